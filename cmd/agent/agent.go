@@ -9,16 +9,24 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/Xide/rssh/cmd/agent/export"
+	"github.com/Xide/rssh/cmd/agent/imports"
 	"github.com/Xide/rssh/cmd/agent/ls"
 	"github.com/Xide/rssh/cmd/agent/register"
 	"github.com/Xide/rssh/cmd/agent/rm"
+	"github.com/Xide/rssh/cmd/output"
+	"github.com/Xide/rssh/cmd/version"
 	"github.com/Xide/rssh/pkg/agent"
 )
 
 // Flags unmarshall directly to the agent definition
 type Flags = agent.Agent
 
-func getRSSHBaseDirectory() string {
+// DefaultAPIPort is the default port of the API on the root domain
+const DefaultAPIPort = 9321
+
+// DefaultRootDirectory returns the default agent configuration directory
+func DefaultRootDirectory() string {
 	user, err := user.Current()
 	if err != nil {
 		cwd, err := os.Getwd()
@@ -32,16 +40,19 @@ func getRSSHBaseDirectory() string {
 
 // NewCommand return the agent entrypoint command
 func NewCommand(flags *Flags) *cobra.Command {
+	flags.Version = version.Version
 	cmd := &cobra.Command{
 		Use:   "agent",
 		Short: "Expose your SSH server.",
 		Long:  `Expose your SSH server.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Validate()
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			log.Info().
 				Str("root-dir", flags.RootDirectory).
 				Msg("Starting RSSH agent.")
-			flags.Run()
-			return nil
+			return flags.Run()
 		},
 	}
 
@@ -49,7 +60,7 @@ func NewCommand(flags *Flags) *cobra.Command {
 		&flags.RootDirectory,
 		"config-dir",
 		"c",
-		getRSSHBaseDirectory(),
+		DefaultRootDirectory(),
 		"Directory used to store secret keys",
 	)
 	viper.BindPFlag("agent.root_directory", cmd.PersistentFlags().Lookup("config-dir"))
@@ -57,13 +68,57 @@ func NewCommand(flags *Flags) *cobra.Command {
 	cmd.PersistentFlags().Uint16Var(
 		&flags.APIPort,
 		"api-port",
-		9321,
+		DefaultAPIPort,
 		"Port on which the HTTP API will listen on the root domain",
 	)
 	viper.BindPFlag("api.port", cmd.PersistentFlags().Lookup("api-port"))
 
+	cmd.PersistentFlags().StringVar(
+		&flags.Proxy,
+		"proxy",
+		"",
+		"Proxy used to reach RSSH servers (http://[user:pass@]host:port or socks5://[user:pass@]host:port), defaults to HTTP_PROXY / HTTPS_PROXY / ALL_PROXY except for NO_PROXY hosts",
+	)
+	viper.BindPFlag("agent.proxy", cmd.PersistentFlags().Lookup("proxy"))
+
+	cmd.PersistentFlags().StringVar(
+		&flags.Transport,
+		"transport",
+		agent.TransportTCP,
+		"Transport used to reach the gatekeeper (tcp or websocket)",
+	)
+	viper.BindPFlag("agent.transport", cmd.PersistentFlags().Lookup("transport"))
+
+	cmd.PersistentFlags().StringVar(
+		&flags.KeyEncryption,
+		"key-encryption",
+		agent.KeyEncryptionNone,
+		"Encryption of the private keys at rest (none, passphrase or keyring)",
+	)
+	viper.BindPFlag("agent.key_encryption", cmd.PersistentFlags().Lookup("key-encryption"))
+
+	cmd.PersistentFlags().StringVar(
+		&flags.PassphraseFile,
+		"key-passphrase-file",
+		"",
+		"File containing the private keys passphrase, defaults to "+agent.KeyPassphraseEnv,
+	)
+	viper.BindPFlag("agent.passphrase_file", cmd.PersistentFlags().Lookup("key-passphrase-file"))
+
+	cmd.PersistentFlags().StringVar(
+		&flags.KeyringFile,
+		"keyring-file",
+		"",
+		"Keyring file holding the private keys secret, required by the keyring encryption (outside of the root directory)",
+	)
+	viper.BindPFlag("agent.keyring_file", cmd.PersistentFlags().Lookup("keyring-file"))
+
+	output.AddFlag(cmd.PersistentFlags())
+
 	cmd.AddCommand(register.NewCommand(flags))
 	cmd.AddCommand(ls.NewCommand(flags))
 	cmd.AddCommand(rm.NewCommand(flags))
+	cmd.AddCommand(export.NewCommand(flags))
+	cmd.AddCommand(imports.NewCommand(flags))
 	return cmd
 }
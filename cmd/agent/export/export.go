@@ -0,0 +1,100 @@
+package export
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/Xide/rssh/pkg/agent"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// Flags is the configuration of an identity export
+type Flags struct {
+	All            bool
+	Output         string
+	Encrypt        bool
+	PassphraseFile string
+}
+
+func parseArgsE(flags *Flags, args []string) error {
+	if flags.All && len(args) > 0 {
+		return errors.New("identities can't be specified along with --all")
+	}
+	if !flags.All && len(args) == 0 {
+		return errors.New("specify the identities to export, or --all")
+	}
+	return nil
+}
+
+// NewCommand return the identity export cobra command
+func NewCommand(a *agent.Agent) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export identities.",
+		Long: `Export identities (by domain or UID) in a portable bundle,
+that can be installed on another machine with 'rssh agent import'.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return parseArgsE(&flags, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := a.Init(); err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("Could not initialize RSSH agent.")
+				os.Exit(1)
+			}
+			var passphrase []byte
+			if flags.Encrypt || flags.PassphraseFile != "" {
+				var err error
+				passphrase, err = agent.ReadPassphrase(flags.PassphraseFile, agent.BundlePassphraseEnv, true)
+				if err != nil {
+					return err
+				}
+			}
+			bundle, err := a.ExportIdentities(args, passphrase)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(flags.Output, bundle, 0600); err != nil {
+				return err
+			}
+			log.Info().
+				Str("file", flags.Output).
+				Bool("encrypted", len(passphrase) > 0).
+				Msg("Identities exported.")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(
+		&flags.All,
+		"all",
+		"a",
+		false,
+		"Export all the identities, for backup",
+	)
+	cmd.Flags().StringVarP(
+		&flags.Output,
+		"file",
+		"f",
+		"rssh-identities.json",
+		"File in which the bundle is written",
+	)
+	cmd.Flags().BoolVarP(
+		&flags.Encrypt,
+		"encrypt",
+		"e",
+		false,
+		"Encrypt the bundle with a passphrase (prompted, or read from "+agent.BundlePassphraseEnv+"), required with key encryption",
+	)
+	cmd.Flags().StringVar(
+		&flags.PassphraseFile,
+		"passphrase-file",
+		"",
+		"File containing the passphrase used to encrypt the bundle",
+	)
+	return cmd
+}
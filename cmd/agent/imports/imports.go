@@ -0,0 +1,72 @@
+package imports
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/Xide/rssh/pkg/agent"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// Flags is the configuration of an identity import
+type Flags struct {
+	Overwrite      bool
+	PassphraseFile string
+}
+
+// NewCommand return the identity import cobra command
+func NewCommand(a *agent.Agent) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import identities.",
+		Long:  `Validate and install the identities of a bundle created with 'rssh agent export'.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := a.Init(); err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("Could not initialize RSSH agent.")
+				os.Exit(1)
+			}
+			bundle, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			sealed, err := agent.IsSealedBundle(bundle)
+			if err != nil {
+				return err
+			}
+			var passphrase []byte
+			if sealed {
+				passphrase, err = agent.ReadPassphrase(flags.PassphraseFile, agent.BundlePassphraseEnv, false)
+				if err != nil {
+					return err
+				}
+			}
+			imported, err := a.ImportIdentities(bundle, passphrase, flags.Overwrite)
+			if err != nil {
+				return err
+			}
+			log.Info().
+				Int("count", len(imported)).
+				Msg("Identities imported.")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(
+		&flags.Overwrite,
+		"overwrite",
+		false,
+		"Replace the existing identities with the same domain, and the machine identity",
+	)
+	cmd.Flags().StringVar(
+		&flags.PassphraseFile,
+		"passphrase-file",
+		"",
+		"File containing the passphrase of an encrypted bundle",
+	)
+	return cmd
+}
@@ -1,10 +1,9 @@
 package ls
 
 import (
-	"fmt"
 	"os"
-	"strings"
 
+	"github.com/Xide/rssh/cmd/output"
 	"github.com/Xide/rssh/pkg/agent"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -34,14 +33,7 @@ func NewCommand(a *agent.Agent) *cobra.Command {
 					Msg("Could not initialize RSSH agent.")
 				os.Exit(1)
 			}
-			fmt.Printf("|%s|\n", strings.Repeat("-", 1+(38*2)))
-			fmt.Printf("| %-36s | %-36s | \n", "Domain", "UID")
-			fmt.Printf("|%s|\n", strings.Repeat("-", 1+(38*2)))
-			a.WalkIdentities(func(fw *agent.ForwardedHost) {
-				fmt.Printf("| %-36s | %-36s |\n", fw.Domain, fw.UID)
-			})
-			fmt.Printf("|%s|\n", strings.Repeat("-", 1+(38*2)))
-			return nil
+			return output.PrintIdentities(a.Identities())
 		},
 	}
 
@@ -4,8 +4,11 @@ import (
 	"errors"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/Xide/rssh/cmd/output"
 	"github.com/Xide/rssh/pkg/agent"
+	"github.com/Xide/rssh/pkg/utils"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -21,12 +24,26 @@ func parseArgsE(flags *Flags) error {
 		return errors.New("domain is mandatory")
 	}
 
+	flags.Root = viper.GetString("register.root_domain")
 	flags.Host = viper.GetString("register.host")
 	p, err := strconv.ParseUint(viper.GetString("register.port"), 10, 16)
 	if err != nil {
 		return err
 	}
 	flags.Port = uint16(p)
+	if strings.HasPrefix(flags.Host, "unix://") {
+		// Port is meaningless for unix domain sockets
+		flags.Port = 0
+	}
+
+	flags.Targets = []agent.Target{}
+	for _, raw := range utils.SplitParts(viper.GetStringSlice("register.targets")) {
+		t, err := agent.ParseTarget(raw)
+		if err != nil {
+			return err
+		}
+		flags.Targets = append(flags.Targets, *t)
+	}
 	return nil
 }
 
@@ -62,7 +79,11 @@ func NewCommand(agent *agent.Agent) *cobra.Command {
 					Msg("Domain registration failed.")
 				os.Exit(1)
 			}
-			return nil
+			info, err := agent.Identity(flags.Domain)
+			if err != nil {
+				return err
+			}
+			return output.PrintIdentity(info)
 		},
 	}
 
@@ -75,12 +96,21 @@ func NewCommand(agent *agent.Agent) *cobra.Command {
 	)
 	viper.BindPFlag("register.domain", cmd.Flags().Lookup("domain"))
 
+	cmd.Flags().StringVarP(
+		&flags.Root,
+		"root-domain",
+		"r",
+		"",
+		"RSSH root domain of the domain, required for names outside of the configured root domains with more than three labels",
+	)
+	viper.BindPFlag("register.root_domain", cmd.Flags().Lookup("root-domain"))
+
 	cmd.Flags().StringVarP(
 		&flags.Host,
 		"host",
 		"a",
 		"127.0.0.1",
-		"Host to expose through agent",
+		"Host to expose through agent, or unix:///path for a unix domain socket",
 	)
 	viper.BindPFlag("register.host", cmd.Flags().Lookup("host"))
 
@@ -93,5 +123,13 @@ func NewCommand(agent *agent.Agent) *cobra.Command {
 	)
 	viper.BindPFlag("register.port", cmd.Flags().Lookup("port"))
 
+	cmd.Flags().StringSliceP(
+		"target",
+		"t",
+		[]string{},
+		"Additional named target to expose (format: 'name=host:port' or 'name=unix:///path', repeatable)",
+	)
+	viper.BindPFlag("register.targets", cmd.Flags().Lookup("target"))
+
 	return cmd
 }
@@ -3,6 +3,7 @@ package rm
 import (
 	"os"
 
+	"github.com/Xide/rssh/cmd/output"
 	"github.com/Xide/rssh/pkg/agent"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -33,14 +34,20 @@ func NewCommand(a *agent.Agent) *cobra.Command {
 					Msg("Could not initialize RSSH agent.")
 				os.Exit(1)
 			}
+			removed := []agent.IdentityInfo{}
 			for _, x := range args {
-				if err := a.RemoveIdentity(x); err != nil {
+				info, err := a.Identity(x)
+				if err == nil {
+					err = a.RemoveIdentity(x)
+				}
+				if err != nil {
 					log.Warn().Str("error", err.Error()).Msg("Could not remove identity")
 				} else {
 					log.Info().Msg("Identity removed")
+					removed = append(removed, *info)
 				}
 			}
-			return nil
+			return output.PrintIdentities(removed)
 		},
 	}
 
@@ -0,0 +1,44 @@
+package agents
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Xide/rssh/cmd/output"
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+// NewCommand return the registered agents listing cobra command
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agents [agent-id...]",
+		Short: "List the registered agents.",
+		Long: `List the registered agents (all of them if no ID is given),
+with their machine description and the domains they own.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			etcdConfig, err := utils.GetEtcdConfig()
+			if err != nil {
+				return err
+			}
+			k, err := utils.GetEtcdKey(etcdConfig)
+			if err != nil {
+				return err
+			}
+			agents, err := api.ListAgents(*k, args...)
+			if err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("Failed to list agents.")
+				return err
+			}
+			return output.PrintAgents(agents)
+		},
+	}
+	cmd.SilenceUsage = true
+	output.AddFlag(cmd.Flags())
+	return cmd
+}
@@ -1,10 +1,16 @@
 package api
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/Xide/rssh/cmd/api/agents"
+	"github.com/Xide/rssh/cmd/api/token"
 	"github.com/Xide/rssh/pkg/api"
 	"github.com/Xide/rssh/pkg/utils"
 	"github.com/spf13/cobra"
@@ -14,15 +20,46 @@ import (
 // Flags are injected by parent command
 // from the cli > env > config file > defaults
 type Flags struct {
-	BindAddr      string `mapstructure:"addr"`
-	BindPort      uint16 `mapstructure:"port"`
-	RootDomain    string `mapstructure:"domain"`
+	BindAddr      string           `mapstructure:"addr"`
+	BindPort      uint16           `mapstructure:"port"`
+	RootDomain    string           `mapstructure:"domain"`
+	Roots         []api.RootDomain `mapstructure:"roots"`
+	DrainTimeout  time.Duration    `mapstructure:"drain_timeout"`
 	EtcdEndpoints []string
+	Etcd          utils.EtcdConfig
+}
+
+// RootDomains returns the rssh root domains configured, the default
+// one (`api.domain`) first, followed by the additional `api.roots`.
+// They are shared with the gatekeeper and the clients, to split the
+// requested names into the subdomain and the root domain.
+func RootDomains() []string {
+	res := []string{}
+	if root := viper.GetString("api.domain"); len(root) > 0 {
+		res = append(res, root)
+	}
+	roots := []api.RootDomain{}
+	if err := viper.UnmarshalKey("api.roots", &roots); err != nil {
+		return res
+	}
+	for _, root := range roots {
+		if len(root.Domain) > 0 {
+			res = append(res, root.Domain)
+		}
+	}
+	return res
 }
 
 func parseArgs(flags *Flags) error {
 	// Shared resource not directly available through mapstructure
-	flags.EtcdEndpoints = utils.SplitParts(viper.GetStringSlice("etcd.endpoints"))
+	etcdConfig, err := utils.GetEtcdConfig()
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Invalid etcd configuration.")
+		return err
+	}
+	flags.Etcd = etcdConfig
 
 	// Domain validation
 	if !utils.IsValidDomain(flags.RootDomain) {
@@ -49,13 +86,30 @@ func NewCommand(flags *Flags) *cobra.Command {
 				flags.BindAddr,
 				flags.BindPort,
 				flags.RootDomain,
-				flags.EtcdEndpoints,
+				flags.Roots,
+				flags.Etcd,
 			)
 			if err != nil {
 				log.Error().Str("error", err.Error()).Msg("Failed to start HTTP API dispatcher")
 				os.Exit(1)
 			}
-			err = httpAPI.Run()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- httpAPI.Run()
+			}()
+			select {
+			case err = <-errs:
+			case sig := <-signals:
+				log.Info().
+					Str("signal", sig.String()).
+					Dur("drain_timeout", flags.DrainTimeout).
+					Msg("Shutting down HTTP API")
+				ctx, cancel := context.WithTimeout(context.Background(), flags.DrainTimeout)
+				defer cancel()
+				err = httpAPI.Shutdown(ctx)
+			}
 			if err != nil {
 				log.Error().Str("error", err.Error()).Msg("API server failed unexpectedly")
 				os.Exit(1)
@@ -82,6 +136,14 @@ func NewCommand(flags *Flags) *cobra.Command {
 	)
 	viper.BindPFlag("api.port", cmd.PersistentFlags().Lookup("port"))
 
+	cmd.Flags().DurationVar(
+		&flags.DrainTimeout,
+		"drain-timeout",
+		10*time.Second,
+		"Maximum time waiting for the pending requests to complete on shutdown",
+	)
+	viper.BindPFlag("api.drain_timeout", cmd.Flags().Lookup("drain-timeout"))
+
 	cmd.PersistentFlags().StringSliceVarP(
 		&flags.EtcdEndpoints,
 		"etcd",
@@ -91,5 +153,7 @@ func NewCommand(flags *Flags) *cobra.Command {
 	)
 	viper.BindPFlag("etcd.endpoints", cmd.PersistentFlags().Lookup("etcd"))
 
+	cmd.AddCommand(token.NewCommand())
+	cmd.AddCommand(agents.NewCommand())
 	return cmd
 }
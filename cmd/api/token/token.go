@@ -0,0 +1,111 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+// Flags are the options of the API token creation
+type Flags struct {
+	User    string
+	Domains []string
+}
+
+func newCreateCommand() *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API token.",
+		Long: `Create an API token allowing a user to list the domains matching the patterns.
+The token is printed on the standard output, and can't be retrieved afterwards.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(flags.Domains) == 0 {
+				return errors.New("at least one domain pattern is mandatory")
+			}
+			etcdConfig, err := utils.GetEtcdConfig()
+			if err != nil {
+				return err
+			}
+			k, err := utils.GetEtcdKey(etcdConfig)
+			if err != nil {
+				return err
+			}
+			token, err := api.CreateToken(*k, flags.User, utils.SplitParts(flags.Domains))
+			if err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Str("user", flags.User).
+					Msg("Failed to create API token.")
+				return err
+			}
+			fmt.Println(token)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(
+		&flags.User,
+		"user",
+		"u",
+		"",
+		"Name of the token owner",
+	)
+	cmd.MarkFlagRequired("user")
+	cmd.Flags().StringSliceVarP(
+		&flags.Domains,
+		"domain",
+		"d",
+		[]string{},
+		"Subdomain pattern visible with the token (e.g: 'dev-*', '*' for all, repeatable)",
+	)
+	return cmd
+}
+
+func newRevokeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <token>",
+		Short: "Revoke an API token.",
+		Long:  `Revoke an API token.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			etcdConfig, err := utils.GetEtcdConfig()
+			if err != nil {
+				return err
+			}
+			k, err := utils.GetEtcdKey(etcdConfig)
+			if err != nil {
+				return err
+			}
+			if err := api.RevokeToken(*k, args[0]); err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("Failed to revoke API token.")
+				return err
+			}
+			log.Info().Msg("API token revoked.")
+			return nil
+		},
+	}
+}
+
+// NewCommand return the API tokens management cobra command
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage the API tokens.",
+		Long:  `Manage the tokens authenticating the users of the domains discovery API.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+	cmd.SilenceUsage = true
+	cmd.AddCommand(newCreateCommand())
+	cmd.AddCommand(newRevokeCommand())
+	return cmd
+}
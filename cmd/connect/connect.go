@@ -0,0 +1,79 @@
+package connect
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	agentcmd "github.com/Xide/rssh/cmd/agent"
+	"github.com/Xide/rssh/pkg/client"
+)
+
+// Flags unmarshall directly to the client definition
+type Flags = client.Client
+
+// NewCommand return the client connection cobra command
+func NewCommand(flags *Flags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "connect <domain>",
+		Short: "Connect to an exposed domain.",
+		Long: `Bridge the standard input and output with an exposed domain (or domain:target),
+through the gatekeeper discovered from the API of the root domain.
+It is meant to be used as an SSH ProxyCommand:
+
+  ssh -o ProxyCommand='rssh connect %h' subdomain.baguette.localhost`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.Connect(args[0], os.Stdin, os.Stdout)
+		},
+	}
+	cmd.SilenceUsage = true
+
+	cmd.Flags().Uint16Var(
+		&flags.APIPort,
+		"api-port",
+		agentcmd.DefaultAPIPort,
+		"Port on which the HTTP API listen on the root domain",
+	)
+	viper.BindPFlag("client.api_port", cmd.Flags().Lookup("api-port"))
+
+	cmd.Flags().StringVarP(
+		&flags.IdentityFile,
+		"identity",
+		"i",
+		"",
+		"Private key offered to the gatekeeper, in addition to the ssh-agent keys",
+	)
+	viper.BindPFlag("client.identity_file", cmd.Flags().Lookup("identity"))
+	addHostKeyFlags(cmd, flags)
+	return cmd
+}
+
+// addHostKeyFlags registers the flags of the gatekeeper host key
+// verification, bound to the `client` configuration.
+func addHostKeyFlags(cmd *cobra.Command, flags *Flags) {
+	cmd.Flags().BoolVar(
+		&flags.APITLS,
+		"api-tls",
+		false,
+		"Reach the API over HTTPS, and trust the gatekeeper host keys it publishes",
+	)
+	viper.BindPFlag("client.api_tls", cmd.Flags().Lookup("api-tls"))
+
+	cmd.Flags().StringVar(
+		&flags.KnownHosts,
+		"known-hosts",
+		"",
+		"known_hosts file pinning the gatekeeper host keys",
+	)
+	viper.BindPFlag("client.known_hosts", cmd.Flags().Lookup("known-hosts"))
+
+	cmd.Flags().BoolVar(
+		&flags.Insecure,
+		"insecure",
+		false,
+		"Skip the verification of the gatekeeper host key",
+	)
+	viper.BindPFlag("client.insecure", cmd.Flags().Lookup("insecure"))
+}
@@ -0,0 +1,126 @@
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	agentcmd "github.com/Xide/rssh/cmd/agent"
+	"github.com/Xide/rssh/cmd/output"
+	"github.com/Xide/rssh/pkg/agent"
+)
+
+// Flags override the agent configuration used by the diagnostics
+type Flags struct {
+	RootDirectory string
+	APIPort       uint16
+}
+
+// diagnoseConfig reports how the configuration was resolved.
+func diagnoseConfig() agent.Diagnostic {
+	d := agent.Diagnostic{Check: "config"}
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		d.Status = agent.DiagnosticWarn
+		d.Detail = "no configuration file, using defaults"
+		d.Hint = "create a .rssh.yml in the current or home directory, or use --config"
+		return d
+	}
+	if _, err := os.Stat(file); err != nil {
+		d.Status = agent.DiagnosticFail
+		d.Detail = err.Error()
+		d.Hint = "check the path given with --config"
+		return d
+	}
+	d.Status = agent.DiagnosticPass
+	d.Detail = file
+	return d
+}
+
+// applyDefaults fills the agent settings that are usually
+// set by the `rssh agent` flags.
+func applyDefaults(cmd *cobra.Command, a *agent.Agent, flags *Flags) {
+	if cmd.Flags().Changed("config-dir") || a.RootDirectory == "" {
+		a.RootDirectory = flags.RootDirectory
+	}
+	if cmd.Flags().Changed("api-port") || a.APIPort == 0 {
+		a.APIPort = flags.APIPort
+	}
+}
+
+func printReport(results []agent.Diagnostic) error {
+	return output.Print(results, func(w io.Writer) {
+		fmt.Fprintln(w, "DOMAIN\tCHECK\tSTATUS\tDETAIL\tHINT")
+		for _, x := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", x.Domain, x.Check, x.Status, x.Detail, x.Hint)
+		}
+	})
+}
+
+// NewCommand return the diagnostics cobra command
+func NewCommand(a *agent.Agent) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "doctor [domain...]",
+		Short: "Diagnose the agent connectivity.",
+		Long: `Check the configuration, DNS, API, gatekeeper, SSH handshake,
+slots and local targets of the domains (or all the identities),
+and print a report with remediation hints.
+The checks are read-only: the identities are not modified, and no
+slot is allocated on the gatekeeper (the state of the current slots
+is reported by the API).`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			applyDefaults(cmd, a, &flags)
+			results := []agent.Diagnostic{diagnoseConfig()}
+			if err := a.Load(); err != nil {
+				results = append(results, agent.Diagnostic{
+					Check:  "agent",
+					Status: agent.DiagnosticFail,
+					Detail: err.Error(),
+					Hint:   "fix the agent configuration",
+				})
+			} else {
+				if len(args) == 0 {
+					args = a.Domains()
+				}
+				for _, domain := range args {
+					results = append(results, a.Diagnose(domain)...)
+				}
+			}
+
+			if err := printReport(results); err != nil {
+				return err
+			}
+			for _, x := range results {
+				if x.Status == agent.DiagnosticFail {
+					log.Error().Msg("Some checks failed.")
+					os.Exit(1)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(
+		&flags.RootDirectory,
+		"config-dir",
+		"c",
+		agentcmd.DefaultRootDirectory(),
+		"Directory used to store secret keys",
+	)
+	cmd.Flags().Uint16Var(
+		&flags.APIPort,
+		"api-port",
+		agentcmd.DefaultAPIPort,
+		"Port on which the HTTP API will listen on the root domain",
+	)
+	output.AddFlag(cmd.Flags())
+	return cmd
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"net"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Xide/rssh/pkg/client"
+)
+
+// Flags are the local forwarding options. The connection settings
+// override the `client` configuration when they are set.
+type Flags struct {
+	ListenAddr   string
+	APIPort      uint16
+	IdentityFile string
+	APITLS       bool
+	KnownHosts   string
+	Insecure     bool
+}
+
+// listenAddress accepts a port alone, bound to the loopback interface.
+func listenAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort("127.0.0.1", addr)
+	}
+	return addr
+}
+
+// NewCommand return the local port forwarding cobra command
+func NewCommand(c *client.Client) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "forward <domain[:target]>",
+		Short: "Forward a local port to an exposed service.",
+		Long: `Listen on a local address, and bridge each accepted connection with an exposed
+domain (or domain:target) through the gatekeeper, e.g:
+
+  rssh forward subdomain.baguette.localhost:pg -L 127.0.0.1:5432`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed("api-port") {
+				c.APIPort = flags.APIPort
+			}
+			if cmd.Flags().Changed("identity") {
+				c.IdentityFile = flags.IdentityFile
+			}
+			if cmd.Flags().Changed("api-tls") {
+				c.APITLS = flags.APITLS
+			}
+			if cmd.Flags().Changed("known-hosts") {
+				c.KnownHosts = flags.KnownHosts
+			}
+			if cmd.Flags().Changed("insecure") {
+				c.Insecure = flags.Insecure
+			}
+			return c.Forward(args[0], listenAddress(flags.ListenAddr))
+		},
+	}
+	cmd.SilenceUsage = true
+
+	cmd.Flags().StringVarP(
+		&flags.ListenAddr,
+		"local",
+		"L",
+		"",
+		"Local address (or port) on which connections are accepted",
+	)
+	cmd.MarkFlagRequired("local")
+	cmd.Flags().Uint16Var(
+		&flags.APIPort,
+		"api-port",
+		0,
+		"Port on which the HTTP API listen on the root domain",
+	)
+	cmd.Flags().StringVarP(
+		&flags.IdentityFile,
+		"identity",
+		"i",
+		"",
+		"Private key offered to the gatekeeper, in addition to the ssh-agent keys",
+	)
+	cmd.Flags().BoolVar(
+		&flags.APITLS,
+		"api-tls",
+		false,
+		"Reach the API over HTTPS, and trust the gatekeeper host keys it publishes",
+	)
+	cmd.Flags().StringVar(
+		&flags.KnownHosts,
+		"known-hosts",
+		"",
+		"known_hosts file pinning the gatekeeper host keys",
+	)
+	cmd.Flags().BoolVar(
+		&flags.Insecure,
+		"insecure",
+		false,
+		"Skip the verification of the gatekeeper host key",
+	)
+	return cmd
+}
@@ -1,13 +1,18 @@
 package gatekeeper
 
 import (
+	"context"
 	"errors"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
+	apicmd "github.com/Xide/rssh/cmd/api"
 	"github.com/Xide/rssh/pkg/gatekeeper"
 	"github.com/Xide/rssh/pkg/utils"
 	"github.com/spf13/cobra"
@@ -17,13 +22,27 @@ import (
 // Flags are injected by parent command
 // from the cli > env > config file > defaults
 type Flags struct {
-	BindAddr      string `mapstructure:"ssh_addr"`
-	BindPort      uint16 `mapstructure:"ssh_port"`
-	SSHPortRange  string `mapstructure:"ssh_port_range"`
-	HostKeyFile   string `mapstructure:"ssh_host_key"`
+	BindAddr      string        `mapstructure:"ssh_addr"`
+	BindPort      uint16        `mapstructure:"ssh_port"`
+	SSHPortRange  string        `mapstructure:"ssh_port_range"`
+	HostKeyFile   string        `mapstructure:"ssh_host_key"`
+	WSAddr        string        `mapstructure:"ws_addr"`
+	WSPort        uint16        `mapstructure:"ws_port"`
+	TLSCert       string        `mapstructure:"tls_cert"`
+	TLSKey        string        `mapstructure:"tls_key"`
+	AuditLog      string        `mapstructure:"audit_log"`
+	RecordDomains []string      `mapstructure:"record_domains"`
+	RecordingsDir string        `mapstructure:"recordings_dir"`
+	RecordingKey  string        `mapstructure:"recording_key"`
+	RecordInput   bool          `mapstructure:"record_input"`
+	DrainTimeout  time.Duration `mapstructure:"drain_timeout"`
+	HealthAddr    string        `mapstructure:"health_addr"`
+	HealthPort    uint16        `mapstructure:"health_port"`
 	SSHPortLow    uint16
 	SSHPortHigh   uint16
+	RootDomains   []string
 	EtcdEndpoints []string
+	Etcd          utils.EtcdConfig
 }
 
 func parsePortRange(raw string) (uint16, uint16, error) {
@@ -46,7 +65,16 @@ func parsePortRange(raw string) (uint16, uint16, error) {
 
 func parseArgsE(flags *Flags) error {
 	// Shared resource not directly available through mapstructure
-	flags.EtcdEndpoints = utils.SplitParts(viper.GetStringSlice("etcd.endpoints"))
+	etcdConfig, err := utils.GetEtcdConfig()
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Invalid etcd configuration.")
+		return err
+	}
+	flags.Etcd = etcdConfig
+	flags.RecordDomains = utils.SplitParts(viper.GetStringSlice("gatekeeper.record_domains"))
+	flags.RootDomains = apicmd.RootDomains()
 
 	// SSH port range parsing
 	pRangeLow, pRangeHigh, err := parsePortRange(viper.GetString("gatekeeper.ssh_port_range"))
@@ -85,12 +113,31 @@ func NewCommand(flags *Flags) *cobra.Command {
 					Msg("Could not start Gatekeeper")
 			}
 
-			if err := g.WithEtcdE(flags.EtcdEndpoints); err != nil {
+			if err := g.WithEtcdE(flags.Etcd); err != nil {
 				log.Error().
 					Str("error", err.Error()).
 					Msg("Etcd unreachable")
 				os.Exit(1)
 			}
+			g.WithRootDomains(flags.RootDomains)
+
+			if flags.WSPort != 0 {
+				g.WithWebSocket(flags.WSAddr, flags.WSPort, flags.TLSCert, flags.TLSKey)
+			}
+
+			if flags.HealthPort != 0 {
+				g.WithHealth(flags.HealthAddr, flags.HealthPort)
+			}
+
+			if len(flags.AuditLog) != 0 {
+				if err := g.WithAudit(flags.AuditLog); err != nil {
+					log.Error().
+						Str("error", err.Error()).
+						Str("sink", flags.AuditLog).
+						Msg("Failed to open audit log")
+					os.Exit(1)
+				}
+			}
 
 			if err := g.WithHostKey(flags.HostKeyFile); err != nil {
 				log.Error().
@@ -99,9 +146,47 @@ func NewCommand(flags *Flags) *cobra.Command {
 				os.Exit(1)
 			}
 
-			return g.Run()
+			if len(flags.RecordDomains) != 0 {
+				if err := g.WithRecording(flags.RecordingsDir, flags.RecordingKey, flags.RecordDomains, flags.RecordInput); err != nil {
+					log.Error().
+						Str("error", err.Error()).
+						Str("directory", flags.RecordingsDir).
+						Msg("Failed to enable session recording")
+					os.Exit(1)
+				}
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- g.Run()
+			}()
+			for {
+				select {
+				case err := <-errs:
+					return err
+				case sig := <-signals:
+					if sig == syscall.SIGHUP {
+						if err := g.ReloadHostKeys(); err != nil {
+							log.Error().
+								Str("error", err.Error()).
+								Msg("Failed to reload host keys, keeping the current ones")
+						}
+						continue
+					}
+					log.Info().
+						Str("signal", sig.String()).
+						Dur("drain_timeout", flags.DrainTimeout).
+						Msg("Shutting down Gatekeeper")
+					ctx, cancel := context.WithTimeout(context.Background(), flags.DrainTimeout)
+					defer cancel()
+					return g.Shutdown(ctx)
+				}
+			}
 		},
 	}
+	cmd.AddCommand(newRotateHostKeyCommand())
 
 	cmd.Flags().StringVarP(
 		&flags.BindAddr,
@@ -144,9 +229,104 @@ func NewCommand(flags *Flags) *cobra.Command {
 		"host-key",
 		"i",
 		".rssh-gk-host.key",
-		"SSH server host file. If the destination file does not exists, a new one will be generated there.",
+		"SSH server host file. If the destination file does not exists, a new one will be generated there. Reloaded on SIGHUP.",
 	)
 	viper.BindPFlag("gatekeeper.ssh_host_key", cmd.Flags().Lookup("host-key"))
 
+	cmd.Flags().StringVar(
+		&flags.WSAddr,
+		"ws-addr",
+		"0.0.0.0",
+		"SSH over WebSocket server address",
+	)
+	viper.BindPFlag("gatekeeper.ws_addr", cmd.Flags().Lookup("ws-addr"))
+
+	cmd.Flags().Uint16Var(
+		&flags.WSPort,
+		"ws-port",
+		0,
+		"SSH over WebSocket server port, for agents restricted to HTTP(S) (0 to disable)",
+	)
+	viper.BindPFlag("gatekeeper.ws_port", cmd.Flags().Lookup("ws-port"))
+
+	cmd.Flags().StringVar(
+		&flags.TLSCert,
+		"tls-cert",
+		"",
+		"Certificate used to serve SSH over WebSocket with TLS",
+	)
+	viper.BindPFlag("gatekeeper.tls_cert", cmd.Flags().Lookup("tls-cert"))
+
+	cmd.Flags().StringVar(
+		&flags.TLSKey,
+		"tls-key",
+		"",
+		"Private key used to serve SSH over WebSocket with TLS",
+	)
+	viper.BindPFlag("gatekeeper.tls_key", cmd.Flags().Lookup("tls-key"))
+
+	cmd.Flags().StringVar(
+		&flags.AuditLog,
+		"audit-log",
+		"",
+		"Sink of the client sessions audit records: file:///path (JSON lines), syslog, syslog://host:port or etcd",
+	)
+	viper.BindPFlag("gatekeeper.audit_log", cmd.Flags().Lookup("audit-log"))
+
+	cmd.Flags().StringSlice(
+		"record",
+		[]string{},
+		"Subdomain pattern whose sessions are recorded (e.g: 'prod-*', repeatable)",
+	)
+	viper.BindPFlag("gatekeeper.record_domains", cmd.Flags().Lookup("record"))
+
+	cmd.Flags().StringVar(
+		&flags.RecordingsDir,
+		"recordings-dir",
+		"rssh-recordings",
+		"Directory in which the recorded sessions are stored",
+	)
+	viper.BindPFlag("gatekeeper.recordings_dir", cmd.Flags().Lookup("recordings-dir"))
+
+	cmd.Flags().StringVar(
+		&flags.RecordingKey,
+		"recording-key",
+		".rssh-gk-recording.key",
+		"Key of the recorded sessions. If the destination file does not exists, a new one will be generated there.",
+	)
+	viper.BindPFlag("gatekeeper.recording_key", cmd.Flags().Lookup("recording-key"))
+
+	cmd.Flags().BoolVar(
+		&flags.RecordInput,
+		"record-input",
+		false,
+		"Record the input of the recorded sessions, including the secrets typed without echo",
+	)
+	viper.BindPFlag("gatekeeper.record_input", cmd.Flags().Lookup("record-input"))
+
+	cmd.Flags().DurationVar(
+		&flags.DrainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"Maximum time waiting for the client sessions to finish on shutdown",
+	)
+	viper.BindPFlag("gatekeeper.drain_timeout", cmd.Flags().Lookup("drain-timeout"))
+
+	cmd.Flags().StringVar(
+		&flags.HealthAddr,
+		"health-addr",
+		"0.0.0.0",
+		"Health endpoints server address",
+	)
+	viper.BindPFlag("gatekeeper.health_addr", cmd.Flags().Lookup("health-addr"))
+
+	cmd.Flags().Uint16Var(
+		&flags.HealthPort,
+		"health-port",
+		0,
+		"Health endpoints server port (/health/live and /health/ready, 0 to disable)",
+	)
+	viper.BindPFlag("gatekeeper.health_port", cmd.Flags().Lookup("health-port"))
+
 	return cmd
 }
@@ -0,0 +1,104 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Xide/rssh/cmd/output"
+	"github.com/Xide/rssh/pkg/gatekeeper"
+)
+
+// Host key rotation steps
+const (
+	rotationStatus  = "status"
+	rotationStage   = "stage"
+	rotationPromote = "promote"
+	rotationFinish  = "finish"
+)
+
+func printHostKeys(path string) error {
+	keys, err := gatekeeper.ListHostKeys(path)
+	if err != nil {
+		return err
+	}
+	return output.Print(keys, func(w io.Writer) {
+		fmt.Fprintln(w, "ROLE\tFINGERPRINT\tPATH")
+		for _, x := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", x.Role, x.Fingerprint, x.Path)
+		}
+	})
+}
+
+func rotateHostKey(path string, step string) error {
+	var err error
+	switch step {
+	case rotationStatus:
+		return printHostKeys(path)
+	case rotationStage:
+		_, err = gatekeeper.StageHostKey(path)
+	case rotationPromote:
+		err = gatekeeper.PromoteHostKey(path)
+	case rotationFinish:
+		err = gatekeeper.FinishHostKeyRotation(path)
+	default:
+		return fmt.Errorf("unknown rotation step %s", step)
+	}
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Str("step", step).
+			Msg("Host key rotation failed.")
+		return err
+	}
+	log.Info().
+		Str("step", step).
+		Msg("Host key files updated, send SIGHUP to the gatekeeper to apply.")
+	return printHostKeys(path)
+}
+
+func newRotateHostKeyCommand() *cobra.Command {
+	var hostKeyFile string
+	cmd := &cobra.Command{
+		Use:   "rotate-host-key [status|stage|promote|finish]",
+		Short: "Rotate the gatekeeper host key.",
+		Long: `Rotate the gatekeeper host key without breaking the clients and agents pinning it.
+
+The rotation is driven in three steps, each applied by sending SIGHUP to the gatekeeper:
+  stage    generate the next host key, advertised alongside the current one
+           (hostkeys-00@openssh.com and /meta/gatekeeper).
+  promote  once the clients learned the next key, use it in the handshakes.
+           The previous key is still advertised.
+  finish   stop advertising the previous key.
+
+Without step, the host key files are listed.`,
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{rotationStatus, rotationStage, rotationPromote, rotationFinish},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("host-key") {
+				hostKeyFile = viper.GetString("gatekeeper.ssh_host_key")
+			}
+			step := rotationStatus
+			if len(args) != 0 {
+				step = args[0]
+			}
+			return rotateHostKey(hostKeyFile, step)
+		},
+	}
+
+	cmd.Flags().StringVarP(
+		&hostKeyFile,
+		"host-key",
+		"i",
+		".rssh-gk-host.key",
+		"SSH server host file of the gatekeeper",
+	)
+	output.AddFlag(cmd.Flags())
+	return cmd
+}
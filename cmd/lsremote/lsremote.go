@@ -0,0 +1,75 @@
+package lsremote
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Xide/rssh/cmd/output"
+	"github.com/Xide/rssh/pkg/client"
+)
+
+// Flags are the remote listing options. The connection settings
+// override the `client` configuration when they are set.
+type Flags struct {
+	APIPort uint16
+	Token   string
+}
+
+// applyFlags overrides the client settings with the flags set on the command line.
+// The token defaults to the `client.token` configuration (or RSSH_CLIENT_TOKEN).
+func applyFlags(cmd *cobra.Command, flags *Flags, c *client.Client) {
+	if cmd.Flags().Changed("api-port") {
+		c.APIPort = flags.APIPort
+	}
+	if cmd.Flags().Changed("token") {
+		c.Token = flags.Token
+	} else if token := viper.GetString("client.token"); len(token) != 0 {
+		c.Token = token
+	}
+}
+
+// addFlags registers the connection flags of the remote listing.
+func addFlags(cmd *cobra.Command, flags *Flags) {
+	cmd.Flags().Uint16Var(
+		&flags.APIPort,
+		"api-port",
+		0,
+		"Port on which the HTTP API listen on the root domain",
+	)
+	cmd.Flags().StringVar(
+		&flags.Token,
+		"token",
+		"",
+		"API token used to list the domains (default: client.token)",
+	)
+}
+
+// NewCommand return the remote domains listing cobra command
+func NewCommand(c *client.Client) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "ls-remote <root domain>",
+		Short: "List the domains reachable on a root domain.",
+		Long: `List the domains visible with your API token on a root domain,
+along with the state of their targets, e.g:
+
+  rssh ls-remote baguette.localhost --token <token>`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return output.Validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			applyFlags(cmd, &flags, c)
+			domains, err := c.Domains(args[0])
+			if err != nil {
+				return err
+			}
+			return output.PrintDomains(domains)
+		},
+	}
+	cmd.SilenceUsage = true
+
+	addFlags(cmd, &flags)
+	output.AddFlag(cmd.Flags())
+	return cmd
+}
@@ -0,0 +1,44 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+// PrintAgents writes the registered agents in the selected format.
+func PrintAgents(infos []api.AgentInfo) error {
+	return Print(infos, func(w io.Writer) {
+		agentsTable(w, infos)
+	})
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func agentsTable(w io.Writer, infos []api.AgentInfo) {
+	fmt.Fprintln(w, "ID\tHOSTNAME\tVERSION\tLABELS\tDOMAINS")
+	for _, x := range infos {
+		labels := []string{}
+		for k, v := range x.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\n",
+			x.ID,
+			orNone(x.Hostname),
+			orNone(x.Version),
+			orNone(strings.Join(labels, ",")),
+			orNone(strings.Join(x.Domains, ",")),
+		)
+	}
+}
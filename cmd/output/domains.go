@@ -0,0 +1,40 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+// PrintDomains writes the remote domains in the selected format.
+func PrintDomains(infos []api.DomainInfo) error {
+	return Print(infos, func(w io.Writer) {
+		domainsTable(w, infos)
+	})
+}
+
+func state(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+func domainsTable(w io.Writer, infos []api.DomainInfo) {
+	fmt.Fprintln(w, "DOMAIN\tSTATE\tTARGETS")
+	for _, x := range infos {
+		targets := []string{}
+		for _, t := range x.Targets {
+			targets = append(targets, t.Name+"="+state(t.Online))
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\n",
+			x.Domain,
+			state(x.Online),
+			strings.Join(targets, ","),
+		)
+	}
+}
@@ -0,0 +1,49 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/agent"
+)
+
+func endpoint(host string, port uint16) string {
+	t := agent.Target{Host: host, Port: port}
+	return t.Address()
+}
+
+// PrintIdentities writes the identities in the selected format.
+func PrintIdentities(infos []agent.IdentityInfo) error {
+	return Print(infos, func(w io.Writer) {
+		identitiesTable(w, infos)
+	})
+}
+
+// PrintIdentity writes a single identity in the selected format.
+func PrintIdentity(info *agent.IdentityInfo) error {
+	return Print(info, func(w io.Writer) {
+		identitiesTable(w, []agent.IdentityInfo{*info})
+	})
+}
+
+func identitiesTable(w io.Writer, infos []agent.IdentityInfo) {
+	fmt.Fprintln(w, "DOMAIN\tUID\tENDPOINT\tTARGETS\tENABLED\tKEY TYPE\tFINGERPRINT")
+	for _, x := range infos {
+		targets := []string{}
+		for _, t := range x.Targets {
+			targets = append(targets, t.Name+"="+endpoint(t.Host, t.Port))
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			x.Domain,
+			x.UID,
+			endpoint(x.Host, x.Port),
+			strings.Join(targets, ","),
+			x.Enabled,
+			x.KeyType,
+			x.Fingerprint,
+		)
+	}
+}
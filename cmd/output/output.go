@@ -0,0 +1,74 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats of the CLI commands
+const (
+	// Table is the human readable format (default)
+	Table = "table"
+	// JSON is a single JSON document
+	JSON = "json"
+	// YAML is a single YAML document
+	YAML = "yaml"
+)
+
+// format selected with the `--output` flag
+var format = Table
+
+// AddFlag registers the `--output` flag in the flagset.
+func AddFlag(flags *pflag.FlagSet) {
+	flags.StringVarP(
+		&format,
+		"output",
+		"o",
+		Table,
+		"Output format (one of: table,json,yaml)",
+	)
+}
+
+// Validate returns an error if the selected format is unknown.
+func Validate() error {
+	switch format {
+	case Table, JSON, YAML:
+		return nil
+	default:
+		return fmt.Errorf("invalid output format %s", format)
+	}
+}
+
+// IsStructured returns true if the output is meant to be parsed.
+func IsStructured() bool {
+	return format != Table
+}
+
+// Print writes `v` on the standard output in the selected format.
+// `table` renders `v` in the table format, on a writer aligning
+// the tab separated columns.
+func Print(v interface{}, table func(w io.Writer)) error {
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case YAML:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		table(w)
+		return w.Flush()
+	}
+}
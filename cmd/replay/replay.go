@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/Xide/rssh/pkg/asciicast"
+)
+
+// Flags are the playback options
+type Flags struct {
+	Speed     float64
+	IdleLimit time.Duration
+}
+
+// NewCommand return the session recording playback cobra command
+func NewCommand() *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "replay <recording.cast>",
+		Short: "Play back a recorded session.",
+		Long: `Play back in the terminal a session recorded by the gatekeeper
+(asciicast v2 format, also playable with asciinema), e.g:
+
+  rssh replay rssh-recordings/prod/20190210T034811Z-1a2b3c4d-0.cast --speed 2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return asciicast.Play(f, os.Stdout, flags.Speed, flags.IdleLimit)
+		},
+	}
+	cmd.SilenceUsage = true
+
+	cmd.Flags().Float64VarP(
+		&flags.Speed,
+		"speed",
+		"s",
+		1,
+		"Playback speed multiplier",
+	)
+	cmd.Flags().DurationVarP(
+		&flags.IdleLimit,
+		"idle-limit",
+		"i",
+		0,
+		"Maximum pause between two outputs (e.g: 2s), 0 to keep the recorded timing",
+	)
+	return cmd
+}
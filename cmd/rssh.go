@@ -17,7 +17,13 @@ import (
 
 	"github.com/Xide/rssh/cmd/agent"
 	"github.com/Xide/rssh/cmd/api"
+	"github.com/Xide/rssh/cmd/connect"
+	"github.com/Xide/rssh/cmd/doctor"
+	"github.com/Xide/rssh/cmd/forward"
 	"github.com/Xide/rssh/cmd/gatekeeper"
+	"github.com/Xide/rssh/cmd/lsremote"
+	"github.com/Xide/rssh/cmd/replay"
+	"github.com/Xide/rssh/cmd/sshconfig"
 	"github.com/Xide/rssh/cmd/version"
 )
 
@@ -32,6 +38,7 @@ type Flags struct {
 	APIFlags        api.Flags        `mapstructure:"api"`
 	GatekeeperFlags gatekeeper.Flags `mapstructure:"gatekeeper"`
 	AgentFlags      agent.Flags      `mapstructure:"agent"`
+	ClientFlags     connect.Flags    `mapstructure:"client"`
 }
 
 func parseLogLevel(strLevel string) zerolog.Level {
@@ -59,7 +66,8 @@ func setupLogLevel(flags *Flags) error {
 
 	raw := viper.GetString("log_level")
 	ll := parseLogLevel(raw)
-	isTerminal := terminal.IsTerminal(int(os.Stdout.Fd()))
+	// Logs are written on stderr, leaving stdout to the commands output
+	isTerminal := terminal.IsTerminal(int(os.Stderr.Fd()))
 	if isTerminal {
 		fmtLevel = func(i interface{}) string {
 			switch i.(string) {
@@ -82,7 +90,7 @@ func setupLogLevel(flags *Flags) error {
 	}
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out:         os.Stdout,
+		Out:         os.Stderr,
 		TimeFormat:  time.RFC3339,
 		NoColor:     !isTerminal,
 		FormatLevel: fmtLevel,
@@ -100,6 +108,9 @@ func NewCommand(flags *Flags) *cobra.Command {
 	cobra.OnInitialize(func() {
 		utils.InitConfig(flags)
 		setupLogLevel(flags)
+		// The root domains of the API split the names of the agents and clients
+		flags.AgentFlags.RootDomains = api.RootDomains()
+		flags.ClientFlags.RootDomains = api.RootDomains()
 	})
 	cmd := &cobra.Command{
 		Use:   "rssh",
@@ -131,6 +142,12 @@ func NewCommand(flags *Flags) *cobra.Command {
 	cmd.AddCommand(agent.NewCommand(&flags.AgentFlags))
 	cmd.AddCommand(api.NewCommand(&flags.APIFlags))
 	cmd.AddCommand(gatekeeper.NewCommand(&flags.GatekeeperFlags))
+	cmd.AddCommand(doctor.NewCommand(&flags.AgentFlags))
+	cmd.AddCommand(connect.NewCommand(&flags.ClientFlags))
+	cmd.AddCommand(forward.NewCommand(&flags.ClientFlags))
+	cmd.AddCommand(sshconfig.NewCommand(&flags.ClientFlags))
+	cmd.AddCommand(lsremote.NewCommand(&flags.ClientFlags))
+	cmd.AddCommand(replay.NewCommand())
 
 	return cmd
 }
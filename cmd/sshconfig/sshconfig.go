@@ -0,0 +1,134 @@
+package sshconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	agentcmd "github.com/Xide/rssh/cmd/agent"
+	"github.com/Xide/rssh/pkg/client"
+)
+
+// Flags are the options of the generated ProxyCommand
+type Flags struct {
+	APIPort      uint16
+	IdentityFile string
+	APITLS       bool
+	KnownHosts   string
+	// Root domain on which the visible domains are listed
+	Remote string
+	Token  string
+}
+
+// proxyCommand returns the `rssh connect` invocation of the current binary.
+func proxyCommand(flags *Flags) string {
+	bin, err := os.Executable()
+	if err != nil {
+		bin = "rssh"
+	}
+	cmd := []string{bin, "connect"}
+	if flags.APIPort != agentcmd.DefaultAPIPort {
+		cmd = append(cmd, fmt.Sprintf("--api-port %d", flags.APIPort))
+	}
+	if flags.IdentityFile != "" {
+		cmd = append(cmd, "-i "+flags.IdentityFile)
+	}
+	if flags.APITLS {
+		cmd = append(cmd, "--api-tls")
+	}
+	if flags.KnownHosts != "" {
+		if abs, err := filepath.Abs(flags.KnownHosts); err == nil {
+			flags.KnownHosts = abs
+		}
+		cmd = append(cmd, "--known-hosts "+flags.KnownHosts)
+	}
+	return strings.Join(cmd, " ")
+}
+
+// remoteHosts lists the hosts visible with the API token on the remote root domain.
+func remoteHosts(cmd *cobra.Command, flags *Flags, c *client.Client) ([]string, error) {
+	c.APIPort = flags.APIPort
+	c.APITLS = c.APITLS || flags.APITLS
+	if cmd.Flags().Changed("token") {
+		c.Token = flags.Token
+	} else if token := viper.GetString("client.token"); len(token) != 0 {
+		c.Token = token
+	}
+	domains, err := c.Domains(flags.Remote)
+	if err != nil {
+		return nil, err
+	}
+	return client.DomainHosts(domains), nil
+}
+
+// NewCommand return the ssh configuration generation cobra command
+func NewCommand(c *client.Client) *cobra.Command {
+	flags := Flags{}
+	cmd := &cobra.Command{
+		Use:   "ssh-config [host pattern...]",
+		Short: "Generate the SSH configuration of exposed domains.",
+		Long: `Print the ~/.ssh/config blocks routing the hosts through 'rssh connect'.
+Patterns follow the ssh_config syntax, e.g: '*.baguette.localhost'.
+With --remote, a block is generated for each domain visible with your API token.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hosts := args
+			if len(flags.Remote) != 0 {
+				remote, err := remoteHosts(cmd, &flags, c)
+				if err != nil {
+					return err
+				}
+				hosts = append(hosts, remote...)
+			}
+			if len(hosts) == 0 {
+				return errors.New("a host pattern or --remote is required")
+			}
+			fmt.Print(client.SSHConfig(hosts, proxyCommand(&flags)))
+			return nil
+		},
+	}
+	cmd.SilenceUsage = true
+
+	cmd.Flags().Uint16Var(
+		&flags.APIPort,
+		"api-port",
+		agentcmd.DefaultAPIPort,
+		"Port on which the HTTP API listen on the root domain",
+	)
+	cmd.Flags().StringVarP(
+		&flags.IdentityFile,
+		"identity",
+		"i",
+		"",
+		"Private key offered to the gatekeeper, in addition to the ssh-agent keys",
+	)
+	cmd.Flags().BoolVar(
+		&flags.APITLS,
+		"api-tls",
+		false,
+		"Reach the API over HTTPS, and trust the gatekeeper host keys it publishes",
+	)
+	cmd.Flags().StringVar(
+		&flags.KnownHosts,
+		"known-hosts",
+		"",
+		"known_hosts file pinning the gatekeeper host keys",
+	)
+	cmd.Flags().StringVar(
+		&flags.Remote,
+		"remote",
+		"",
+		"Root domain on which the domains visible with your API token are listed",
+	)
+	cmd.Flags().StringVar(
+		&flags.Token,
+		"token",
+		"",
+		"API token used to list the domains (default: client.token)",
+	)
+	return cmd
+}
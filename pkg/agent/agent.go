@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
@@ -10,12 +11,14 @@ import (
 	"net"
 	"net/http"
 	"path"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Xide/rssh/pkg/api"
-	"github.com/Xide/rssh/pkg/utils"
+	"github.com/Xide/rssh/pkg/gatekeeper"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 )
@@ -25,15 +28,36 @@ import (
 type ForwardedHost struct {
 	// complete FQDN for which the host is bound
 	Domain string `json:"domain" mapstructure:"domain"`
-	// Address or domain on which the agent will dial the connection
+	// RSSH root domain of Domain, empty for the identities
+	// registered before it was recorded
+	Root string `json:"root" mapstructure:"root"`
+	// Address or domain on which the agent will dial the connection,
+	// or `unix:///path` for a unix domain socket.
 	Host string `json:"host" mapstructure:"host"`
-	// Port on which the agent will connect to
+	// Port on which the agent will connect to, unused for unix sockets
 	Port uint16 `json:"port" mapstructure:"ports"`
+	// Named targets exposed in addition to Host / Port
+	Targets []Target `json:"targets" mapstructure:"targets"`
+	// Health check performed on Host / Port
+	Check string `json:"check" mapstructure:"check"`
 	// UUID assigned to the agent
 	UID string
+	// Whether the agent should connect this forward
+	Enabled bool
+	// Maximum number of concurrent connections, 0 means unlimited
+	MaxConnections uint
+	// Authorized keys allowed to connect, empty means everyone
+	AllowedKeys []string
 
 	privateKey     *rsa.PrivateKey
 	gatekeeperPort uint16
+	// Gatekeeper session and slots bound to each target,
+	// only set on active forwards
+	session     *gatekeeperSession
+	slots       map[uint32]string
+	connections *int32
+	// Closed once the forward is stopped
+	stop chan struct{}
 }
 
 // Agent is the main structure of this package, it gets deserialized from
@@ -42,109 +66,85 @@ type Agent struct {
 	// Auto generated by `Agent.synchronizeIdentities` from the filesystem
 	hosts []ForwardedHost
 	// Currently bound channels
-	actives []ForwardedHost
+	actives     []*ForwardedHost
+	activesLock sync.Mutex
+	// Connection to each gatekeeper, shared by all the forwards it serves
+	sessions     map[string]*gatekeeperSession
+	sessionsLock sync.Mutex
+	// Time before which each gatekeeper must not be reconnected
+	holdoff map[string]time.Time
 	// Persistent agent configuration directory
 	RootDirectory string `json:"root_directory" mapstructure:"root_directory"`
 	// Port on which the API listen to requests on the root domain
 	APIPort uint16 `json:"api_port" mapstructure:"api_port"`
-}
+	// Declarative forwards configuration, reconciled with the identities
+	Forwards []ForwardConfig `json:"forwards" mapstructure:"forwards"`
+	// Interval between two health checks of the targets
+	HealthInterval time.Duration `json:"health_interval" mapstructure:"health_interval"`
+	// Proxy used to reach the API and the gatekeeper (http:// or socks5://)
+	Proxy string `json:"proxy" mapstructure:"proxy"`
+	// Transport used to reach the gatekeeper (tcp or websocket)
+	Transport string `json:"transport" mapstructure:"transport"`
+	// Protection of the private keys at rest (none, passphrase or keyring)
+	KeyEncryption string `json:"key_encryption" mapstructure:"key_encryption"`
+	// File containing the key encryption passphrase, defaults to RSSH_KEY_PASSPHRASE
+	PassphraseFile string `json:"passphrase_file" mapstructure:"passphrase_file"`
+	// Keyring file holding the key encryption secret, outside of the root directory
+	KeyringFile string `json:"keyring_file" mapstructure:"keyring_file"`
+	// Labels describing the agent machine, sent on registration
+	Labels map[string]string `json:"labels" mapstructure:"labels"`
+	// Agent version, sent on registration
+	Version string `json:"-" mapstructure:"-"`
+	// RSSH root domains, configured in the `api` section
+	RootDomains []string `json:"-" mapstructure:"-"`
 
-func publicKeyFile(file string) ssh.AuthMethod {
-	buffer, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil
-	}
+	keys *keyProtector
+	// Set when the agent is loaded to be inspected, see Load
+	readOnly bool
+	// Wakes up the reconciliation loop before the next retry
+	reconnect chan struct{}
+}
 
-	key, err := ssh.ParsePrivateKey(buffer)
-	if err != nil {
-		return nil
-	}
-	return ssh.PublicKeys(key)
+// forwardedTCPPayload is the payload of a forwarded-tcpip
+// channel opening, as described in RFC 4254 section 7.2.
+type forwardedTCPPayload struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
 }
 
-func forwardConnection(conn ssh.Channel, fwd *ForwardedHost) error {
-	localHost := fmt.Sprintf("%s:%d", fwd.Host, fwd.Port)
-	localConn, err := net.Dial("tcp", localHost)
+// forwardConnection bridges the channel with the local target,
+// `done` is called once both sides are closed.
+func forwardConnection(conn ssh.Channel, target *Target, done func()) error {
+	localConn, err := target.Dial()
 	if err != nil {
 		return err
 	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		defer conn.Close()
 		defer localConn.Close()
 		io.Copy(conn, localConn)
 	}()
 	go func() {
+		defer wg.Done()
 		defer conn.Close()
 		defer localConn.Close()
 		io.Copy(localConn, conn)
 	}()
+	go func() {
+		wg.Wait()
+		done()
+	}()
 	return nil
 }
 
-func (a *Agent) handleNewConnections(ch <-chan ssh.NewChannel, fwHost *ForwardedHost) {
-	for {
-		select {
-		case x := <-ch:
-			if x == nil {
-				log.Warn().
-					Str("domain", fwHost.Domain).
-					Msg("Connection to gatekeeper interrupted")
-				// Removes fwHost from the list of active connections.
-				for idx, h := range a.actives {
-					if h.UID == fwHost.UID {
-						a.actives = append(a.actives[:idx], a.actives[idx+1:]...)
-					}
-				}
-				return
-			}
-			log.Debug().
-				Str("domain", fwHost.Domain).
-				Msg("New connection request.")
-			ch, reqs, err := x.Accept()
-			ssh.DiscardRequests(reqs)
-			if err != nil {
-				log.Warn().
-					Str("error", err.Error()).
-					Str("domain", fwHost.Domain).
-					Msg("Failed to accept new connection.")
-			}
-			err = forwardConnection(ch, fwHost)
-			if err != nil {
-				log.Warn().
-					Str("error", err.Error()).
-					Str("domain", fwHost.Domain).
-					Msg("Failed to forward new connection.")
-			}
-
-		}
-	}
-}
-
-func (a *Agent) establishReverseForward(host string, port uint16, slot uint16, fwHost *ForwardedHost) error {
-	pubKeyFile := path.Join(
-		a.RootDirectory,
-		"identities",
-		fmt.Sprintf("id_rsa.%s.pub", fwHost.Domain),
-	)
-
-	sshConfig := &ssh.ClientConfig{
-		User: "rssh_agent",
-		Auth: []ssh.AuthMethod{
-			publicKeyFile(pubKeyFile),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	gkAddr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.Dial("tcp", gkAddr)
-	if err != nil {
-		return err
-	}
-	sshConn, ch, _, err := ssh.NewClientConn(conn, gkAddr, sshConfig)
-	if err != nil {
-		return err
-	}
-
+// requestSlotForward asks the gatekeeper to forward the slot to the agent,
+// and checks it is reachable unless the slots are firewalled by the transport.
+func (a *Agent) requestSlotForward(sshConn ssh.Conn, host string, slot uint16) error {
 	c, data, err := sshConn.SendRequest("tcpip-forward", true, ssh.Marshal(&struct {
 		BindAddr string
 		BindPort uint32
@@ -155,76 +155,193 @@ func (a *Agent) establishReverseForward(host string, port uint16, slot uint16, f
 	if err != nil {
 		return err
 	}
-	if c {
-		cn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, uint32(slot)))
+	if !c {
+		log.Error().
+			Str("response", string(data)).
+			Uint16("slot", slot).
+			Msg("Failed to request port forwarding.")
+		return errors.New(string(data))
+	}
+	if a.isWebSocket() {
+		return nil
+	}
+	cn, err := a.dial(net.JoinHostPort(host, strconv.Itoa(int(slot))))
+	if err != nil {
+		return err
+	}
+	cn.Close()
+	return nil
+}
+
+// establishReverseForward binds the slots of the forwarded host
+// on the gatekeeper session, which is opened if needed.
+func (a *Agent) establishReverseForward(host string, gk *gatekeeper.Meta, slots map[string]uint16, fwHost *ForwardedHost) error {
+	a.sessionsLock.Lock()
+	defer a.sessionsLock.Unlock()
+
+	session, err := a.openSession(host, gk, fwHost)
+	if err != nil {
+		return err
+	}
+
+	active := *fwHost
+	active.session = session
+	active.slots = map[uint32]string{}
+	active.connections = new(int32)
+	active.stop = make(chan struct{})
+	for _, target := range fwHost.AllTargets() {
+		slot, ok := slots[target.Name]
+		if !ok {
+			err = fmt.Errorf("no slot allocated for target %s", target.Name)
+		} else {
+			err = a.requestSlotForward(session.conn, host, slot)
+		}
 		if err != nil {
-			sshConn.Close()
+			a.releaseSlots(&active)
 			return err
 		}
-		cn.Close()
+		active.slots[uint32(slot)] = target.Name
+		session.bind(uint32(slot), &active, target.Name)
 		log.Info().
 			Str("domain", fwHost.Domain).
-			Str("host", fwHost.Host).
-			Uint16("port", fwHost.Port).
+			Str("target", target.Name).
+			Str("address", target.Address()).
 			Msg("Established forwarding.")
-		a.actives = append(a.actives, *fwHost)
-		go a.handleNewConnections(ch, fwHost)
-	} else {
-		log.Error().
-			Str("response", string(data)).
-			Msg("Failed to request port forwarding.")
-		return errors.New(string(data))
 	}
+
+	a.activesLock.Lock()
+	a.actives = append(a.actives, &active)
+	a.activesLock.Unlock()
+	go a.monitorTargets(&active)
 	return nil
 }
 
-func (a *Agent) discoverGkPort(fwHost *ForwardedHost) (gkPort uint16, slot uint16, err error) {
-	subDomain, rootDomain := utils.SplitDomainRequest(fwHost.Domain)
+// discoverGkPort authenticates the agent against the API, which
+// returns the gatekeeper metadatas and the slots allocated for each target.
+func (a *Agent) discoverGkPort(fwHost *ForwardedHost) (gk *gatekeeper.Meta, slots map[string]uint16, err error) {
+	infos, err := a.authenticate(fwHost, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	slots = infos.Targets
+	if slots == nil {
+		// API without targets support
+		slots = map[string]uint16{gatekeeper.DefaultTarget: infos.Port}
+	}
+	return &infos.GkMeta, slots, nil
+}
 
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s:%d/auth/%s?identity=%s", rootDomain, a.APIPort, subDomain, fwHost.UID),
-		"application/json",
-		strings.NewReader("{}"),
-	)
+// authenticate sends the authentication request of the forwarded host to the API,
+// signed by the identity key. A dry run only validates the identity, without
+// allocating any slot, and returns the current slots of the domain.
+func (a *Agent) authenticate(fwHost *ForwardedHost, dryRun bool) (*api.GkConnectInfos, error) {
+	subDomain, rootDomain, err := fwHost.splitDomain()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(api.AuthRequestBody{
+		AllowedKeys: fwHost.AllowedKeys,
+		Targets:     fwHost.targetNames(),
+		Domain:      subDomain + "." + rootDomain,
+		Timestamp:   time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(fwHost.privateKey)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
+	}
+	signature, err := api.SignRegisterRequest(signer, payload)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := a.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("http://%s:%d/auth/%s?identity=%s", rootDomain, a.APIPort, subDomain, fwHost.UID)
+	if dryRun {
+		endpoint += "&dry_run=true"
+	}
+	httpReq, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(api.RegisterSignatureHeader, signature)
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	authResp := api.AuthResponse{}
 	err = json.Unmarshal(body, &authResp)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	if authResp.Err != nil {
-		return 0, 0, errors.New(authResp.Err.Msg)
+		return nil, errors.New(authResp.Err.Msg)
+	}
+	if authResp.Infos == nil {
+		return nil, errors.New("empty authentication response")
 	}
 	log.Debug().
 		Str("gk_infos", fmt.Sprintf("%v", authResp.Infos)).
 		Str("uid", fwHost.UID).
 		Str("domain", fwHost.Domain).
 		Msg("Authenticated.")
-	gkPort = authResp.Infos.GkMeta.SSHPort
-	slot = authResp.Infos.Port
-	return
+	return authResp.Infos, nil
 }
 
 // Init stup the identities and directories required by the agent.
 func (a *Agent) Init() error {
+	if err := a.validateTransport(); err != nil {
+		return err
+	}
+	if err := a.validateForwards(); err != nil {
+		return err
+	}
 	if err := a.setupFileSystem(); err != nil {
 		return err
 	}
+	if err := a.initKeyProtection(); err != nil {
+		return err
+	}
 	if err := a.synchronizeIdentities(); err != nil {
 		return err
 	}
+	if err := a.encryptIdentities(); err != nil {
+		return err
+	}
 	log.Debug().Msg("Agent initialized")
 	return nil
 }
 
+// Load reads the configuration and the identities without writing to the
+// root directory, for the commands inspecting the agent (e.g: doctor):
+// the identities are neither synchronized on disk nor encrypted,
+// and a missing keyring is not generated.
+func (a *Agent) Load() error {
+	if err := a.validateTransport(); err != nil {
+		return err
+	}
+	if err := a.validateForwards(); err != nil {
+		return err
+	}
+	a.readOnly = true
+	if err := a.initKeyProtection(); err != nil {
+		return err
+	}
+	return a.synchronizeIdentities()
+}
+
 // WalkIdentities calls fn() on each of the parsed keys from the filesystem
 func (a *Agent) WalkIdentities(fn func(*ForwardedHost)) {
 	for _, x := range a.hosts {
@@ -233,51 +350,152 @@ func (a *Agent) WalkIdentities(fn func(*ForwardedHost)) {
 }
 
 func (a *Agent) isRunning(fwHost *ForwardedHost) bool {
+	a.activesLock.Lock()
+	defer a.activesLock.Unlock()
 	for _, running := range a.actives {
-		if fwHost.UID == running.UID {
+		if fwHost.Domain == running.Domain {
 			return true
 		}
 	}
 	return false
 }
 
+// stopForward releases the slots of an active forward on the gatekeeper.
+// The gatekeeper session is closed once it doesn't serve any forward.
+func (a *Agent) stopForward(fwHost *ForwardedHost) {
+	a.sessionsLock.Lock()
+	defer a.sessionsLock.Unlock()
+
+	a.activesLock.Lock()
+	var stopped []*ForwardedHost
+	for idx := 0; idx < len(a.actives); idx++ {
+		if running := a.actives[idx]; running.Domain == fwHost.Domain {
+			stopped = append(stopped, running)
+			a.actives = append(a.actives[:idx], a.actives[idx+1:]...)
+			idx--
+		}
+	}
+	a.activesLock.Unlock()
+
+	for _, running := range stopped {
+		log.Info().
+			Str("domain", running.Domain).
+			Str("uid", running.UID).
+			Msg("Closing forwarding.")
+		close(running.stop)
+		a.releaseSlots(running)
+	}
+}
+
+// connectIdentities registers the missing configured forwards and
+// establish a reverse forward for every enabled identity that is not
+// currently bound.
+func (a *Agent) connectIdentities() {
+	a.registerMissingForwards()
+	for _, credential := range a.hosts {
+		if credential.Enabled && !a.isRunning(&credential) {
+			_, root, _ := credential.splitDomain()
+			if a.isHeldOff(root) {
+				continue
+			}
+			gk, slots, err := a.discoverGkPort(&credential)
+			if err != nil {
+				log.Warn().
+					Str("error", err.Error()).
+					Str("uid", credential.UID).
+					Msg("Failed to authenticate.")
+				continue
+			}
+			err = a.establishReverseForward(root, gk, slots, &credential)
+			if err != nil {
+				log.Warn().
+					Str("error", err.Error()).
+					Str("uid", credential.UID).
+					Msg("Failed to establish reverse forward")
+			}
+		}
+	}
+}
+
+// watchIdentities returns a watcher notified of every change
+// in the identities directory.
+func (a *Agent) watchIdentities() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(path.Join(a.RootDirectory, "identities")); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+func (a *Agent) synchronizeAndLog() {
+	if err := a.synchronizeIdentities(); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("Could not synchronize identities.")
+	}
+}
+
+// reconciliationLoop keeps the gatekeeper connections in sync with the
+// identities on disk. Identities are synchronized whenever the watcher
+// reports a change, and unbound identities are retried periodically.
+// If the watcher can't be created, identities are synchronized on each retry.
 func (a *Agent) reconciliationLoop() {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	watcher, err := a.watchIdentities()
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Could not watch identities directory, falling back to polling.")
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 	for {
-		if err := a.synchronizeIdentities(); err != nil {
-			log.Error().
+		a.connectIdentities()
+
+		select {
+		case ev := <-events:
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			log.Debug().
+				Str("file", ev.Name).
+				Str("op", ev.Op.String()).
+				Msg("Identities directory changed.")
+			a.synchronizeAndLog()
+		case err := <-errs:
+			log.Warn().
 				Str("error", err.Error()).
-				Msg("Could not synchronize identities.")
-		}
-		for _, credential := range a.hosts {
-			if !a.isRunning(&credential) {
-				_, root := utils.SplitDomainRequest(credential.Domain)
-				gkPort, slot, err := a.discoverGkPort(&credential)
-				if err != nil {
-					log.Warn().
-						Str("error", err.Error()).
-						Str("uid", credential.UID).
-						Msg("Failed to authenticate.")
-					continue
-				}
-				err = a.establishReverseForward(root, gkPort, slot, &credential)
-				if err != nil {
-					log.Warn().
-						Str("error", err.Error()).
-						Str("uid", credential.UID).
-						Msg("Failed to establish reverse forward")
-				}
+				Msg("Identities watcher error.")
+		case <-a.reconnect:
+		case <-ticker.C:
+			if watcher == nil {
+				a.synchronizeAndLog()
 			}
 		}
-
-		time.Sleep(5 * time.Second)
 	}
 }
 
 // Run is the entrypoint for the agent
-func (a *Agent) Run() {
-	a.Init()
+func (a *Agent) Run() error {
+	if err := a.Init(); err != nil {
+		return err
+	}
 	log.Info().
 		Int("hosts_count", len(a.hosts)).
+		Int("forwards_count", len(a.Forwards)).
 		Msg("Finished hosts import.")
+	a.reconnect = make(chan struct{}, 1)
 	a.reconciliationLoop()
+	return nil
 }
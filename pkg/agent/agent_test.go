@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestIdentity writes a plaintext identity of `domain` in the root directory.
+func writeTestIdentity(t *testing.T, root string, domain string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "identities")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "id_rsa."+domain)
+	pemEncoded := pem.EncodeToMemory(&pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: map[string]string{"uid": "test-uid", "host": "localhost", "port": "22"},
+		Bytes:   x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err := ioutil.WriteFile(file, pemEncoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadIsReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	identity := writeTestIdentity(t, root, "sub.example.com")
+	before, _ := ioutil.ReadFile(identity)
+	keyring := filepath.Join(tmp, "keyring")
+
+	a := &Agent{RootDirectory: root, KeyEncryption: KeyEncryptionKeyring, KeyringFile: keyring}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Domains(); len(got) != 1 || got[0] != "sub.example.com" {
+		t.Errorf("loaded domains = %v", got)
+	}
+	if after, _ := ioutil.ReadFile(identity); string(after) != string(before) {
+		t.Error("Load modified the identity")
+	}
+	if _, err := os.Stat(keyring); !os.IsNotExist(err) {
+		t.Error("Load generated the keyring")
+	}
+
+	// Init encrypts the identity with a new keyring
+	a = &Agent{RootDirectory: root, KeyEncryption: KeyEncryptionKeyring, KeyringFile: keyring}
+	if err := a.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(identity); string(after) == string(before) {
+		t.Error("Init did not encrypt the identity")
+	}
+	if _, err := os.Stat(keyring); err != nil {
+		t.Errorf("Init did not generate the keyring: %v", err)
+	}
+}
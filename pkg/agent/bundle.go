@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// bundleVersion is the version of the exported bundles. Bundles of version 1,
+// without the machine identity, can still be imported.
+const bundleVersion = 2
+
+// bundle is the portable format of exported identities.
+// Identities are stored in Payload, sealed with a passphrase if Sealed is set.
+type bundle struct {
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"identities,omitempty"`
+	Sealed  *sealedPayload  `json:"sealed,omitempty"`
+}
+
+// bundleContent is the payload of a bundle. In version 1,
+// the payload only holds the identities array.
+type bundleContent struct {
+	Identities []bundleIdentity `json:"identities"`
+	Machine    *bundleMachine   `json:"machine,omitempty"`
+}
+
+// bundleIdentity holds the files of an identity, as stored on disk.
+type bundleIdentity struct {
+	Domain     string `json:"domain"`
+	PrivateKey []byte `json:"private_key"`
+	PublicKey  []byte `json:"public_key"`
+}
+
+// bundleMachine holds the machine identity of the agent (see machineKeyName).
+type bundleMachine struct {
+	UID        string `json:"uid"`
+	PrivateKey []byte `json:"private_key"`
+	PublicKey  []byte `json:"public_key"`
+}
+
+// ExportIdentities serializes the identities (by domain or uid), or all of
+// them if none is given, in a bundle encrypted if a passphrase is provided.
+// The machine identity is exported along, for the agent to keep registering
+// its domains under the same identity once the bundle is imported. Keys
+// encrypted at rest are never exported in plaintext, a passphrase is required.
+func (a *Agent) ExportIdentities(uids []string, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 && a.KeyEncryption != "" && a.KeyEncryption != KeyEncryptionNone {
+		return nil, fmt.Errorf("keys are encrypted at rest (%s), the bundle has to be encrypted", a.KeyEncryption)
+	}
+	if len(uids) == 0 {
+		for _, x := range a.hosts {
+			uids = append(uids, x.Domain)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, errors.New("no identity to export")
+	}
+
+	identities := []bundleIdentity{}
+	for _, uid := range uids {
+		fw := a.lookupIdentity(uid)
+		if fw == nil {
+			return nil, errors.New("Identity not found : " + uid)
+		}
+		keyFile := path.Join(a.RootDirectory, "identities", "id_rsa."+fw.Domain)
+		pemEncoded, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Keys encrypted at rest are exported in plaintext,
+		// the bundle being protected by its own passphrase.
+		block, err := a.openIdentity(pemEncoded)
+		if err != nil {
+			return nil, err
+		}
+		priv := pem.EncodeToMemory(block)
+		pub, err := ioutil.ReadFile(keyFile + ".pub")
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, bundleIdentity{
+			Domain:     fw.Domain,
+			PrivateKey: priv,
+			PublicKey:  pub,
+		})
+	}
+
+	content := bundleContent{Identities: identities}
+	machine, err := a.loadMachineIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if machine != nil {
+		content.Machine = &bundleMachine{
+			UID:        machine.ID.String(),
+			PrivateKey: machine.Secret,
+			PublicKey:  machine.Identity,
+		}
+	}
+	payload, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	b := bundle{Version: bundleVersion}
+	if len(passphrase) > 0 {
+		if b.Sealed, err = seal(payload, passphrase); err != nil {
+			return nil, err
+		}
+	} else {
+		b.Payload = payload
+	}
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// IsSealedBundle returns true if the bundle requires a passphrase to be imported.
+func IsSealedBundle(data []byte) (bool, error) {
+	b := bundle{}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return false, err
+	}
+	return b.Sealed != nil, nil
+}
+
+// ImportIdentities validates the identities of the bundle and installs them
+// in the identities directory, along with the machine identity of the bundle.
+// Existing identities are only replaced if `overwrite` is set. It returns the
+// imported domains.
+func (a *Agent) ImportIdentities(data []byte, passphrase []byte, overwrite bool) ([]string, error) {
+	b := bundle{}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if b.Version != 1 && b.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	payload := []byte(b.Payload)
+	if b.Sealed != nil {
+		if len(passphrase) == 0 {
+			return nil, errors.New("bundle is encrypted, a passphrase is required")
+		}
+		var err error
+		if payload, err = b.Sealed.open(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	content := bundleContent{}
+	if b.Version == 1 {
+		if err := json.Unmarshal(payload, &content.Identities); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(payload, &content); err != nil {
+		return nil, err
+	}
+
+	// Validate the whole bundle before installing anything
+	for _, id := range content.Identities {
+		if err := a.validateBundleIdentity(&id); err != nil {
+			return nil, fmt.Errorf("invalid identity %s: %s", id.Domain, err.Error())
+		}
+		if !overwrite && a.findIdentityForFile("id_rsa."+id.Domain) != nil {
+			return nil, fmt.Errorf("identity %s already exists", id.Domain)
+		}
+	}
+	var machine *api.AgentCredentials
+	if content.Machine != nil {
+		var err error
+		if machine, err = a.validateBundleMachine(content.Machine, overwrite); err != nil {
+			return nil, err
+		}
+	}
+
+	if machine != nil {
+		if err := a.persistMachineIdentity(machine); err != nil {
+			return nil, err
+		}
+	}
+	imported := []string{}
+	for _, id := range content.Identities {
+		err := a.persistKeyToDisk(
+			path.Join(a.RootDirectory, "identities"),
+			id.Domain,
+			&api.AgentCredentials{Identity: id.PublicKey, Secret: id.PrivateKey},
+		)
+		if err != nil {
+			return imported, err
+		}
+		log.Info().
+			Str("domain", id.Domain).
+			Msg("Identity imported.")
+		imported = append(imported, id.Domain)
+	}
+	return imported, a.synchronizeIdentities()
+}
+
+// validateBundleIdentity parses the identity the same way the agent does
+// when loading it from disk, and ensures both keys of the pair match.
+func (a *Agent) validateBundleIdentity(id *bundleIdentity) error {
+	if id.Domain == "" || path.Base(id.Domain) != id.Domain {
+		return errors.New("invalid domain")
+	}
+	fw, err := a.parseFwdHost(id.PrivateKey, id.Domain)
+	if err != nil {
+		return err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(id.PublicKey)
+	if err != nil {
+		return err
+	}
+	expected, err := ssh.NewPublicKey(&fw.privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub.Marshal(), expected.Marshal()) {
+		return errors.New("public key does not match the private key")
+	}
+	return nil
+}
+
+// validateBundleMachine parses the machine identity of a bundle, and returns it
+// unless the agent already has this identity. A different machine identity is
+// only replaced if `overwrite` is set.
+func (a *Agent) validateBundleMachine(m *bundleMachine, overwrite bool) (*api.AgentCredentials, error) {
+	id, err := uuid.FromString(m.UID)
+	if err != nil {
+		return nil, errors.New("invalid machine identity uid")
+	}
+	block, _ := pem.Decode(m.PrivateKey)
+	if block == nil || block.Headers["uid"] != id.String() {
+		return nil, errors.New("invalid machine identity private key")
+	}
+	signer, err := ssh.ParsePrivateKey(m.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(m.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, errors.New("machine identity public key does not match the private key")
+	}
+
+	current, err := a.loadMachineIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		currentPub, _, _, _, err := ssh.ParseAuthorizedKey(current.Identity)
+		if err == nil && uuid.Equal(current.ID, id) && bytes.Equal(currentPub.Marshal(), pub.Marshal()) {
+			return nil, nil
+		}
+		if !overwrite {
+			return nil, fmt.Errorf("machine identity %s already exists", current.ID.String())
+		}
+	}
+	return &api.AgentCredentials{ID: id, Identity: m.PublicKey, Secret: m.PrivateKey}, nil
+}
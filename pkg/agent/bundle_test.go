@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+// loadTestAgent loads an agent with a plaintext identity for each domain.
+func loadTestAgent(t *testing.T, root string, domains ...string) *Agent {
+	writeTestKeyPairs(t, root, domains...)
+	a := &Agent{RootDirectory: root}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// writeTestKeyPairs writes a plaintext identity and its public key for each domain.
+func writeTestKeyPairs(t *testing.T, root string, domains ...string) {
+	if err := os.MkdirAll(filepath.Join(root, "identities"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		file := writeTestIdentity(t, root, domain)
+		signer, err := ssh.ParsePrivateKey(readTestFile(t, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFile(t *testing.T, file string) []byte {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeTestMachine persists a new machine identity for the agent.
+func writeTestMachine(t *testing.T, a *Agent) *api.AgentCredentials {
+	machine, err := api.GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.persistMachineIdentity(machine); err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	tests := []struct {
+		name             string
+		exportPassphrase string
+		importPassphrase string
+		// Identity already installed on the importing agent
+		existing  bool
+		overwrite bool
+		// Machine identity of the importing agent: none, "same" or "other"
+		existingMachine string
+		// Exported in the version 1 format, without the machine identity
+		v1 bool
+		// Modifies the content of a plaintext bundle
+		tamper  func(*bundleContent)
+		wantErr bool
+	}{
+		{name: "plaintext"},
+		{name: "sealed", exportPassphrase: "secret", importPassphrase: "secret"},
+		{name: "sealed without passphrase", exportPassphrase: "secret", wantErr: true},
+		{name: "wrong passphrase", exportPassphrase: "secret", importPassphrase: "other", wantErr: true},
+		{name: "existing identity", existing: true, wantErr: true},
+		{name: "overwritten identity", existing: true, overwrite: true},
+		{name: "same machine identity", existingMachine: "same"},
+		{name: "other machine identity", existingMachine: "other", wantErr: true},
+		{name: "overwritten machine identity", existingMachine: "other", overwrite: true},
+		{name: "version 1", v1: true},
+		{
+			name: "mismatched public key",
+			tamper: func(c *bundleContent) {
+				c.Identities[0].PublicKey, c.Identities[1].PublicKey = c.Identities[1].PublicKey, c.Identities[0].PublicKey
+			},
+			wantErr: true,
+		},
+		{
+			name:    "domain with a path",
+			tamper:  func(c *bundleContent) { c.Identities[0].Domain = "../" + c.Identities[0].Domain },
+			wantErr: true,
+		},
+		{
+			name:    "mismatched machine public key",
+			tamper:  func(c *bundleContent) { c.Machine.PublicKey = c.Identities[0].PublicKey },
+			wantErr: true,
+		},
+		{
+			name:    "mismatched machine uid",
+			tamper:  func(c *bundleContent) { c.Machine.UID = uuid.NewV4().String() },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			src := loadTestAgent(t, filepath.Join(tmp, "src"), "db.example.com", "web.example.com")
+			machine := writeTestMachine(t, src)
+			data, err := src.ExportIdentities(nil, []byte(tt.exportPassphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sealed, err := IsSealedBundle(data); err != nil || sealed != (tt.exportPassphrase != "") {
+				t.Errorf("IsSealedBundle() = %v, %v", sealed, err)
+			}
+			if tt.tamper != nil || tt.v1 {
+				b := bundle{}
+				content := bundleContent{}
+				if err := json.Unmarshal(data, &b); err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(b.Payload, &content); err != nil {
+					t.Fatal(err)
+				}
+				if tt.tamper != nil {
+					tt.tamper(&content)
+					b.Payload, err = json.Marshal(content)
+				} else {
+					b.Version = 1
+					b.Payload, err = json.Marshal(content.Identities)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err = json.Marshal(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			existing := []string{}
+			if tt.existing {
+				existing = append(existing, "db.example.com")
+			}
+			dst := loadTestAgent(t, filepath.Join(tmp, "dst"), existing...)
+			var before []byte
+			if tt.existing {
+				before = readTestFile(t, filepath.Join(tmp, "dst", "identities", "id_rsa.db.example.com"))
+			}
+			var dstMachine *api.AgentCredentials
+			switch tt.existingMachine {
+			case "same":
+				dstMachine = machine
+				if err := dst.persistMachineIdentity(machine); err != nil {
+					t.Fatal(err)
+				}
+			case "other":
+				dstMachine = writeTestMachine(t, dst)
+			}
+			imported, err := dst.ImportIdentities(data, []byte(tt.importPassphrase), tt.overwrite)
+
+			current, loadErr := dst.loadMachineIdentity()
+			if loadErr != nil {
+				t.Fatal(loadErr)
+			}
+			wantMachine := machine
+			if tt.wantErr || tt.v1 {
+				wantMachine = dstMachine
+			}
+			if (current == nil) != (wantMachine == nil) || (current != nil && current.ID != wantMachine.ID) {
+				t.Errorf("machine identity = %v, want %v", current, wantMachine)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, imported %v", imported)
+				}
+				if len(dst.Domains()) != len(existing) {
+					t.Errorf("identities installed from an invalid bundle: %v", dst.Domains())
+				}
+				if tt.existing && string(readTestFile(t, filepath.Join(tmp, "dst", "identities", "id_rsa.db.example.com"))) != string(before) {
+					t.Error("existing identity modified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imported) != 2 || len(dst.Domains()) != 2 {
+				t.Fatalf("imported %v, agent identities %v", imported, dst.Domains())
+			}
+			for _, domain := range imported {
+				want := readTestFile(t, filepath.Join(tmp, "src", "identities", "id_rsa."+domain))
+				got := readTestFile(t, filepath.Join(tmp, "dst", "identities", "id_rsa."+domain))
+				if string(got) != string(want) {
+					t.Errorf("identity %s differs from the exported one", domain)
+				}
+			}
+		})
+	}
+}
+
+func TestExportEncryptedKeys(t *testing.T) {
+	tests := []struct {
+		name          string
+		keyEncryption string
+		passphrase    string
+		wantErr       bool
+	}{
+		{"plaintext keys", KeyEncryptionNone, "", false},
+		{"encrypted keys", KeyEncryptionKeyring, "", true},
+		{"encrypted keys and bundle", KeyEncryptionKeyring, "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			root := filepath.Join(tmp, "root")
+			writeTestKeyPairs(t, root, "db.example.com")
+			a := &Agent{RootDirectory: root, KeyEncryption: tt.keyEncryption, KeyringFile: filepath.Join(tmp, "keyring")}
+			if err := a.Init(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := a.ExportIdentities(nil, []byte(tt.passphrase))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("exported a plaintext bundle: %s", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
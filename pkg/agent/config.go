@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// ForwardConfig is the declarative description of a forwarded domain,
+// as found in the `agent.forwards` section of the configuration file.
+type ForwardConfig struct {
+	// complete FQDN to expose
+	Domain string `json:"domain" mapstructure:"domain"`
+	// RSSH root domain of Domain, required for names outside of the
+	// configured root domains with more than three labels
+	Root string `json:"root" mapstructure:"root"`
+	// Address or domain on which the agent will dial the connection,
+	// or `unix:///path` for a unix domain socket.
+	Host string `json:"host" mapstructure:"host"`
+	// Port on which the agent will connect to, unused for unix sockets
+	Port uint16 `json:"port" mapstructure:"port"`
+	// Named targets exposed in addition to Host / Port
+	Targets []Target `json:"targets" mapstructure:"targets"`
+	// Health check performed on Host / Port (tcp, ssh or none)
+	Check string `json:"check" mapstructure:"check"`
+	// Whether the domain is exposed (default: true). Disabled
+	// forwards keep their identity but are not connected.
+	Enabled *bool `json:"enabled" mapstructure:"enabled"`
+	// Maximum number of concurrent connections, 0 means unlimited
+	MaxConnections uint `json:"max_connections" mapstructure:"max_connections"`
+	// Authorized keys allowed to connect, empty means everyone
+	AllowedKeys []string `json:"allowed_keys" mapstructure:"allowed_keys"`
+}
+
+// IsEnabled returns the value of the enabled flag, defaulting to true.
+func (f *ForwardConfig) IsEnabled() bool {
+	return f.Enabled == nil || *f.Enabled
+}
+
+// Validate returns an error if the forward configuration is unusable.
+func (f *ForwardConfig) Validate() error {
+	if len(f.Domain) == 0 {
+		return errors.New("forward without domain")
+	}
+	defaultTarget := Target{Name: gatekeeper.DefaultTarget, Host: f.Host, Port: f.Port, Check: f.Check}
+	if err := defaultTarget.validateEndpoint(); err != nil {
+		return fmt.Errorf("invalid default target for %s: %s", f.Domain, err.Error())
+	}
+	if err := validateTargets(f.Targets); err != nil {
+		return fmt.Errorf("invalid targets for %s: %s", f.Domain, err.Error())
+	}
+	for _, k := range f.AllowedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			return fmt.Errorf("invalid allowed key for %s: %s", f.Domain, err.Error())
+		}
+	}
+	return nil
+}
+
+// setForwardDefaults fills the optional fields of the configured forwards.
+func (a *Agent) setForwardDefaults() {
+	for i := range a.Forwards {
+		if len(a.Forwards[i].Host) == 0 {
+			a.Forwards[i].Host = "127.0.0.1"
+		}
+		if a.Forwards[i].Port == 0 && !strings.HasPrefix(a.Forwards[i].Host, unixScheme) {
+			a.Forwards[i].Port = 22
+		}
+	}
+}
+
+func (a *Agent) validateForwards() error {
+	a.setForwardDefaults()
+	seen := map[string]bool{}
+	for _, f := range a.Forwards {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		if seen[f.Domain] {
+			return fmt.Errorf("duplicate forward for %s", f.Domain)
+		}
+		seen[f.Domain] = true
+	}
+	return nil
+}
+
+func (a *Agent) findForward(domain string) *ForwardConfig {
+	for i := range a.Forwards {
+		if a.Forwards[i].Domain == domain {
+			return &a.Forwards[i]
+		}
+	}
+	return nil
+}
+
+// applyForwardConfig overrides the identity settings with the
+// declarative configuration. When forwards are declared, identities
+// missing from the configuration are disabled.
+func (a *Agent) applyForwardConfig(fw *ForwardedHost) {
+	fw.Enabled = true
+	if len(a.Forwards) == 0 {
+		return
+	}
+	f := a.findForward(fw.Domain)
+	if f == nil {
+		fw.Enabled = false
+		return
+	}
+	fw.Host = f.Host
+	fw.Port = f.Port
+	fw.Targets = f.Targets
+	fw.Check = f.Check
+	fw.Enabled = f.IsEnabled()
+	fw.MaxConnections = f.MaxConnections
+	fw.AllowedKeys = f.AllowedKeys
+}
+
+// registerMissingForwards registers the configured domains
+// for which the agent does not have an identity yet.
+func (a *Agent) registerMissingForwards() {
+	for _, f := range a.Forwards {
+		if !f.IsEnabled() || a.findIdentityForFile("id_rsa."+f.Domain) != nil {
+			continue
+		}
+		log.Info().
+			Str("domain", f.Domain).
+			Msg("Registering configured forward.")
+		if err := a.RegisterHost(&RegisterRequest{
+			Domain:  f.Domain,
+			Root:    f.Root,
+			Host:    f.Host,
+			Port:    f.Port,
+			Targets: f.Targets,
+		}); err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("domain", f.Domain).
+				Msg("Could not register configured forward.")
+		}
+	}
+}
@@ -18,12 +18,20 @@ func embedHostConfiguration(creds *api.AgentCredentials, req *RegisterRequest) e
 	if block == nil || block.Type != "RSA PRIVATE KEY" {
 		return errors.New("invalid PEM block")
 	}
+	block.Headers["root"] = req.Root
 	block.Headers["host"] = req.Host
 	block.Headers["port"] = strconv.FormatUint(uint64(req.Port), 10)
+	if len(req.Targets) > 0 {
+		block.Headers["targets"] = formatTargets(req.Targets)
+	}
 	creds.Secret = pem.EncodeToMemory(block)
 	return nil
 }
 
+// synchronizeIdentities diffs the identities on the filesystem against
+// the ones known by the agent. New identities are imported, while removed
+// and modified ones get their forward closed so that the reconciliation
+// loop reconnects them with their new configuration.
 func (a *Agent) synchronizeIdentities() error {
 	hosts := []ForwardedHost{}
 	keys, err := filterPublicKeys(path.Join(a.RootDirectory, "identities"))
@@ -31,7 +39,7 @@ func (a *Agent) synchronizeIdentities() error {
 		return err
 	}
 	for _, idFile := range keys {
-		fw, err := parseFwdHostFromFile(
+		fw, err := a.parseFwdHostFromFile(
 			path.Join(
 				a.RootDirectory,
 				"identities",
@@ -43,24 +51,108 @@ func (a *Agent) synchronizeIdentities() error {
 				Str("error", err.Error()).
 				Str("file", idFile).
 				Msg("Could not load identity")
+			// The file may be in the middle of a write,
+			// keep the previous version until it is readable.
+			if prev := a.findIdentityForFile(idFile); prev != nil {
+				hosts = append(hosts, *prev)
+			}
 			continue
 		}
-		if a.isImported(fw) {
-			continue
+		a.applyForwardConfig(fw)
+		prev := a.findIdentity(fw.Domain)
+		if prev == nil {
+			log.Debug().
+				Str("identity", fw.UID).
+				Str("file", idFile).
+				Msg("Identity imported.")
+		} else if !prev.sameAs(fw) {
+			log.Info().
+				Str("identity", fw.UID).
+				Str("file", idFile).
+				Msg("Identity modified.")
+			a.stopForward(prev)
 		}
 		hosts = append(hosts, *fw)
-		log.Debug().
-			Str("identity", fw.UID).
-			Str("file", idFile).
-			Msg("Identity imported.")
 	}
-	a.hosts = append(a.hosts, hosts...)
+
+	for _, x := range a.hosts {
+		if !containsIdentity(hosts, x.Domain) {
+			log.Info().
+				Str("identity", x.UID).
+				Str("domain", x.Domain).
+				Msg("Identity removed.")
+			a.stopForward(&x)
+		}
+	}
+	a.hosts = hosts
 	return nil
 }
 
-func (a *Agent) isImported(fwHost *ForwardedHost) bool {
-	for _, x := range a.hosts {
-		if fwHost.UID == x.UID {
+// sameAs returns true if both hosts are bound to the same
+// domain and key, and forward to the same local endpoint.
+func (fw *ForwardedHost) sameAs(other *ForwardedHost) bool {
+	return fw.UID == other.UID &&
+		fw.Domain == other.Domain &&
+		fw.Root == other.Root &&
+		fw.Host == other.Host &&
+		fw.Port == other.Port &&
+		sameTargets(fw.Targets, other.Targets) &&
+		fw.Check == other.Check &&
+		fw.Enabled == other.Enabled &&
+		fw.MaxConnections == other.MaxConnections &&
+		sameKeys(fw.AllowedKeys, other.AllowedKeys) &&
+		fw.privateKey.Equal(other.privateKey)
+}
+
+func sameKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// findIdentity finds an identity by domain, the uid being
+// shared by the domains registered with the machine identity.
+func (a *Agent) findIdentity(domain string) *ForwardedHost {
+	for i := range a.hosts {
+		if a.hosts[i].Domain == domain {
+			return &a.hosts[i]
+		}
+	}
+	return nil
+}
+
+func (a *Agent) findIdentityForFile(idFile string) *ForwardedHost {
+	for i := range a.hosts {
+		if "id_rsa."+a.hosts[i].Domain == idFile {
+			return &a.hosts[i]
+		}
+	}
+	return nil
+}
+
+// lookupIdentity finds an identity by domain or uid,
+// the domain taking precedence as the uid may be shared.
+func (a *Agent) lookupIdentity(uid string) *ForwardedHost {
+	if fw := a.findIdentity(uid); fw != nil {
+		return fw
+	}
+	for i := range a.hosts {
+		if uid == a.hosts[i].UID {
+			return &a.hosts[i]
+		}
+	}
+	return nil
+}
+
+func containsIdentity(hosts []ForwardedHost, domain string) bool {
+	for _, x := range hosts {
+		if x.Domain == domain {
 			return true
 		}
 	}
@@ -74,7 +166,8 @@ func filterPublicKeys(path string) ([]string, error) {
 	}
 	res := []string{}
 	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), ".pub") {
+		// Hidden files are temporary files of an ongoing write
+		if !strings.HasSuffix(f.Name(), ".pub") && !strings.HasPrefix(f.Name(), ".") {
 			res = append(res, f.Name())
 		}
 	}
@@ -85,8 +178,9 @@ func filterPublicKeys(path string) ([]string, error) {
 // (domain or uid), and removes the corresponding
 // entry from the filesystem and the agent memory
 func (a *Agent) RemoveIdentity(uid string) error {
+	fw := a.lookupIdentity(uid)
 	for i, x := range a.hosts {
-		if uid == x.UID || uid == x.Domain {
+		if fw != nil && x.Domain == fw.Domain {
 			path := path.Join(
 				a.RootDirectory,
 				"identities",
@@ -96,6 +190,7 @@ func (a *Agent) RemoveIdentity(uid string) error {
 			if err != nil {
 				return err
 			}
+			a.stopForward(&x)
 			a.hosts = append(a.hosts[:i], a.hosts[i+1:]...)
 			return nil
 		}
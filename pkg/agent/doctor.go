@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+// Diagnostic statuses
+const (
+	DiagnosticPass = "pass"
+	DiagnosticWarn = "warn"
+	DiagnosticFail = "fail"
+	DiagnosticSkip = "skip"
+)
+
+// Diagnostic is the result of a connectivity check,
+// with a remediation hint when it did not pass.
+type Diagnostic struct {
+	Domain string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Check  string `json:"check" yaml:"check"`
+	Status string `json:"status" yaml:"status"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty" yaml:"hint,omitempty"`
+}
+
+// diagnosis accumulates the diagnostics of a domain. Once a check failed,
+// the checks depending on it are skipped.
+type diagnosis struct {
+	domain  string
+	results []Diagnostic
+	failed  bool
+}
+
+func (d *diagnosis) pass(check string, detail string) {
+	d.results = append(d.results, Diagnostic{Domain: d.domain, Check: check, Status: DiagnosticPass, Detail: detail})
+}
+
+func (d *diagnosis) warn(check string, detail string, hint string) {
+	d.results = append(d.results, Diagnostic{Domain: d.domain, Check: check, Status: DiagnosticWarn, Detail: detail, Hint: hint})
+}
+
+func (d *diagnosis) fail(check string, err error, hint string) {
+	d.failed = true
+	d.results = append(d.results, Diagnostic{Domain: d.domain, Check: check, Status: DiagnosticFail, Detail: err.Error(), Hint: hint})
+}
+
+func (d *diagnosis) skip(checks ...string) {
+	for _, check := range checks {
+		d.results = append(d.results, Diagnostic{Domain: d.domain, Check: check, Status: DiagnosticSkip})
+	}
+}
+
+// Diagnose runs the end to end connectivity checks of the domain
+// (or uid): DNS, API, authentication, gatekeeper, SSH handshake,
+// slots and local targets. The diagnosis is read-only: the authentication
+// is a dry run, no slot is allocated or bound on the gatekeeper.
+func (a *Agent) Diagnose(uid string) []Diagnostic {
+	d := &diagnosis{domain: uid}
+	fw := a.lookupIdentity(uid)
+	if fw == nil {
+		d.fail("identity", errors.New("identity not found"), "register the domain with `rssh agent register -d "+uid+"`")
+		return d.results
+	}
+	d.domain = fw.Domain
+	d.pass("identity", fw.UID)
+	infos := a.diagnoseGatekeeper(d, fw)
+	for _, target := range fw.AllTargets() {
+		diagnoseSlot(d, infos, target.Name)
+	}
+	for _, target := range fw.AllTargets() {
+		check := "target " + target.Name
+		if err := probeTarget(&target); err != nil {
+			d.fail(check, err, "ensure the local service is running and listening on "+target.Address())
+		} else {
+			d.pass(check, target.Address())
+		}
+	}
+	return d.results
+}
+
+// diagnoseGatekeeper runs the checks up to the SSH handshake, and returns
+// the response of the authentication dry run, nil if it failed.
+func (a *Agent) diagnoseGatekeeper(d *diagnosis, fw *ForwardedHost) *api.GkConnectInfos {
+	remaining := []string{"dns", "api", "auth", "gatekeeper", "ssh"}
+	next := func() string {
+		check := remaining[0]
+		remaining = remaining[1:]
+		return check
+	}
+	_, root, _ := fw.splitDomain()
+
+	check := next()
+	addrs, err := net.LookupHost(root)
+	if err != nil {
+		d.fail(check, err, "ensure the DNS records of "+root+" point to the RSSH API and gatekeeper")
+		d.skip(remaining...)
+		return nil
+	}
+	d.pass(check, fmt.Sprintf("%s resolves to %v", root, addrs))
+
+	check = next()
+	if err := a.checkAPIHealth(root); err != nil {
+		d.fail(check, err, "ensure the API is running and its port ("+strconv.Itoa(int(a.APIPort))+") is reachable, or configure a proxy")
+		d.skip(remaining...)
+		return nil
+	}
+	d.pass(check, "healthy")
+
+	check = next()
+	infos, err := a.authenticate(fw, true)
+	if err != nil {
+		d.fail(check, err, "the identity may have been revoked, register the domain again")
+		d.skip(remaining...)
+		return nil
+	}
+	gk := &infos.GkMeta
+	d.pass(check, fmt.Sprintf("gatekeeper on port %d", gk.SSHPort))
+
+	check = next()
+	conn, gkAddr, err := a.dialGatekeeper(root, gk)
+	if err != nil {
+		d.fail(check, err, "ensure the gatekeeper is running and reachable, or use the websocket transport")
+		d.skip(remaining...)
+		return infos
+	}
+	d.pass(check, fmt.Sprintf("%s (%s)", gkAddr, a.transport()))
+
+	check = next()
+	sshConn, _, err := handshakeGatekeeper(conn, gkAddr, gk, fw)
+	if err != nil {
+		conn.Close()
+		d.fail(check, err, "ensure the gatekeeper host key is valid and the identity key is accepted")
+		d.skip(remaining...)
+		return infos
+	}
+	sshConn.Close()
+	d.pass(check, "authenticated")
+	return infos
+}
+
+// diagnoseSlot reports the state of the slots of the target on the gatekeeper,
+// as published by the authentication dry run.
+func diagnoseSlot(d *diagnosis, infos *api.GkConnectInfos, target string) {
+	check := "slot " + target
+	if infos == nil {
+		d.skip(check)
+		return
+	}
+	if infos.Slots == nil {
+		d.warn(check, "the API does not report the slots", "upgrade the RSSH API")
+		return
+	}
+	allocated := []uint16{}
+	for _, slot := range infos.Slots {
+		if slot.Target != target {
+			continue
+		}
+		if slot.Established {
+			if slot.Healthy != nil && !*slot.Healthy {
+				d.warn(check, fmt.Sprintf("port %d established, target reported down", slot.Port), "ensure the local service is running")
+			} else {
+				d.pass(check, fmt.Sprintf("port %d established", slot.Port))
+			}
+			return
+		}
+		allocated = append(allocated, slot.Port)
+	}
+	if len(allocated) == 0 {
+		d.fail(check, errors.New("no slot allocated"), "start the agent with `rssh agent`")
+		return
+	}
+	d.fail(check, fmt.Errorf("slots %v allocated but not bound", allocated), "start the agent with `rssh agent`, and check its logs for forwarding errors")
+}
+
+func (a *Agent) transport() string {
+	if a.Transport == "" {
+		return TransportTCP
+	}
+	return a.Transport
+}
+
+// checkAPIHealth queries the API health endpoint of the root domain.
+func (a *Agent) checkAPIHealth(root string) error {
+	httpClient, err := a.httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/health", net.JoinHostPort(root, strconv.Itoa(int(a.APIPort)))))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	health := struct {
+		Ok bool `json:"ok"`
+	}{}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return err
+	}
+	if !health.Ok {
+		return errors.New("API reported unhealthy")
+	}
+	return nil
+}
+
+// Domains returns the domains of all the identities known by the agent.
+func (a *Agent) Domains() []string {
+	res := []string{}
+	for _, x := range a.hosts {
+		res = append(res, x.Domain)
+	}
+	return res
+}
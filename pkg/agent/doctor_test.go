@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+func TestDiagnoseSlot(t *testing.T) {
+	down := false
+	up := true
+	tests := []struct {
+		name   string
+		infos  *api.GkConnectInfos
+		target string
+		want   string
+	}{
+		{"authentication failed", nil, "default", DiagnosticSkip},
+		{"API without slots", &api.GkConnectInfos{}, "default", DiagnosticWarn},
+		{"no slot", &api.GkConnectInfos{Slots: []api.SlotState{}}, "default", DiagnosticFail},
+		{"other target slot", &api.GkConnectInfos{Slots: []api.SlotState{{Target: "pg", Port: 2000, Established: true}}}, "default", DiagnosticFail},
+		{"not bound", &api.GkConnectInfos{Slots: []api.SlotState{{Target: "default", Port: 2000}}}, "default", DiagnosticFail},
+		{"established", &api.GkConnectInfos{Slots: []api.SlotState{{Target: "default", Port: 2000, Established: true}}}, "default", DiagnosticPass},
+		{"established healthy", &api.GkConnectInfos{Slots: []api.SlotState{{Target: "pg", Port: 2000, Established: true, Healthy: &up}}}, "pg", DiagnosticPass},
+		{"established down", &api.GkConnectInfos{Slots: []api.SlotState{{Target: "pg", Port: 2000, Established: true, Healthy: &down}}}, "pg", DiagnosticWarn},
+		{
+			"stale slot and established slot",
+			&api.GkConnectInfos{Slots: []api.SlotState{{Target: "default", Port: 2000}, {Target: "default", Port: 2001, Established: true}}},
+			"default", DiagnosticPass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &diagnosis{domain: "sub.example.com"}
+			diagnoseSlot(d, tt.infos, tt.target)
+			if len(d.results) != 1 {
+				t.Fatalf("%d diagnostics, want 1", len(d.results))
+			}
+			if got := d.results[0]; got.Status != tt.want || got.Check != "slot "+tt.target {
+				t.Errorf("diagnostic = %+v, want status %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,7 @@
 package agent
 
 import (
-	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -35,22 +33,6 @@ func ensureDirectory(path string, mode os.FileMode) error {
 	return nil
 }
 
-func parsePrivatekeyFromFile(file string) (*rsa.PrivateKey, error) {
-	pemEncoded, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(pemEncoded)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("invalid PEM block")
-	}
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return priv, nil
-}
-
 func (a *Agent) ensureRSSHDirectories() error {
 	if err := ensureDirectory(a.RootDirectory, 0744); err != nil {
 		return err
@@ -67,14 +49,20 @@ func (a *Agent) setupFileSystem() error {
 	return nil
 }
 
-func parseFwdHostFromFile(file string) (*ForwardedHost, error) {
+func (a *Agent) parseFwdHostFromFile(file string) (*ForwardedHost, error) {
 	pemEncoded, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(pemEncoded)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("invalid PEM block")
+	return a.parseFwdHost(pemEncoded, strings.TrimPrefix(filepath.Base(file), "id_rsa."))
+}
+
+// parseFwdHost decodes an identity private key, and the
+// forwarding configuration stored in its PEM headers.
+func (a *Agent) parseFwdHost(pemEncoded []byte, domain string) (*ForwardedHost, error) {
+	block, err := a.openIdentity(pemEncoded)
+	if err != nil {
+		return nil, err
 	}
 	for _, k := range []string{"uid", "host", "port"} {
 		if len(block.Headers[k]) == 0 {
@@ -85,23 +73,31 @@ func parseFwdHostFromFile(file string) (*ForwardedHost, error) {
 	if err != nil {
 		return nil, err
 	}
+	targets, err := parseTargets(block.Headers["targets"])
+	if err != nil {
+		return nil, err
+	}
 
-	pkey, err := parsePrivatekeyFromFile(file)
+	pkey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
 	}
 
 	fwHost := ForwardedHost{
 		UID:        block.Headers["uid"],
+		Root:       block.Headers["root"],
 		Host:       block.Headers["host"],
 		Port:       uint16(fwPort),
-		Domain:     strings.TrimPrefix(filepath.Base(file), "id_rsa."),
+		Targets:    targets,
+		Domain:     domain,
 		privateKey: pkey,
 	}
 	return &fwHost, nil
 }
 
-func persistKeyToDisk(
+// persistKeyToDisk writes the identity key pair, the private key
+// is encrypted beforehand if key encryption is enabled.
+func (a *Agent) persistKeyToDisk(
 	configDir string,
 	domain string,
 	creds *api.AgentCredentials,
@@ -109,8 +105,12 @@ func persistKeyToDisk(
 	if creds == nil {
 		return errors.New("empty credentials cannot be persisted")
 	}
+	secret, err := a.sealIdentity(creds.Secret)
+	if err != nil {
+		return err
+	}
 	keyName := fmt.Sprintf("id_rsa.%s", domain)
-	err := ioutil.WriteFile(path.Join(configDir, keyName), creds.Secret, 0600)
+	err = writeFileAtomic(path.Join(configDir, keyName), secret, 0600)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Health checks performed on the targets
+const (
+	// CheckTCP only ensures the target accepts connections (default)
+	CheckTCP = "tcp"
+	// CheckSSH ensures the target sends an SSH banner
+	CheckSSH = "ssh"
+	// CheckNone disables the health checks
+	CheckNone = "none"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	probeTimeout          = 3 * time.Second
+)
+
+func validateCheck(check string) error {
+	switch check {
+	case "", CheckTCP, CheckSSH, CheckNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid health check %s", check)
+	}
+}
+
+// probeTarget returns an error if the target can't serve connections.
+func probeTarget(t *Target) error {
+	network, addr := t.Network()
+	conn, err := net.DialTimeout(network, addr, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if t.Check != CheckSSH {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	banner := make([]byte, 4)
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		return err
+	}
+	if string(banner) != "SSH-" {
+		return errors.New("invalid SSH banner")
+	}
+	return nil
+}
+
+func (a *Agent) healthInterval() time.Duration {
+	if a.HealthInterval <= 0 {
+		return defaultHealthInterval
+	}
+	return a.HealthInterval
+}
+
+// monitorTargets periodically probes the targets bound to the forward slots,
+// and reports their health to the gatekeeper whenever it changes.
+func (a *Agent) monitorTargets(fwHost *ForwardedHost) {
+	conn := fwHost.session.conn
+	reported := map[uint32]bool{}
+	ticker := time.NewTicker(a.healthInterval())
+	defer ticker.Stop()
+	for {
+		for port, name := range fwHost.slots {
+			target := fwHost.findTarget(name)
+			if target == nil || target.Check == CheckNone {
+				continue
+			}
+			err := probeTarget(target)
+			healthy := err == nil
+			if last, ok := reported[port]; ok && last == healthy {
+				continue
+			}
+			if err != nil {
+				log.Warn().
+					Str("error", err.Error()).
+					Str("domain", fwHost.Domain).
+					Str("target", target.Name).
+					Msg("Target is down.")
+			} else {
+				log.Info().
+					Str("domain", fwHost.Domain).
+					Str("target", target.Name).
+					Msg("Target is up.")
+			}
+			if _, _, err := conn.SendRequest(
+				gatekeeper.HealthRequestType,
+				true,
+				ssh.Marshal(&gatekeeper.HealthReport{Port: port, Healthy: healthy}),
+			); err != nil {
+				log.Debug().
+					Str("error", err.Error()).
+					Str("domain", fwHost.Domain).
+					Msg("Failed to report target health.")
+				continue
+			}
+			reported[port] = healthy
+		}
+
+		select {
+		case <-fwHost.stop:
+			return
+		case <-fwHost.session.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// IdentityInfo is the public description of an identity,
+// as displayed by the CLI.
+type IdentityInfo struct {
+	Domain      string       `json:"domain" yaml:"domain"`
+	UID         string       `json:"uid" yaml:"uid"`
+	Host        string       `json:"host" yaml:"host"`
+	Port        uint16       `json:"port" yaml:"port"`
+	Targets     []TargetInfo `json:"targets,omitempty" yaml:"targets,omitempty"`
+	Enabled     bool         `json:"enabled" yaml:"enabled"`
+	KeyType     string       `json:"key_type" yaml:"key_type"`
+	Fingerprint string       `json:"fingerprint" yaml:"fingerprint"`
+}
+
+// TargetInfo is the public description of a named target.
+type TargetInfo struct {
+	Name string `json:"name" yaml:"name"`
+	Host string `json:"host" yaml:"host"`
+	Port uint16 `json:"port" yaml:"port"`
+}
+
+// Info describes the identity, including its public key fingerprint.
+func (fw *ForwardedHost) Info() IdentityInfo {
+	info := IdentityInfo{
+		Domain:  fw.Domain,
+		UID:     fw.UID,
+		Host:    fw.Host,
+		Port:    fw.Port,
+		Enabled: fw.Enabled,
+	}
+	for _, t := range fw.Targets {
+		info.Targets = append(info.Targets, TargetInfo{Name: t.Name, Host: t.Host, Port: t.Port})
+	}
+	if fw.privateKey != nil {
+		if pub, err := ssh.NewPublicKey(&fw.privateKey.PublicKey); err == nil {
+			info.KeyType = pub.Type()
+			info.Fingerprint = ssh.FingerprintSHA256(pub)
+		}
+	}
+	return info
+}
+
+// Identities describes all the identities known by the agent.
+func (a *Agent) Identities() []IdentityInfo {
+	res := []IdentityInfo{}
+	for _, x := range a.hosts {
+		res = append(res, x.Info())
+	}
+	return res
+}
+
+// Identity describes an identity, by domain or uid.
+func (a *Agent) Identity(uid string) (*IdentityInfo, error) {
+	fw := a.lookupIdentity(uid)
+	if fw == nil {
+		return nil, errors.New("Identity not found : " + uid)
+	}
+	info := fw.Info()
+	return &info, nil
+}
+
+// splitDomain splits the FQDN into the subdomain and the RSSH root domain,
+// which is derived from the FQDN and the configured `roots` if not given
+// (see utils.SplitDomainRequest).
+func splitDomain(fqdn string, root string, roots []string) (string, string, error) {
+	if len(root) == 0 {
+		return utils.SplitDomainRequest(fqdn, roots)
+	}
+	sub, root, ok := utils.SplitDomain(fqdn, []string{root})
+	if !ok {
+		return "", "", fmt.Errorf("%s is not a subdomain of %s", fqdn, root)
+	}
+	return sub, root, nil
+}
+
+// splitDomain returns the subdomain and the RSSH root domain of the identity.
+// Identities registered before the multiple levels subdomains have no root
+// domain, their subdomain is the first label.
+func (fw *ForwardedHost) splitDomain() (string, string, error) {
+	if len(fw.Root) == 0 {
+		labels := strings.SplitN(fw.Domain, ".", 2)
+		if len(labels) < 2 {
+			return "", "", fmt.Errorf("invalid domain %s", fw.Domain)
+		}
+		return labels[0], labels[1], nil
+	}
+	return splitDomain(fw.Domain, fw.Root, nil)
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// machineKeyName is the key pair identifying the agent machine, shared by
+// all the domains it registers. Domain identities are copies of this key,
+// with their forwarding configuration in the PEM headers.
+const machineKeyName = "id_rsa"
+
+// loadMachineIdentity returns the agent machine credentials, with the
+// private key in plaintext, or nil if the agent has not registered yet.
+func (a *Agent) loadMachineIdentity() (*api.AgentCredentials, error) {
+	keyFile := path.Join(a.RootDirectory, machineKeyName)
+	pemEncoded, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := a.openIdentity(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.FromString(block.Headers["uid"])
+	if err != nil {
+		return nil, errors.New("invalid uid encoded in the machine identity")
+	}
+	pub, err := ioutil.ReadFile(keyFile + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	return &api.AgentCredentials{
+		ID:       id,
+		Identity: pub,
+		Secret:   pem.EncodeToMemory(block),
+	}, nil
+}
+
+// persistMachineIdentity stores the credentials of the first registration
+// as the agent machine identity, reused by the next registrations.
+func (a *Agent) persistMachineIdentity(creds *api.AgentCredentials) error {
+	secret, err := a.sealIdentity(creds.Secret)
+	if err != nil {
+		return err
+	}
+	keyFile := path.Join(a.RootDirectory, machineKeyName)
+	if err := writeFileAtomic(keyFile, secret, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile+".pub", creds.Identity, 0644); err != nil {
+		return err
+	}
+	log.Info().
+		Str("agent", creds.ID.String()).
+		Msg("Persisted machine identity to disk.")
+	return nil
+}
+
+// registerRequestBody describes the agent machine to the API,
+// for the registration of the domain `fqdn`.
+func (a *Agent) registerRequestBody(machine *api.AgentCredentials, fqdn string) api.RegisterRequestBody {
+	body := api.RegisterRequestBody{
+		Version:   a.Version,
+		Labels:    a.Labels,
+		Domain:    fqdn,
+		Timestamp: time.Now().Unix(),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		body.Hostname = hostname
+	}
+	if machine != nil {
+		body.AgentID = machine.ID.String()
+	}
+	return body
+}
+
+// machineSigner returns the signer of the machine identity, nil if there is none.
+func machineSigner(machine *api.AgentCredentials) (ssh.Signer, error) {
+	if machine == nil {
+		return nil, nil
+	}
+	return ssh.ParsePrivateKey(machine.Secret)
+}
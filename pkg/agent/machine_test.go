@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Xide/rssh/pkg/api"
+)
+
+func TestRegisterRequestSignature(t *testing.T) {
+	machine, err := api.GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		machine *api.AgentCredentials
+		signed  bool
+	}{
+		{"new agent", nil, false},
+		{"machine identity", machine, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			var signature string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				signature = r.Header.Get(api.RegisterSignatureHeader)
+				json.NewEncoder(w).Encode(api.RegisterResponse{AgentID: machine})
+			}))
+			defer srv.Close()
+
+			signer, err := machineSigner(tt.machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &Agent{}
+			if _, err := registerRequest(srv.Client(), srv.URL, a.registerRequestBody(tt.machine, "sub.example.com"), signer); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.signed {
+				if signature != "" {
+					t.Error("request of a new agent is signed")
+				}
+				return
+			}
+			if err := api.VerifyRegisterRequest(string(machine.Identity), body, signature); err != nil {
+				t.Errorf("invalid request signature: %v", err)
+			}
+			sent := api.RegisterRequestBody{}
+			if err := json.Unmarshal(body, &sent); err != nil {
+				t.Fatal(err)
+			}
+			if sent.AgentID != machine.ID.String() || sent.Domain != "sub.example.com" || sent.Timestamp == 0 {
+				t.Errorf("unexpected request body %+v", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Environment variables from which the passphrases are read when no
+// passphrase file is given, for unattended usage. Each passphrase has its
+// own variable, so that sharing a bundle does not disclose the passphrase
+// protecting the private keys at rest.
+const (
+	// BundlePassphraseEnv holds the passphrase of the exported bundles
+	BundlePassphraseEnv = "RSSH_BUNDLE_PASSPHRASE"
+	// KeyPassphraseEnv holds the passphrase encrypting the private keys at rest
+	KeyPassphraseEnv = "RSSH_KEY_PASSPHRASE"
+)
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+// ReadPassphrase returns the passphrase stored in `file`, in the `env`
+// environment variable, or prompted on the terminal, by order of precedence.
+// If `confirm` is set, the prompted passphrase has to be typed twice.
+func ReadPassphrase(file string, env string, confirm bool) ([]byte, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase provided, set %s or use a passphrase file", env)
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// sealedPayload is a payload encrypted with AES-GCM,
+// using a key derived from a passphrase with scrypt.
+type sealedPayload struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func passphraseCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(plaintext []byte, passphrase []byte) (*sealedPayload, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &sealedPayload{
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+func (s *sealedPayload) open(passphrase []byte) ([]byte, error) {
+	aead, err := passphraseCipher(passphrase, s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, s.Nonce, s.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("invalid passphrase or corrupted payload")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPassphrase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "passphrase")
+	if err := ioutil.WriteFile(file, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		file string
+		env  string
+		want string
+	}{
+		{"file before environment", file, BundlePassphraseEnv, "from file"},
+		{"bundle passphrase", "", BundlePassphraseEnv, "bundle"},
+		{"key passphrase", "", KeyPassphraseEnv, "key"},
+	}
+	t.Setenv(BundlePassphraseEnv, "bundle")
+	t.Setenv(KeyPassphraseEnv, "key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadPassphrase(tt.file, tt.env, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadPassphrase() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSealedPayload(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		tamper     func(*sealedPayload)
+		wantErr    bool
+	}{
+		{"same passphrase", "secret", nil, false},
+		{"wrong passphrase", "other", nil, true},
+		{"tampered ciphertext", "secret", func(s *sealedPayload) { s.Ciphertext[0] ^= 1 }, true},
+		{"tampered salt", "secret", func(s *sealedPayload) { s.Salt[0] ^= 1 }, true},
+		{"truncated nonce", "secret", func(s *sealedPayload) { s.Nonce = s.Nonce[1:] }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := seal([]byte("payload"), []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(sealed)
+			}
+			got, err := sealed.open([]byte(tt.passphrase))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil || string(got) != "payload" {
+				t.Errorf("open() = %q, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const dialTimeout = 10 * time.Second
+
+// proxyFunc returns the proxy selection of the connections to the API and the
+// gatekeeper: the `agent.proxy` setting if defined, or the proxy from the
+// environment (HTTP_PROXY or HTTPS_PROXY by URL scheme, then ALL_PROXY).
+// The hosts matching NO_PROXY are always reached directly.
+func (a *Agent) proxyFunc() func(*url.URL) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if len(a.Proxy) > 0 {
+		cfg.HTTPProxy, cfg.HTTPSProxy = a.Proxy, a.Proxy
+	} else if all := getEnvAny("ALL_PROXY", "all_proxy"); len(all) > 0 {
+		if len(cfg.HTTPProxy) == 0 {
+			cfg.HTTPProxy = all
+		}
+		if len(cfg.HTTPSProxy) == 0 {
+			cfg.HTTPSProxy = all
+		}
+	}
+	// The SOCKS5 dialer always lets the proxy resolve the names.
+	cfg.HTTPProxy = strings.Replace(cfg.HTTPProxy, "socks5h://", "socks5://", 1)
+	cfg.HTTPSProxy = strings.Replace(cfg.HTTPSProxy, "socks5h://", "socks5://", 1)
+	proxyForURL := cfg.ProxyFunc()
+	return func(u *url.URL) (*url.URL, error) {
+		p, err := proxyForURL(u)
+		if err != nil || p == nil {
+			return nil, err
+		}
+		switch p.Scheme {
+		case "http", "socks5":
+			return p, nil
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s", p.Scheme)
+		}
+	}
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); len(val) > 0 {
+			return val
+		}
+	}
+	return ""
+}
+
+// proxyURL returns the proxy used to open a TCP connection to addr, like
+// for an HTTPS request. It returns nil if the connection is direct.
+func (a *Agent) proxyURL(addr string) (*url.URL, error) {
+	return a.proxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+// apiProxyFunc returns the proxy selection of the API requests. The API is
+// reached over plain HTTP, the HTTPS proxy is used when no HTTP proxy is
+// defined, like for the connections to the gatekeeper (see proxyURL).
+func (a *Agent) apiProxyFunc() func(*url.URL) (*url.URL, error) {
+	proxyForURL := a.proxyFunc()
+	return func(u *url.URL) (*url.URL, error) {
+		p, err := proxyForURL(u)
+		if err != nil || p != nil || u.Scheme != "http" {
+			return p, err
+		}
+		return proxyForURL(&url.URL{Scheme: "https", Host: u.Host})
+	}
+}
+
+// httpClient returns the client used to contact the API.
+func (a *Agent) httpClient() (*http.Client, error) {
+	proxyForURL := a.apiProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// dial opens a TCP connection to addr, through the proxy if any.
+func (a *Agent) dial(addr string) (net.Conn, error) {
+	u, err := a.proxyURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	direct := &net.Dialer{Timeout: dialTimeout}
+	if u == nil {
+		return direct.Dial("tcp", addr)
+	}
+	if u.Scheme == "http" {
+		return dialHTTPConnect(u, addr)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// bufferedConn reads through the buffer used to parse
+// the proxy response, in case it already holds tunneled data.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// dialHTTPConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialHTTPConnect(u *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// Do not hang on a proxy accepting connections without answering
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{conn, r}, nil
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,31 +9,55 @@ import (
 	"net/http"
 	"path"
 
-	"github.com/Xide/rssh/pkg/utils"
+	"github.com/Xide/rssh/pkg/gatekeeper"
 
 	"github.com/Xide/rssh/pkg/api"
 	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/ssh"
 )
 
 // RegisterRequest is the result of a `rssh agent register ...` command.
 type RegisterRequest struct {
 	// Requested domain FQDN (including RSSH root domain)
 	Domain string
-	// Host to dial for the "local" end of the connection
+	// RSSH root domain of Domain, derived from it when empty
+	// (see utils.SplitDomainRequest)
+	Root string
+	// Host to dial for the "local" end of the connection,
+	// or `unix:///path` for a unix domain socket.
 	Host string
 	// Port to dial for the "local" end of the connection
 	Port uint16
+	// Named targets exposed in addition to Host / Port
+	Targets []Target
 }
 
-// registerRequest perform the http request, parse the result,
-// interpret any server error and return the generated credentials
-// upon success
-func registerRequest(url string) (*api.AgentCredentials, error) {
-	resp, err := http.Post(
-		url,
-		"application/json",
-		nil,
-	)
+// errUnknownAgent is returned by the API when the machine identity
+// sent in the registration is not known (e.g: removed by an operator).
+const errUnknownAgent = "Unknown agent."
+
+// registerRequest perform the http request, signed by `signer` when the
+// agent has a machine identity, parse the result, interpret any server
+// error and return the generated credentials upon success
+func registerRequest(httpClient *http.Client, url string, reqBody api.RegisterRequestBody, signer ssh.Signer) (*api.AgentCredentials, error) {
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if signer != nil {
+		signature, err := api.SignRegisterRequest(signer, payload)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set(api.RegisterSignatureHeader, signature)
+	}
+	resp, err := httpClient.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -56,28 +81,84 @@ func registerRequest(url string) (*api.AgentCredentials, error) {
 
 // RegisterHost contact the API to retreive credentials for domain `req.Domain`
 func (a *Agent) RegisterHost(req *RegisterRequest) error {
-	subDomain, rootDomain := utils.SplitDomainRequest(req.Domain)
+	if err := validateTargets(req.Targets); err != nil {
+		return err
+	}
+	defaultTarget := Target{Name: gatekeeper.DefaultTarget, Host: req.Host, Port: req.Port}
+	if err := defaultTarget.validateEndpoint(); err != nil {
+		return err
+	}
+	for _, t := range append([]Target{defaultTarget}, req.Targets...) {
+		if err := t.checkSocket(); err != nil {
+			return err
+		}
+	}
+	subDomain, rootDomain, err := splitDomain(req.Domain, req.Root, a.RootDomains)
+	if err != nil {
+		if len(req.Root) == 0 {
+			return fmt.Errorf("%s (see --root-domain)", err.Error())
+		}
+		return err
+	}
+	req.Root = rootDomain
 
 	log.Debug().
 		Str("root", rootDomain).
 		Str("sub", subDomain).
 		Msg("Registration request")
-	creds, err := registerRequest(fmt.Sprintf(
+	httpClient, err := a.httpClient()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf(
 		"http://%s:%d/register/%s",
 		rootDomain,
 		a.APIPort,
 		subDomain,
-	))
+	)
+	// The domain is owned by the machine identity if there is one,
+	// the API then only returns its public part.
+	machine, err := a.loadMachineIdentity()
 	if err != nil {
 		return err
 	}
+	signer, err := machineSigner(machine)
+	if err != nil {
+		return err
+	}
+	fqdn := subDomain + "." + rootDomain
+	creds, err := registerRequest(httpClient, url, a.registerRequestBody(machine, fqdn), signer)
+	if err != nil && err.Error() == errUnknownAgent && machine != nil {
+		log.Warn().
+			Str("agent", machine.ID.String()).
+			Msg("Machine identity unknown to the API, registering a new one.")
+		machine = nil
+		creds, err = registerRequest(httpClient, url, a.registerRequestBody(nil, fqdn), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if machine != nil && uuid.Equal(machine.ID, creds.ID) {
+		creds.Secret = machine.Secret
+	} else if machine == nil {
+		if err := a.persistMachineIdentity(creds); err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Msg("Failed to persist the machine identity, the next domains will have their own.")
+		}
+	}
+	// Otherwise, the API does not support machine identities
+	// and generated credentials for this domain only.
+	if len(creds.Secret) == 0 {
+		return errors.New("no private key received for the domain")
+	}
 
 	err = embedHostConfiguration(creds, req)
 	if err != nil {
 		return err
 	}
 
-	err = persistKeyToDisk(path.Join(a.RootDirectory, "identities"), req.Domain, creds)
+	err = a.persistKeyToDisk(path.Join(a.RootDirectory, "identities"), req.Domain, creds)
 	if err != nil {
 		return err
 	}
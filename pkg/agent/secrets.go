@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Protections of the private keys at rest
+const (
+	// KeyEncryptionNone stores the private keys in plaintext (default)
+	KeyEncryptionNone = "none"
+	// KeyEncryptionPassphrase encrypts the private keys with a passphrase
+	// read from a file or the KeyPassphraseEnv environment variable.
+	KeyEncryptionPassphrase = "passphrase"
+	// KeyEncryptionKeyring encrypts the private keys with a random secret
+	// stored in a keyring file, generated on first use.
+	KeyEncryptionKeyring = "keyring"
+)
+
+// PEM headers of an encrypted private key
+const (
+	encryptionHeader    = "encryption"
+	encryptionAlgorithm = "scrypt-aes256-gcm"
+	saltHeader          = "salt"
+	nonceHeader         = "nonce"
+)
+
+// SecretProvider supplies the secret protecting the private keys at rest.
+type SecretProvider interface {
+	Secret() ([]byte, error)
+}
+
+// passphraseProvider reads the passphrase once, from a file,
+// the environment or the terminal.
+type passphraseProvider struct {
+	file       string
+	passphrase []byte
+	lock       sync.Mutex
+}
+
+func (p *passphraseProvider) Secret() ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.passphrase == nil {
+		passphrase, err := ReadPassphrase(p.file, KeyPassphraseEnv, false)
+		if err != nil {
+			return nil, err
+		}
+		p.passphrase = passphrase
+	}
+	return p.passphrase, nil
+}
+
+// keyringProvider keeps a random secret in a file, which should
+// be stored apart from the identities (e.g: on another volume).
+type keyringProvider struct {
+	file string
+	// Do not generate a missing keyring
+	readOnly bool
+}
+
+func (k *keyringProvider) Secret() ([]byte, error) {
+	b, err := ioutil.ReadFile(k.file)
+	if os.IsNotExist(err) && !k.readOnly {
+		return k.generate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+}
+
+func (k *keyringProvider) generate() ([]byte, error) {
+	secret := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(k.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(secret) + "\n"); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// keyProtector encrypts and decrypts the private keys PEM blocks.
+// Derived keys are cached by salt, as deriving them is expensive.
+type keyProtector struct {
+	provider SecretProvider
+	ciphers  map[string]cipher.AEAD
+	lock     sync.Mutex
+}
+
+func (k *keyProtector) cipher(salt []byte) (cipher.AEAD, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if aead, ok := k.ciphers[string(salt)]; ok {
+		return aead, nil
+	}
+	secret, err := k.provider.Secret()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := passphraseCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if k.ciphers == nil {
+		k.ciphers = map[string]cipher.AEAD{}
+	}
+	k.ciphers[string(salt)] = aead
+	return aead, nil
+}
+
+// encrypt replaces the block content by its ciphertext,
+// the headers are kept in plaintext.
+func (k *keyProtector) encrypt(block *pem.Block) error {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	aead, err := k.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	block.Bytes = aead.Seal(nil, nonce, block.Bytes, nil)
+	block.Headers[encryptionHeader] = encryptionAlgorithm
+	block.Headers[saltHeader] = base64.StdEncoding.EncodeToString(salt)
+	block.Headers[nonceHeader] = base64.StdEncoding.EncodeToString(nonce)
+	return nil
+}
+
+func (k *keyProtector) decrypt(block *pem.Block) error {
+	salt, err := base64.StdEncoding.DecodeString(block.Headers[saltHeader])
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers[nonceHeader])
+	if err != nil {
+		return err
+	}
+	aead, err := k.cipher(salt)
+	if err != nil {
+		return err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return errors.New("invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return errors.New("invalid secret or corrupted private key")
+	}
+	block.Bytes = plaintext
+	delete(block.Headers, encryptionHeader)
+	delete(block.Headers, saltHeader)
+	delete(block.Headers, nonceHeader)
+	return nil
+}
+
+func isEncryptedBlock(block *pem.Block) bool {
+	return block.Headers[encryptionHeader] != ""
+}
+
+// resolvePath returns the absolute path of file, with its symlinks resolved if it exists.
+func resolvePath(file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// validateKeyringFile ensures that the keyring is not stored along with the
+// identities it protects: a copy of the root directory must not be enough
+// to decrypt them.
+func validateKeyringFile(file string, rootDirectory string) error {
+	if file == "" {
+		return errors.New("keyring key encryption requires a keyring file, outside of the root directory")
+	}
+	keyring, err := resolvePath(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	root, err := resolvePath(rootDirectory)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, keyring)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("keyring file %s must be stored outside of the root directory %s", file, rootDirectory)
+	}
+	return nil
+}
+
+// initKeyProtection setups the secret provider configured for the private keys.
+func (a *Agent) initKeyProtection() error {
+	switch a.KeyEncryption {
+	case "", KeyEncryptionNone:
+		a.keys = nil
+	case KeyEncryptionPassphrase:
+		a.keys = &keyProtector{provider: &passphraseProvider{file: a.PassphraseFile}}
+	case KeyEncryptionKeyring:
+		if err := validateKeyringFile(a.KeyringFile, a.RootDirectory); err != nil {
+			return err
+		}
+		a.keys = &keyProtector{provider: &keyringProvider{file: a.KeyringFile, readOnly: a.readOnly}}
+	default:
+		return fmt.Errorf("invalid key encryption %s", a.KeyEncryption)
+	}
+	return nil
+}
+
+// sealIdentity encrypts the private key PEM if key encryption is enabled.
+func (a *Agent) sealIdentity(pemEncoded []byte) ([]byte, error) {
+	if a.keys == nil {
+		return pemEncoded, nil
+	}
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("invalid PEM block")
+	}
+	if isEncryptedBlock(block) {
+		return pemEncoded, nil
+	}
+	if err := a.keys.encrypt(block); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// openIdentity decodes the private key PEM, decrypting it if needed.
+func (a *Agent) openIdentity(pemEncoded []byte) (*pem.Block, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("invalid PEM block")
+	}
+	if !isEncryptedBlock(block) {
+		return block, nil
+	}
+	if block.Headers[encryptionHeader] != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported key encryption %s", block.Headers[encryptionHeader])
+	}
+	if a.keys == nil {
+		return nil, errors.New("private key is encrypted, key encryption must be configured")
+	}
+	if err := a.keys.decrypt(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// encryptIdentities encrypts the identities still stored in plaintext.
+func (a *Agent) encryptIdentities() error {
+	if a.keys == nil {
+		return nil
+	}
+	keyFiles := map[string]string{}
+	for _, x := range a.hosts {
+		keyFiles[x.Domain] = path.Join(a.RootDirectory, "identities", "id_rsa."+x.Domain)
+	}
+	if _, err := os.Stat(path.Join(a.RootDirectory, machineKeyName)); err == nil {
+		keyFiles[""] = path.Join(a.RootDirectory, machineKeyName)
+	}
+	for domain, keyFile := range keyFiles {
+		pemEncoded, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(pemEncoded)
+		if block == nil || isEncryptedBlock(block) {
+			continue
+		}
+		sealed, err := a.sealIdentity(pemEncoded)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(keyFile, sealed, 0600); err != nil {
+			return err
+		}
+		log.Info().
+			Str("domain", domain).
+			Str("file", keyFile).
+			Msg("Encrypted private key.")
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary file renamed over it,
+// so that the previous content is never truncated.
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
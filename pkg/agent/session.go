@@ -0,0 +1,315 @@
+package agent
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// gatekeeperSession is an SSH connection to a gatekeeper. It is shared by
+// the forwards of every domain served by this gatekeeper, each of them
+// binding its own slots on the connection.
+type gatekeeperSession struct {
+	host string
+	conn ssh.Conn
+	// Closed once the connection is lost
+	done chan struct{}
+	// Active forward and target bound to each slot
+	routes     map[uint32]slotRoute
+	routesLock sync.Mutex
+}
+
+type slotRoute struct {
+	fwHost *ForwardedHost
+	target string
+}
+
+func (s *gatekeeperSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *gatekeeperSession) bind(slot uint32, fwHost *ForwardedHost, target string) {
+	s.routesLock.Lock()
+	defer s.routesLock.Unlock()
+	s.routes[slot] = slotRoute{fwHost: fwHost, target: target}
+}
+
+func (s *gatekeeperSession) unbind(slot uint32) {
+	s.routesLock.Lock()
+	defer s.routesLock.Unlock()
+	delete(s.routes, slot)
+}
+
+func (s *gatekeeperSession) idle() bool {
+	s.routesLock.Lock()
+	defer s.routesLock.Unlock()
+	return len(s.routes) == 0
+}
+
+// route returns the forward and the target bound to the slot
+// on which the gatekeeper opened the channel.
+func (s *gatekeeperSession) route(x ssh.NewChannel) (*ForwardedHost, *Target, error) {
+	payload := forwardedTCPPayload{}
+	if err := ssh.Unmarshal(x.ExtraData(), &payload); err != nil {
+		return nil, nil, err
+	}
+	s.routesLock.Lock()
+	r, ok := s.routes[payload.DestPort]
+	s.routesLock.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("no forward bound to slot %d", payload.DestPort)
+	}
+	target := r.fwHost.findTarget(r.target)
+	if target == nil {
+		return nil, nil, fmt.Errorf("unknown target %s", r.target)
+	}
+	return r.fwHost, target, nil
+}
+
+// handshakeGatekeeper establishes the SSH connection on the stream,
+// authenticating with the identity of the forwarded host, and verifying
+// the gatekeeper against its published host keys.
+// The global requests of the gatekeeper are discarded.
+func handshakeGatekeeper(conn net.Conn, gkAddr string, gk *gatekeeper.Meta, fwHost *ForwardedHost) (ssh.Conn, <-chan ssh.NewChannel, error) {
+	sshConn, ch, reqs, err := handshakeGatekeeperRequests(conn, gkAddr, gk, fwHost)
+	if err != nil {
+		return nil, nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return sshConn, ch, nil
+}
+
+// handshakeGatekeeperRequests is handshakeGatekeeper, returning the global requests of the gatekeeper.
+func handshakeGatekeeperRequests(conn net.Conn, gkAddr string, gk *gatekeeper.Meta, fwHost *ForwardedHost) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	signer, err := ssh.NewSignerFromKey(fwHost.privateKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Gatekeepers predating the host keys publication are not verified
+	hostKeyCallback, err := gk.HostKeyCallback()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	sshConn, ch, reqs, err := ssh.NewClientConn(conn, gkAddr, &ssh.ClientConfig{
+		User: "rssh_agent",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sshConn, ch, reqs, nil
+}
+
+// handleGatekeeperRequests answers the global requests of the gatekeeper.
+// On a reconnect hint, sent before the gatekeeper shuts down, the connection
+// is closed and the forwards are established again after the hinted delay,
+// with a random jitter for the agents not to reconnect at the same time.
+func (a *Agent) handleGatekeeperRequests(session *gatekeeperSession, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type == gatekeeper.ReconnectRequestType {
+			hint := gatekeeper.ReconnectHint{}
+			if err := ssh.Unmarshal(req.Payload, &hint); err != nil {
+				log.Debug().
+					Str("error", err.Error()).
+					Msg("Invalid reconnect hint.")
+			}
+			delay := time.Duration(hint.Delay) * time.Second
+			if delay > 0 {
+				delay += time.Duration(rand.Int63n(int64(delay)))
+			}
+			log.Info().
+				Str("gatekeeper", session.host).
+				Dur("delay", delay).
+				Msg("Gatekeeper is shutting down, reconnecting later.")
+			a.sessionsLock.Lock()
+			if a.holdoff == nil {
+				a.holdoff = map[string]time.Time{}
+			}
+			a.holdoff[session.host] = time.Now().Add(delay)
+			a.sessionsLock.Unlock()
+			time.AfterFunc(delay, a.wakeup)
+			session.conn.Close()
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// isHeldOff returns true if the agent must wait
+// before reconnecting to the gatekeeper of `host`.
+func (a *Agent) isHeldOff(host string) bool {
+	a.sessionsLock.Lock()
+	defer a.sessionsLock.Unlock()
+	return time.Now().Before(a.holdoff[host])
+}
+
+// wakeup triggers an immediate reconciliation of the forwards.
+func (a *Agent) wakeup() {
+	select {
+	case a.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// openSession returns the session established with the gatekeeper of `host`,
+// connecting with the identity of the forwarded host if there is none.
+// The caller must hold the sessions lock.
+func (a *Agent) openSession(host string, gk *gatekeeper.Meta, fwHost *ForwardedHost) (*gatekeeperSession, error) {
+	if session, ok := a.sessions[host]; ok && !session.closed() {
+		return session, nil
+	}
+
+	conn, gkAddr, err := a.dialGatekeeper(host, gk)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, ch, reqs, err := handshakeGatekeeperRequests(conn, gkAddr, gk, fwHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	session := &gatekeeperSession{
+		host:   host,
+		conn:   sshConn,
+		done:   make(chan struct{}),
+		routes: map[uint32]slotRoute{},
+	}
+	if a.sessions == nil {
+		a.sessions = map[string]*gatekeeperSession{}
+	}
+	a.sessions[host] = session
+	log.Debug().
+		Str("gatekeeper", gkAddr).
+		Msg("Connected to gatekeeper.")
+	go a.handleGatekeeperRequests(session, reqs)
+	go a.handleNewConnections(session, ch)
+	return session, nil
+}
+
+// releaseSlots cancels the forwarding of the slots bound by the forwarded
+// host, and closes its session if no other forward uses it.
+// The caller must hold the sessions lock.
+func (a *Agent) releaseSlots(fwHost *ForwardedHost) {
+	session := fwHost.session
+	for slot := range fwHost.slots {
+		session.unbind(slot)
+		if session.closed() {
+			continue
+		}
+		_, _, err := session.conn.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&struct {
+			BindAddr string
+			BindPort uint32
+		}{
+			BindAddr: "0.0.0.0",
+			BindPort: slot,
+		}))
+		if err != nil {
+			log.Debug().
+				Str("error", err.Error()).
+				Uint32("slot", slot).
+				Msg("Failed to cancel port forwarding.")
+		}
+	}
+	if session.idle() {
+		log.Debug().
+			Str("gatekeeper", session.host).
+			Msg("Closing idle gatekeeper connection.")
+		session.conn.Close()
+		if a.sessions[session.host] == session {
+			delete(a.sessions, session.host)
+		}
+	}
+}
+
+// dropSession forgets a session whose connection has been lost,
+// along with the forwards it was serving.
+func (a *Agent) dropSession(session *gatekeeperSession) {
+	close(session.done)
+
+	a.sessionsLock.Lock()
+	if a.sessions[session.host] == session {
+		delete(a.sessions, session.host)
+	}
+	a.sessionsLock.Unlock()
+
+	a.activesLock.Lock()
+	defer a.activesLock.Unlock()
+	for idx := 0; idx < len(a.actives); idx++ {
+		if h := a.actives[idx]; h.session == session {
+			log.Warn().
+				Str("domain", h.Domain).
+				Msg("Connection to gatekeeper interrupted")
+			a.actives = append(a.actives[:idx], a.actives[idx+1:]...)
+			idx--
+		}
+	}
+}
+
+func (a *Agent) handleNewConnections(session *gatekeeperSession, ch <-chan ssh.NewChannel) {
+	for x := range ch {
+		fwHost, target, err := session.route(x)
+		if err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("gatekeeper", session.host).
+				Msg("Could not route new connection.")
+			x.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		log.Debug().
+			Str("domain", fwHost.Domain).
+			Str("target", target.Name).
+			Msg("New connection request.")
+		if fwHost.MaxConnections > 0 && uint(atomic.LoadInt32(fwHost.connections)) >= fwHost.MaxConnections {
+			log.Warn().
+				Str("domain", fwHost.Domain).
+				Uint("max_connections", fwHost.MaxConnections).
+				Msg("Connection limit reached, rejecting connection.")
+			x.Reject(ssh.ResourceShortage, "connection limit reached")
+			continue
+		}
+		channel, reqs, err := x.Accept()
+		if err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("domain", fwHost.Domain).
+				Msg("Failed to accept new connection.")
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		atomic.AddInt32(fwHost.connections, 1)
+		err = forwardConnection(channel, target, func() {
+			atomic.AddInt32(fwHost.connections, -1)
+		})
+		if err != nil {
+			atomic.AddInt32(fwHost.connections, -1)
+			channel.Close()
+			log.Warn().
+				Str("error", err.Error()).
+				Str("domain", fwHost.Domain).
+				Str("target", target.Name).
+				Msg("Failed to forward new connection.")
+		}
+	}
+	a.dropSession(session)
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/rs/zerolog/log"
+)
+
+// unixScheme prefixes the host of targets listening on a unix domain socket
+const unixScheme = "unix://"
+
+// Target is a named local endpoint exposed through an identity.
+// Clients select it with `target.sub.root` or `sub.root:target`.
+type Target struct {
+	Name string `json:"name" mapstructure:"name"`
+	// Address or domain on which the agent will dial the connection,
+	// or `unix:///path` for a unix domain socket.
+	Host string `json:"host" mapstructure:"host"`
+	// Port on which the agent will connect to, unused for unix sockets
+	Port uint16 `json:"port" mapstructure:"port"`
+	// Health check performed on the target (tcp, ssh or none)
+	Check string `json:"check,omitempty" mapstructure:"check"`
+}
+
+// IsUnix returns true if the target is a unix domain socket.
+func (t *Target) IsUnix() bool {
+	return strings.HasPrefix(t.Host, unixScheme)
+}
+
+// Network returns the network and address used to dial the target.
+func (t *Target) Network() (string, string) {
+	if t.IsUnix() {
+		return "unix", strings.TrimPrefix(t.Host, unixScheme)
+	}
+	return "tcp", net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+}
+
+// Address returns the dialable address of the target.
+func (t *Target) Address() string {
+	if t.IsUnix() {
+		return t.Host
+	}
+	_, addr := t.Network()
+	return addr
+}
+
+// Dial connects to the target.
+func (t *Target) Dial() (net.Conn, error) {
+	network, addr := t.Network()
+	return net.Dial(network, addr)
+}
+
+// String serialize the target in the `name=host:port` format.
+func (t Target) String() string {
+	return fmt.Sprintf("%s=%s", t.Name, t.Address())
+}
+
+// Validate returns an error if the target can't be exposed.
+func (t *Target) Validate() error {
+	if err := api.ValidateTargetName(t.Name); err != nil {
+		return err
+	}
+	if t.Name == gatekeeper.DefaultTarget {
+		return fmt.Errorf("target name %s is reserved", t.Name)
+	}
+	return t.validateEndpoint()
+}
+
+func (t *Target) validateEndpoint() error {
+	if err := validateCheck(t.Check); err != nil {
+		return err
+	}
+	if t.IsUnix() {
+		_, socket := t.Network()
+		// Commas are used as separator in the identity headers
+		if !filepath.IsAbs(socket) || strings.Contains(socket, ",") {
+			return fmt.Errorf("invalid socket path for target %s", t.Name)
+		}
+		return nil
+	}
+	if len(t.Host) == 0 || t.Port == 0 {
+		return fmt.Errorf("invalid address for target %s", t.Name)
+	}
+	return nil
+}
+
+// checkSocket ensures that an unix target points to a socket.
+// A missing socket is allowed, as the service may not be started yet.
+func (t *Target) checkSocket() error {
+	if !t.IsUnix() {
+		return nil
+	}
+	_, socket := t.Network()
+	s, err := os.Stat(socket)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Warn().
+				Str("target", t.Name).
+				Str("socket", socket).
+				Msg("Socket does not exist yet.")
+			return nil
+		}
+		return err
+	}
+	if s.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", socket)
+	}
+	return nil
+}
+
+// ParseTarget parses a target in the `name=host:port`
+// or `name=unix:///path` format.
+func ParseTarget(raw string) (*Target, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid target %s, expected name=host:port", raw)
+	}
+	if strings.HasPrefix(parts[1], unixScheme) {
+		t := &Target{
+			Name: parts[0],
+			Host: parts[1],
+		}
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	host, rawPort, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	t := &Target{
+		Name: parts[0],
+		Host: host,
+		Port: uint16(port),
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseTargets parses a comma separated list of targets,
+// as stored in the `targets` identity header.
+func parseTargets(raw string) ([]Target, error) {
+	targets := []Target{}
+	if len(raw) == 0 {
+		return targets, nil
+	}
+	for _, x := range strings.Split(raw, ",") {
+		t, err := ParseTarget(x)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, *t)
+	}
+	return targets, validateTargets(targets)
+}
+
+func formatTargets(targets []Target) string {
+	r := []string{}
+	for _, t := range targets {
+		r = append(r, t.String())
+	}
+	return strings.Join(r, ",")
+}
+
+func validateTargets(targets []Target) error {
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate target %s", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return nil
+}
+
+func sameTargets(a []Target, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultTarget returns the target described by the Host / Port fields.
+func (fw *ForwardedHost) defaultTarget() Target {
+	return Target{Name: gatekeeper.DefaultTarget, Host: fw.Host, Port: fw.Port, Check: fw.Check}
+}
+
+// AllTargets returns the targets of the identity,
+// starting with the default one (Host / Port).
+func (fw *ForwardedHost) AllTargets() []Target {
+	return append([]Target{fw.defaultTarget()}, fw.Targets...)
+}
+
+func (fw *ForwardedHost) targetNames() []string {
+	r := []string{}
+	for _, t := range fw.Targets {
+		r = append(r, t.Name)
+	}
+	return r
+}
+
+func (fw *ForwardedHost) findTarget(name string) *Target {
+	for _, t := range fw.AllTargets() {
+		if t.Name == name {
+			return &t
+		}
+	}
+	return nil
+}
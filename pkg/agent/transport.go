@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"golang.org/x/net/websocket"
+)
+
+// Transports used to reach the gatekeeper
+const (
+	// TransportTCP connects to the gatekeeper SSH port (default)
+	TransportTCP = "tcp"
+	// TransportWebSocket tunnels SSH through a WebSocket on the gatekeeper
+	// HTTP(S) endpoint, for networks restricted to outbound HTTP(S).
+	TransportWebSocket = "websocket"
+)
+
+func (a *Agent) validateTransport() error {
+	switch a.Transport {
+	case "", TransportTCP, TransportWebSocket:
+		return nil
+	default:
+		return fmt.Errorf("invalid transport %s", a.Transport)
+	}
+}
+
+func (a *Agent) isWebSocket() bool {
+	return a.Transport == TransportWebSocket
+}
+
+// dialGatekeeper opens the stream on which the SSH connection to the
+// gatekeeper is established, according to the configured transport.
+// It returns the stream and the address used for host key verification.
+func (a *Agent) dialGatekeeper(host string, gk *gatekeeper.Meta) (net.Conn, string, error) {
+	if !a.isWebSocket() {
+		addr := net.JoinHostPort(host, strconv.Itoa(int(gk.SSHPort)))
+		conn, err := a.dial(addr)
+		return conn, addr, err
+	}
+
+	if gk.WSPort == 0 {
+		return nil, "", errors.New("gatekeeper does not accept the websocket transport")
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(gk.WSPort)))
+	scheme := "ws"
+	if gk.WSTLS {
+		scheme = "wss"
+	}
+	config, err := websocket.NewConfig(
+		fmt.Sprintf("%s://%s%s", scheme, addr, gatekeeper.WebSocketPath),
+		fmt.Sprintf("http://%s", host),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := a.dial(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	if gk.WSTLS {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, addr, nil
+}
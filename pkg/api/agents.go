@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ssh"
+)
+
+// AgentInfo describes an agent machine, owning one or several domains.
+// It is persisted in etcd at /agents/<id>.
+type AgentInfo struct {
+	ID string `json:"id" yaml:"id"`
+	// Agent public SSH key, in the authorized_keys format
+	PublicKey  string            `json:"public_key,omitempty" yaml:"public_key,omitempty"`
+	Hostname   string            `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Version    string            `json:"version,omitempty" yaml:"version,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Registered time.Time         `json:"registered" yaml:"registered"`
+	Updated    time.Time         `json:"updated" yaml:"updated"`
+	// Domains leased to the agent, resolved from /domains when listing
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+}
+
+// RegisterRequestBody is the optional JSON payload of a registration request,
+// describing the agent machine. Agents registering an additional domain send
+// their ID, for the domain to be owned by the same identity, and prove they
+// own its key by signing the payload (see SignRegisterRequest).
+type RegisterRequestBody struct {
+	AgentID  string            `json:"agent_id,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// Requested domain FQDN and request time (unix seconds),
+	// binding the signature of the payload to this registration.
+	Domain    string `json:"domain,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// RegisterSignatureHeader is the HTTP header holding the signature of the
+// registration or authentication payload by the agent key, base64 encoded
+// in the SSH wire format.
+const RegisterSignatureHeader = "X-Rssh-Signature"
+
+// RegisterSignatureMaxAge is the maximum clock difference
+// accepted between a signed request and the API.
+const RegisterSignatureMaxAge = 5 * time.Minute
+
+// SignRegisterRequest signs a serialized registration or authentication payload with the agent key.
+func SignRegisterRequest(signer ssh.Signer, payload []byte) (string, error) {
+	sig, err := signer.Sign(rand.Reader, payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+// VerifyRegisterRequest returns an error unless `signature` is a signature
+// of the registration payload by `publicKey`, in the authorized_keys format.
+func VerifyRegisterRequest(publicKey string, payload []byte, signature string) error {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(raw, sig); err != nil {
+		return err
+	}
+	return key.Verify(payload, sig)
+}
+
+func agentKey(id string) string {
+	return fmt.Sprintf("/agents/%s", id)
+}
+
+// GetAgent returns the agent persisted in etcd, without its domains.
+// Agents registered before the agent metadatas have an empty description.
+func GetAgent(etcd client.KeysAPI, id string) (*AgentInfo, error) {
+	resp, err := etcd.Get(context.Background(), agentKey(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	info := &AgentInfo{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), info); err != nil {
+		return nil, err
+	}
+	info.ID = id
+	return info, nil
+}
+
+// PersistAgent stores the agent description in etcd.
+func PersistAgent(etcd client.KeysAPI, info AgentInfo) error {
+	info.Domains = nil
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = etcd.Set(context.Background(), agentKey(info.ID), string(payload), nil)
+	return err
+}
+
+// ListAgents returns the agents (all of them if no id is given),
+// with the subdomains they own.
+func ListAgents(etcd client.KeysAPI, ids ...string) ([]AgentInfo, error) {
+	if len(ids) == 0 {
+		agents, err := listChildren(etcd, "/agents")
+		if err != nil {
+			return nil, err
+		}
+		for id := range agents {
+			ids = append(ids, id)
+		}
+	}
+	domains, err := listDomains(etcd)
+	if err != nil {
+		return nil, err
+	}
+	owned := map[string][]string{}
+	for domain, raw := range domains {
+		creds := AgentCredentials{}
+		if err := json.Unmarshal([]byte(raw), &creds); err != nil {
+			continue
+		}
+		owned[creds.ID.String()] = append(owned[creds.ID.String()], domain)
+	}
+
+	res := []AgentInfo{}
+	for _, id := range ids {
+		info, err := GetAgent(etcd, id)
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %s", id, err.Error())
+		}
+		info.Domains = owned[id]
+		sort.Strings(info.Domains)
+		res = append(res, *info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
@@ -13,13 +13,18 @@ import (
 	"go.etcd.io/etcd/client"
 )
 
+const readTimeout = 5 * time.Second
+
 // Meta represents metadatas about the running api.
 // It will be persisted to etcd in order to configure
 // the gatekeepers.
 type Meta struct {
+	// Default root domain
 	BindDomain string `json:"domain"`
 	BindAddr   string `json:"addr"`
 	BindPort   uint16 `json:"port"`
+	// All the root domains served, the default one first
+	Domains []string `json:"domains,omitempty"`
 }
 
 // Dispatcher is the API entry point, it will compose the middlewares
@@ -27,25 +32,41 @@ type Meta struct {
 type Dispatcher struct {
 	Meta Meta
 
-	etcdEndpoints []string
-	etcd          *client.KeysAPI
+	etcdConfig utils.EtcdConfig
+	etcd       *client.KeysAPI
+	srv        *fasthttp.Server
+	// Root domains served, with their registration policy
+	roots []RootDomain
+	// Index of the metadatas announced in etcd
+	announced uint64
 }
 
-// NewDispatcher is a simple wrapper to construct a Dispatcher structure
+// NewDispatcher is a simple wrapper to construct a Dispatcher structure.
+// The API serves the default root `domain`, and the additional `roots`.
 func NewDispatcher(
 	bindAddr string,
 	bindPort uint16,
 	domain string,
-	etcdEndpoints []string,
+	roots []RootDomain,
+	etcdConfig utils.EtcdConfig,
 ) (*Dispatcher, error) {
+	rootDomains, err := NewRootDomains(domain, roots)
+	if err != nil {
+		return nil, err
+	}
+	domains := []string{}
+	for _, root := range rootDomains {
+		domains = append(domains, root.Domain)
+	}
 	return &Dispatcher{
-		Meta{
-			domain,
-			bindAddr,
-			bindPort,
+		Meta: Meta{
+			BindDomain: domain,
+			BindAddr:   bindAddr,
+			BindPort:   bindPort,
+			Domains:    domains,
 		},
-		etcdEndpoints,
-		nil,
+		etcdConfig: etcdConfig,
+		roots:      rootDomains,
 	}, nil
 }
 
@@ -57,43 +78,16 @@ func (api *Dispatcher) announce() error {
 	}
 
 	log.Debug().Msg("Starting to announce API to etcd")
-	_, err = (*api.etcd).Set(context.Background(), "/meta/api", string(m), nil)
+	resp, err := (*api.etcd).Set(context.Background(), "/meta/api", string(m), nil)
 	if err != nil {
 		return err
 	}
+	api.announced = resp.Node.ModifiedIndex
 
 	log.Info().Msg("API registered in etcd.")
 	return nil
 }
 
-// HealthHandler will respond to GET /health request in order for
-// clients / agents / orchestrators to know if this service can
-// handle traffic.
-// TODO: check for ETCD connectivity
-func (api *Dispatcher) HealthHandler(ctx *fasthttp.RequestCtx) {
-	payload, err := json.Marshal(struct {
-		Ok   bool   `json:"ok"`
-		Time string `json:"time"`
-	}{
-		true,
-		time.Now().String(),
-	})
-	if err != nil {
-		ctx.SetStatusCode(500)
-		log.Warn().
-			Str("error", err.Error()).
-			Msg("Failed to serialize healthcheck infos.")
-	} else {
-		ctx.SetStatusCode(200)
-		_, err = ctx.Write(payload)
-		if err != nil {
-			log.Warn().
-				Str("error", err.Error()).
-				Msg("Failed to respond to healthcheck.")
-		}
-	}
-}
-
 // Run is the entry point of the dispatcher.
 // it does the following:
 // - Connect to etcd
@@ -105,7 +99,7 @@ func (api *Dispatcher) Run() error {
 	if err := utils.WithFixedIntervalRetry(
 		func() error {
 			var err error
-			k, err = utils.GetEtcdKey(api.etcdEndpoints)
+			k, err = utils.GetEtcdKey(api.etcdConfig)
 			return err
 		},
 		5,
@@ -119,21 +113,36 @@ func (api *Dispatcher) Run() error {
 	if err != nil {
 		return err
 	}
+	if err := migrateLegacyDomains(*k, api.Meta.BindDomain); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Failed to migrate the domains under the default root domain.")
+	}
 	router := fasthttprouter.New()
 
 	router.GET("/health", api.HealthHandler)
+	router.GET("/health/live", api.HealthHandler)
+	router.GET("/health/ready", api.ReadyHandler)
+	router.GET("/meta/gatekeeper", api.GatekeeperHandler)
+	router.GET("/domains", api.DomainsHandler)
 	router.POST("/auth/:domain", api.AuthHandler)
 	router.POST("/register/:domain", MValidateDomain(api.RegisterHandler))
 
 	log.Info().
 		Str("domain", api.Meta.BindDomain).
+		Strs("domains", api.Meta.Domains).
 		Str("BindAddr", api.Meta.BindAddr).
 		Uint16("BindPort", api.Meta.BindPort).
 		Msg("Starting HTTP API.")
 
-	if err := fasthttp.ListenAndServe(
+	api.srv = &fasthttp.Server{
+		Handler: router.Handler,
+		// Also closes the idle keep-alive connections,
+		// which would otherwise delay the shutdown.
+		ReadTimeout: readTimeout,
+	}
+	if err := api.srv.ListenAndServe(
 		fmt.Sprintf("%s:%d", api.Meta.BindAddr, api.Meta.BindPort),
-		router.Handler,
 	); err != nil {
 		log.Error().
 			Str("error", err.Error()).
@@ -142,3 +151,37 @@ func (api *Dispatcher) Run() error {
 	}
 	return nil
 }
+
+// Shutdown stops accepting requests, waits for the pending ones to
+// complete until the context is done, and withdraws the API metadatas
+// from etcd unless they have been overwritten by another instance.
+func (api *Dispatcher) Shutdown(ctx context.Context) error {
+	log.Info().Msg("Draining HTTP API.")
+	var err error
+	if api.srv != nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- api.srv.Shutdown()
+		}()
+		select {
+		case err = <-done:
+			log.Info().Msg("All requests finished.")
+		case <-ctx.Done():
+			log.Warn().Msg("Drain deadline reached, closing the remaining connections.")
+		}
+	}
+	if api.announced != 0 {
+		if _, derr := (*api.etcd).Delete(
+			context.Background(),
+			"/meta/api",
+			&client.DeleteOptions{PrevIndex: api.announced},
+		); derr != nil {
+			log.Warn().
+				Str("error", derr.Error()).
+				Msg("API metadatas not withdrawn.")
+		} else {
+			log.Info().Msg("API unregistered from etcd.")
+		}
+	}
+	return err
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/Xide/rssh/pkg/gatekeeper"
 )
@@ -16,12 +20,45 @@ type AuthRequest struct {
 	Domain string
 	// UUID returned by the register API call
 	AgentID string
+	// Authorized keys allowed to connect to the domain
+	AllowedKeys []string
+	// Named targets exposed in addition to the default one
+	Targets []string
+}
+
+// MaxTargets is the maximum number of named targets for a single domain.
+const MaxTargets = 16
+
+// AuthRequestBody is the JSON payload of an authentication request, describing
+// the policy and targets the agent wants for its slots. It is signed by the key
+// of the identity owning the domain (see SignRegisterRequest).
+type AuthRequestBody struct {
+	AllowedKeys []string `json:"allowed_keys"`
+	Targets     []string `json:"targets"`
+	// Requested domain FQDN and request time (unix seconds),
+	// binding the signature of the payload to this authentication.
+	Domain    string `json:"domain,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
 }
 
 // GkConnectInfos describe the content of the authentication response
 type GkConnectInfos struct {
 	GkMeta gatekeeper.Meta `json:"gk"`
-	Port   uint16          `json:"port"`
+	// Slot allocated for the default target
+	Port uint16 `json:"port"`
+	// Slots allocated for every target, by name
+	Targets map[string]uint16 `json:"targets"`
+	// Current slots of the domain, only returned to the dry runs
+	Slots []SlotState `json:"slots"`
+}
+
+// SlotState describes a slot of the domain on the gatekeeper.
+type SlotState struct {
+	Target      string `json:"target"`
+	Port        uint16 `json:"port"`
+	Established bool   `json:"established"`
+	// Last health reported by the agent for the target, nil if unknown
+	Healthy *bool `json:"healthy,omitempty"`
 }
 
 // AuthResponse describe the contents of the HTTP response
@@ -35,6 +72,30 @@ func (r *AuthRequest) Validate() error {
 	if len(r.AgentID) == 0 {
 		return errors.New("Empty agent id")
 	}
+	for _, k := range r.AllowedKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			return errors.New("Invalid allowed key")
+		}
+	}
+	return ValidateTargets(r.Targets)
+}
+
+// ValidateTargets returns an error if the requested target names
+// are invalid, duplicated or too numerous.
+func ValidateTargets(targets []string) error {
+	if len(targets) > MaxTargets {
+		return fmt.Errorf("Too many targets (max %d)", MaxTargets)
+	}
+	seen := map[string]bool{gatekeeper.DefaultTarget: true}
+	for _, t := range targets {
+		if err := ValidateTargetName(t); err != nil {
+			return err
+		}
+		if seen[t] {
+			return fmt.Errorf("Duplicate target %s", t)
+		}
+		seen[t] = true
+	}
 	return nil
 }
 
@@ -48,8 +109,10 @@ func (api *Dispatcher) authHandlerWrapped(ctx *fasthttp.RequestCtx) {
 	log.Debug().Str("domain", domain).Msg("Received new auth request.")
 
 	req := AuthRequest{
-		AgentID: string(token),
-		Domain:  domain,
+		AgentID:     string(token),
+		Domain:      domain,
+		AllowedKeys: getAllowedKeys(ctx),
+		Targets:     getTargets(ctx),
 	}
 	if err := req.Validate(); err != nil {
 		log.Debug().Str("error", err.Error()).Msg("Failed to validate auth request.")
@@ -59,15 +122,22 @@ func (api *Dispatcher) authHandlerWrapped(ctx *fasthttp.RequestCtx) {
 
 	// Get Gatekeeper port
 	gMeta := ctx.UserValue("gatekeeper").(*gatekeeper.Meta)
-	// Create an available slot for the agent to connect to.
-	// TODO: better method than random
 	resp := AuthResponse{
 		Infos: &GkConnectInfos{
-			Port:   ctx.UserValue("slot").(uint16),
-			GkMeta: *gMeta,
+			Port:    ctx.UserValue("slot").(uint16),
+			Targets: ctx.UserValue("slots").(map[string]uint16),
+			GkMeta:  *gMeta,
 		},
 		Err: nil,
 	}
+	if ctx.QueryArgs().Has("dry_run") {
+		slots, err := api.domainSlots(getRoot(ctx), domain)
+		if err != nil {
+			failRequest(ctx, "Backend consensus error", 500)
+			return
+		}
+		resp.Infos.Slots = slots
+	}
 
 	respond(ctx, resp)
 	log.Info().
@@ -80,16 +150,51 @@ func (api *Dispatcher) authHandlerWrapped(ctx *fasthttp.RequestCtx) {
 // It uses several middlewares to validate requests, and pass the valid
 // requests down to Dispatcher.registerHandlerWrapper
 func (api *Dispatcher) AuthHandler(ctx *fasthttp.RequestCtx) {
-	MValidateDomain(
-		MValidateAuthenticationRequest(
-			MWithGatekeeperMeta(
-				MWithNewSlotFS(
-					api.authHandlerWrapped,
+	MWithRootDomain(
+		MValidateDomain(
+			MValidateAuthenticationRequest(
+				MWithGatekeeperMeta(
+					MWithNewSlotFS(
+						api.authHandlerWrapped,
+						*api.etcd,
+					),
 					*api.etcd,
 				),
 				*api.etcd,
 			),
-			*api.etcd,
 		),
+		api,
 	)(ctx)
 }
+
+// domainSlots returns the state of the slots of the domain, ordered by target.
+func (api *Dispatcher) domainSlots(root *RootDomain, domain string) ([]SlotState, error) {
+	raw, err := listChildren(*api.etcd, "/gatekeeper/slotfs")
+	if err != nil {
+		return nil, err
+	}
+	res := []SlotState{}
+	for _, value := range raw {
+		slot := gatekeeper.AgentSlot{}
+		if err := json.Unmarshal([]byte(value), &slot); err != nil {
+			log.Warn().Str("error", err.Error()).Msg("Unable to deserialize slot from etcd.")
+			continue
+		}
+		if slot.Domain != domain || !strings.EqualFold(api.slotRoot(&slot), root.Domain) {
+			continue
+		}
+		res = append(res, SlotState{
+			Target:      slot.TargetName(),
+			Port:        slot.Port,
+			Established: slot.Established,
+			Healthy:     slot.Healthy,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Target != res[j].Target {
+			return res[i].Target < res[j].Target
+		}
+		return res[i].Port < res[j].Port
+	})
+	return res, nil
+}
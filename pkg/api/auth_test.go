@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.etcd.io/etcd/client"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func TestDomainSlots(t *testing.T) {
+	healthy := false
+	slots := []gatekeeper.AgentSlot{
+		{Port: 2000, Domain: "db", Root: "example.com", Established: true},
+		{Port: 2001, Domain: "db", Root: "example.com", Target: "pg", Healthy: &healthy, Established: true},
+		{Port: 2002, Domain: "db", Root: "example.com"},
+		{Port: 2003, Domain: "web", Root: "example.com", Established: true},
+		{Port: 2004, Domain: "db", Root: "other.example", Established: true},
+		// Allocated before the multiple root domains
+		{Port: 2005, Domain: "db", Established: true},
+	}
+	etcd := etcdtest.New()
+	for _, slot := range slots {
+		value, _ := json.Marshal(slot)
+		if _, err := etcd.Set(context.Background(), fmt.Sprintf("/gatekeeper/slotfs/%d", slot.Port), string(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := client.KeysAPI(etcd)
+	api := &Dispatcher{Meta: Meta{BindDomain: "example.com"}, etcd: &keys}
+
+	tests := []struct {
+		root   string
+		domain string
+		want   string
+	}{
+		{"example.com", "db", "[{default 2000 true <nil>} {default 2002 false <nil>} {default 2005 true <nil>} {pg 2001 true false}]"},
+		{"other.example", "db", "[{default 2004 true <nil>}]"},
+		{"example.com", "cache", "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"."+tt.root, func(t *testing.T) {
+			got, err := api.domainSlots(&RootDomain{Domain: tt.root}, tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc := "["
+			for i, slot := range got {
+				if i > 0 {
+					desc += " "
+				}
+				health := "<nil>"
+				if slot.Healthy != nil {
+					health = fmt.Sprint(*slot.Healthy)
+				}
+				desc += fmt.Sprintf("{%s %d %v %s}", slot.Target, slot.Port, slot.Established, health)
+			}
+			desc += "]"
+			if desc != tt.want {
+				t.Errorf("domainSlots() = %s, want %s", desc, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+)
+
+// TargetState describe whether a target of a domain is reachable
+type TargetState struct {
+	Name   string `json:"name" yaml:"name"`
+	Online bool   `json:"online" yaml:"online"`
+}
+
+// DomainInfo describe a domain visible to the caller
+type DomainInfo struct {
+	// complete FQDN of the domain
+	Domain  string        `json:"domain" yaml:"domain"`
+	Online  bool          `json:"online" yaml:"online"`
+	Targets []TargetState `json:"targets" yaml:"targets"`
+}
+
+// DomainsResponse describe the contents of the HTTP response
+type DomainsResponse struct {
+	Domains []DomainInfo `json:"domains"`
+	Err     *Error       `json:"error"`
+}
+
+// listChildren returns the values of the etcd directory by key basename.
+// A missing directory is empty.
+func listChildren(etcd client.KeysAPI, dir string) (map[string]string, error) {
+	res := map[string]string{}
+	resp, err := etcd.Get(context.Background(), dir, nil)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		sl := strings.Split(node.Key, "/")
+		res[sl[len(sl)-1]] = node.Value
+	}
+	return res, nil
+}
+
+// domainsHandlerWrapped is called at the sink of the middleware chain.
+func (api *Dispatcher) domainsHandlerWrapped(ctx *fasthttp.RequestCtx) {
+	token := getToken(ctx)
+	root := getRoot(ctx)
+	domains, err := listChildren(*api.etcd, domainsKey(root.Domain))
+	if err != nil {
+		failRequest(ctx, "Backend consensus error", 500)
+		return
+	}
+	slots, err := listChildren(*api.etcd, "/gatekeeper/slotfs")
+	if err != nil {
+		failRequest(ctx, "Backend consensus error", 500)
+		return
+	}
+
+	// Established targets, by subdomain
+	targets := map[string][]TargetState{}
+	for _, raw := range slots {
+		slot := gatekeeper.AgentSlot{}
+		if err := json.Unmarshal([]byte(raw), &slot); err != nil {
+			log.Warn().Str("error", err.Error()).Msg("Unable to deserialize slot from etcd.")
+			continue
+		}
+		if !slot.Established || !strings.EqualFold(api.slotRoot(&slot), root.Domain) {
+			continue
+		}
+		targets[slot.Domain] = append(targets[slot.Domain], TargetState{
+			Name:   slot.TargetName(),
+			Online: slot.IsHealthy(),
+		})
+	}
+
+	resp := DomainsResponse{Domains: []DomainInfo{}}
+	for domain := range domains {
+		if !token.Allows(domain) {
+			continue
+		}
+		info := DomainInfo{
+			Domain:  root.FQDN(domain),
+			Targets: targets[domain],
+		}
+		if info.Targets == nil {
+			info.Targets = []TargetState{}
+		}
+		sort.Slice(info.Targets, func(i, j int) bool { return info.Targets[i].Name < info.Targets[j].Name })
+		for _, t := range info.Targets {
+			info.Online = info.Online || (t.Name == gatekeeper.DefaultTarget && t.Online)
+		}
+		resp.Domains = append(resp.Domains, info)
+	}
+	sort.Slice(resp.Domains, func(i, j int) bool { return resp.Domains[i].Domain < resp.Domains[j].Domain })
+
+	respond(ctx, resp)
+	log.Debug().
+		Str("user", token.User).
+		Int("count", len(resp.Domains)).
+		Msg("Listed domains.")
+}
+
+// slotRoot returns the root domain of the slot, the slots allocated
+// before the multiple root domains belonging to the default one.
+func (api *Dispatcher) slotRoot(slot *gatekeeper.AgentSlot) string {
+	if len(slot.Root) == 0 {
+		return api.Meta.BindDomain
+	}
+	return slot.Root
+}
+
+// DomainsHandler is the entrypoint for an HTTP GET request in the API.
+// It lists the domains of the requested root domain visible with the
+// API token of the request, along with the state of their targets.
+func (api *Dispatcher) DomainsHandler(ctx *fasthttp.RequestCtx) {
+	MWithRootDomain(
+		MValidateAPIToken(
+			api.domainsHandlerWrapped,
+			*api.etcd,
+		),
+		api,
+	)(ctx)
+}
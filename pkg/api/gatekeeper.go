@@ -0,0 +1,30 @@
+package api
+
+import (
+	"github.com/valyala/fasthttp"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+)
+
+// GatekeeperResponse describe the contents of the HTTP response
+type GatekeeperResponse struct {
+	Infos *gatekeeper.Meta `json:"gatekeeper"`
+	Err   *Error           `json:"error"`
+}
+
+// gatekeeperHandlerWrapped is called at the sink of the middleware chain.
+func (api *Dispatcher) gatekeeperHandlerWrapped(ctx *fasthttp.RequestCtx) {
+	respond(ctx, GatekeeperResponse{
+		Infos: ctx.UserValue("gatekeeper").(*gatekeeper.Meta),
+	})
+}
+
+// GatekeeperHandler is the entrypoint for an HTTP GET request in the API.
+// It exposes the gatekeeper address and host key to the clients,
+// so that they can connect without hard-coding them.
+func (api *Dispatcher) GatekeeperHandler(ctx *fasthttp.RequestCtx) {
+	MWithGatekeeperMeta(
+		api.gatekeeperHandlerWrapped,
+		*api.etcd,
+	)(ctx)
+}
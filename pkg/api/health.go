@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+// Maximum time spent by a readiness check
+const healthTimeout = 2 * time.Second
+
+// writeHealth responds with the status, 503 if it is not healthy.
+func writeHealth(ctx *fasthttp.RequestCtx, status utils.HealthStatus) {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		ctx.SetStatusCode(500)
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Failed to serialize healthcheck infos.")
+		return
+	}
+	ctx.SetContentType("application/json")
+	if status.Ok {
+		ctx.SetStatusCode(200)
+	} else {
+		ctx.SetStatusCode(503)
+	}
+	if _, err = ctx.Write(payload); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Failed to respond to healthcheck.")
+	}
+}
+
+// checkGatekeeper verifies that a gatekeeper announced itself,
+// and that it has free slots for new agents.
+func (api *Dispatcher) checkGatekeeper() []utils.HealthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	resp, err := (*api.etcd).Get(ctx, "/meta/gatekeeper", nil)
+	if err != nil {
+		return []utils.HealthCheck{{Name: "gatekeeper", Detail: err.Error()}}
+	}
+	gk := &gatekeeper.Meta{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), gk); err != nil {
+		return []utils.HealthCheck{{Name: "gatekeeper", Detail: err.Error()}}
+	}
+	checks := []utils.HealthCheck{{
+		Name:   "gatekeeper",
+		Ok:     true,
+		Detail: fmt.Sprintf("%s:%d", gk.SSHAddr, gk.SSHPort),
+	}}
+
+	slots, err := listChildren(*api.etcd, "/gatekeeper/slotfs")
+	if err != nil {
+		return append(checks, utils.HealthCheck{Name: "slots", Detail: err.Error()})
+	}
+	capacity := int(gk.HighPort) - int(gk.LowPort) + 1
+	return append(checks, utils.HealthCheck{
+		Name:   "slots",
+		Ok:     len(slots) < capacity,
+		Detail: fmt.Sprintf("%d/%d used", len(slots), capacity),
+	})
+}
+
+// HealthHandler will respond to GET /health and /health/live requests,
+// for orchestrators to know if this service is running.
+func (api *Dispatcher) HealthHandler(ctx *fasthttp.RequestCtx) {
+	writeHealth(ctx, utils.NewHealthStatus())
+}
+
+// ReadyHandler will respond to GET /health/ready requests,
+// for clients / agents / orchestrators to know if this service can
+// handle traffic: the etcd cluster has a quorum, a gatekeeper
+// is available and it can allocate slots for new agents.
+func (api *Dispatcher) ReadyHandler(ctx *fasthttp.RequestCtx) {
+	checks := []utils.HealthCheck{utils.CheckEtcdQuorum(*api.etcd, "/meta/api", healthTimeout)}
+	if checks[0].Ok {
+		checks = append(checks, api.checkGatekeeper()...)
+	}
+	writeHealth(ctx, utils.NewHealthStatus(checks...))
+}
@@ -1,12 +1,10 @@
 package api
 
 import (
-	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"errors"
-	"fmt"
 
 	"encoding/base64"
 	"encoding/json"
@@ -14,7 +12,6 @@ import (
 
 	"github.com/rs/zerolog/log"
 	uuid "github.com/satori/go.uuid"
-	"go.etcd.io/etcd/client"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -151,20 +148,3 @@ func GenerateAgentCredentials() (*AgentCredentials, error) {
 		Msg("Generated account credentials.")
 	return credentials, nil
 }
-
-// PersistAgentCredentials stores the agent identity in etcd.
-func PersistAgentCredentials(etcd client.KeysAPI, creds AgentCredentials) error {
-	log.Debug().
-		Str("agent", creds.ID.String())
-	_, err := etcd.Set(
-		context.Background(),
-		fmt.Sprintf("/agents/%s", creds.ID.String()),
-		"{}",
-		nil,
-	)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Could not persist agent in etcd.")
-		return err
-	}
-	return nil
-}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 
@@ -29,7 +30,11 @@ func MValidateDomain(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 // It will fail if:
 //	- The agent identity is invalid
 //	- The domain is invalid
+//	- The request body is invalid
 //	- The agent is not registered for this domain
+//	- The request body is not signed by the key of the identity owning the domain
+// The allowed keys and targets sent by the agent are injected in the context
+// under `allowed_keys` and `targets`.
 func MValidateAuthenticationRequest(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		id, err := getIdentity(ctx)
@@ -37,10 +42,21 @@ func MValidateAuthenticationRequest(h fasthttp.RequestHandler, etcd client.KeysA
 			failRequest(ctx, "Empty identity", 400)
 			return
 		}
+		body, err := parseAuthRequestBody(ctx)
+		if err != nil {
+			failRequest(ctx, "Invalid request body", 400)
+			return
+		}
+		if err := ValidateTargets(body.Targets); err != nil {
+			failRequest(ctx, err.Error(), 400)
+			return
+		}
+		ctx.SetUserValue("allowed_keys", body.AllowedKeys)
+		ctx.SetUserValue("targets", body.Targets)
 		domain, _ := getDomain(ctx)
-		resp, err := etcd.Get(context.Background(), fmt.Sprintf("/domains/%s", domain), nil)
+		resp, err := etcd.Get(context.Background(), domainKey(getRoot(ctx).Domain, domain), nil)
 		if err != nil {
-			if err.(client.Error).Code == client.ErrorCodeKeyNotFound {
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
 				failRequest(ctx, "Agent is not registered for this domain.", 403)
 			} else {
 				failRequest(ctx, "Backend consensus error.", 500)
@@ -54,19 +70,26 @@ func MValidateAuthenticationRequest(h fasthttp.RequestHandler, etcd client.KeysA
 					Msg("Could not unmarshal credentials from etcd.")
 				failRequest(ctx, "Inconsistent state for domain", 500)
 			} else {
-				if persistedCreds.ID.String() == id {
-					log.Debug().
-						Str("domain", domain).
-						Str("agentID", id).
-						Msg("Authentication request validated")
-					h(ctx)
-				} else {
+				if persistedCreds.ID.String() != id {
 					log.Debug().
 						Str("expected", persistedCreds.ID.String()).
 						Str("received", id).
 						Str("domain", domain).
 						Msg("Invalid agent ID.")
 					failRequest(ctx, "Invalid agent ID for this domain.", 403)
+				} else if err := verifyAgentSignature(ctx, string(persistedCreds.Identity), body.Domain, body.Timestamp); err != nil {
+					log.Warn().
+						Str("error", err.Error()).
+						Str("agent", id).
+						Str("domain", domain).
+						Msg("Rejected agent authentication.")
+					failRequest(ctx, "Invalid agent signature.", 403)
+				} else {
+					log.Debug().
+						Str("domain", domain).
+						Str("agentID", id).
+						Msg("Authentication request validated")
+					h(ctx)
 				}
 			}
 
@@ -80,7 +103,7 @@ func MWithGatekeeperMeta(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthtt
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		resp, err := etcd.Get(context.Background(), "/meta/gatekeeper", nil)
 		if err != nil {
-			if err.(client.Error).Code == client.ErrorCodeKeyNotFound {
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
 				failRequest(ctx, "Gatekeeper is not available", 500)
 			} else {
 				failRequest(ctx, "Backend consensus error", 500)
@@ -100,86 +123,192 @@ func MWithGatekeeperMeta(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthtt
 	})
 }
 
-// MWithNewSlotFS allocate a slot in an available executor
+// MWithNewSlotFS allocate a slot in an available executor for the default target
+// and each of the requested targets. The default target slot is injected in the context
+// under `slot`, and all the slots by target name under `slots`. The slots are
+// deleted if the allocation or the rest of the request fails.
+// Requests with the `dry_run` query argument only validate the authentication,
+// no slot is allocated (the current slots of the domain are returned instead).
 func MWithNewSlotFS(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		if ctx.QueryArgs().Has("dry_run") {
+			ctx.SetUserValue("slot", uint16(0))
+			ctx.SetUserValue("slots", map[string]uint16{})
+			h(ctx)
+			return
+		}
 		log.Debug().Msg("Creating new gatekeeper slot.")
 		resp, err := etcd.Get(context.Background(), "/gatekeeper/slotfs", nil)
-		if err != nil && err.(client.Error).Code != client.ErrorCodeKeyNotFound {
-			failRequest(ctx, "Backend consensus error", 500)
+		if err != nil {
+			if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+				failRequest(ctx, "Backend consensus error", 500)
+				return
+			}
+		}
+		gkMeta := ctx.UserValue("gatekeeper").(*gatekeeper.Meta)
+		used := map[uint16]bool{}
+		if resp == nil || resp.Node == nil {
+			log.Debug().Msg("Gatekeeper is empty")
 		} else {
-			gkMeta := ctx.UserValue("gatekeeper").(*gatekeeper.Meta)
-			if resp == nil || resp.Node == nil {
-				log.Debug().Msg("Gatekeeper is empty")
-				// Pick one slot at random
-				ctx.SetUserValue("slot", gkMeta.LowPort)
-			} else {
-				last := gkMeta.LowPort - 1
-				for _, e := range resp.Node.Nodes {
-					if e.Dir {
-						// Skipping the root directory /gatekeeper/slotfs/
-						continue
-					}
-					sl := strings.Split(e.Key, "/")
-					usedPort, err := strconv.ParseUint(sl[len(sl)-1], 10, 16)
-					if err != nil {
-						log.Error().Str("error", err.Error()).Msg("Failed to parse slotFS entry")
-						return
-					}
-					if uint16(usedPort) != last+1 {
-						log.Debug().
-							Uint("port", uint(last+1)).
-							Msg("Reusing liberated port.")
-						break
-					}
-					last++
+			for _, e := range resp.Node.Nodes {
+				if e.Dir {
+					// Skipping the root directory /gatekeeper/slotfs/
+					continue
 				}
-				if last >= gkMeta.HighPort {
-					log.Warn().
-						Msg("All gatekeeper slots already in use.")
-					failRequest(ctx, "All gatekeeper slots already in use.", 503)
+				sl := strings.Split(e.Key, "/")
+				usedPort, err := strconv.ParseUint(sl[len(sl)-1], 10, 16)
+				if err != nil {
+					log.Error().Str("error", err.Error()).Msg("Failed to parse slotFS entry")
+					failRequest(ctx, "Inconsistent gatekeeper state", 500)
 					return
 				}
-				ctx.SetUserValue("slot", last+1)
+				used[uint16(usedPort)] = true
 			}
+		}
 
-			domain, _ := getDomain(ctx)
-			identity, _ := getIdentity(ctx)
+		names := append([]string{gatekeeper.DefaultTarget}, getTargets(ctx)...)
+		slots := map[string]uint16{}
+		// uint32 to avoid overflowing when the range ends at 65535
+		next := uint32(gkMeta.LowPort)
+		for _, name := range names {
+			for next <= uint32(gkMeta.HighPort) && used[uint16(next)] {
+				next++
+			}
+			if next > uint32(gkMeta.HighPort) {
+				log.Warn().
+					Msg("All gatekeeper slots already in use.")
+				failRequest(ctx, "All gatekeeper slots already in use.", 503)
+				return
+			}
+			slots[name] = uint16(next)
+			next++
+		}
+
+		domain, _ := getDomain(ctx)
+		identity, _ := getIdentity(ctx)
+		// Etcd index of the slots created by this request
+		created := map[uint16]uint64{}
+		for _, name := range names {
 			payload, err := json.Marshal(gatekeeper.AgentSlot{
-				Port:        ctx.UserValue("slot").(uint16),
+				Port:        slots[name],
 				Domain:      domain,
+				Root:        getRoot(ctx).Domain,
 				AgentID:     identity,
+				AllowedKeys: getAllowedKeys(ctx),
+				Target:      name,
 				Established: false,
 			})
+			if err != nil {
+				releaseSlots(etcd, created)
+				failRequest(ctx, "Failed to serialize slot", 500)
+				return
+			}
 
-			if _, err = etcd.Set(
+			slotResp, err := etcd.Set(
 				context.Background(),
-				fmt.Sprintf("/gatekeeper/slotfs/%d", ctx.UserValue("slot")),
+				fmt.Sprintf("/gatekeeper/slotfs/%d", slots[name]),
 				string(payload),
-				nil,
-			); err != nil {
+				&client.SetOptions{PrevExist: client.PrevNoExist},
+			)
+			if err != nil {
+				releaseSlots(etcd, created)
 				failRequest(ctx, "Backend consensus error", 500)
-			} else {
-				domain, _ := getDomain(ctx)
-				log.Info().
-					Uint("port", uint(ctx.UserValue("slot").(uint16))).
-					Str("domain", domain).
-					Msg("Allocated reverse SSH port.")
-				h(ctx)
+				return
 			}
+			created[slots[name]] = slotResp.Node.ModifiedIndex
+			log.Info().
+				Uint("port", uint(slots[name])).
+				Str("domain", domain).
+				Str("target", name).
+				Msg("Allocated reverse SSH port.")
+		}
+		ctx.SetUserValue("slot", slots[gatekeeper.DefaultTarget])
+		ctx.SetUserValue("slots", slots)
+		h(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			releaseSlots(etcd, created)
 		}
 	})
 }
 
+// releaseSlots deletes the slots allocated for a failed request,
+// unless they were modified since their creation.
+func releaseSlots(etcd client.KeysAPI, created map[uint16]uint64) {
+	for port, index := range created {
+		if _, err := etcd.Delete(
+			context.Background(),
+			fmt.Sprintf("/gatekeeper/slotfs/%d", port),
+			&client.DeleteOptions{PrevIndex: index},
+		); err != nil {
+			log.Warn().
+				Uint("port", uint(port)).
+				Str("error", err.Error()).
+				Msg("Failed to release reverse SSH port.")
+			continue
+		}
+		log.Info().
+			Uint("port", uint(port)).
+			Msg("Released reverse SSH port.")
+	}
+}
+
+// overlappingDomain returns the registered subdomain of the root whose targets
+// would share names with the subdomain: its parent (pg.db and db:pg are both
+// requested as pg.db.<root>) or one of its direct subdomains, if any.
+// Only the domains leased before the etcd index `before` are considered,
+// unless it is 0.
+func overlappingDomain(etcd client.KeysAPI, root string, domain string, before uint64) (string, error) {
+	resp, err := etcd.Get(context.Background(), domainsKey(root), nil)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	domain = strings.ToLower(domain)
+	for _, node := range resp.Node.Nodes {
+		if node.Dir || (before != 0 && node.CreatedIndex >= before) {
+			continue
+		}
+		registered := path.Base(node.Key)
+		parent, child := domain, strings.ToLower(registered)
+		if len(child) < len(parent) {
+			parent, child = child, parent
+		}
+		if label := strings.TrimSuffix(child, "."+parent); label != child && !strings.Contains(label, ".") {
+			return registered, nil
+		}
+	}
+	return "", nil
+}
+
 // MValidateDomainIsAvailable will check for the presence of the domain in etcd. It will only
-// pass requests to the subsequent handler if the domain isn't already reserved. Otherwise,
-// it can yield 403 code for an already registered domain or 500 in case of an etcd failure.
+// pass requests to the subsequent handler if the domain isn't already reserved, nor overlapping
+// with the targets of another domain (see overlappingDomain). Otherwise, it can yield 403 code
+// for an already registered domain or 500 in case of an etcd failure.
 func MValidateDomainIsAvailable(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		domain, _ := getDomain(ctx)
-		_, err := etcd.Get(context.Background(), "/domains/"+domain, nil)
+		_, err := etcd.Get(context.Background(), domainKey(getRoot(ctx).Domain, domain), nil)
 		if err != nil {
-			if err.(client.Error).Code == client.ErrorCodeKeyNotFound {
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+				overlap, err := overlappingDomain(etcd, getRoot(ctx).Domain, domain, 0)
+				if err != nil {
+					log.Error().
+						Str("domain", domain).
+						Str("error", err.Error()).
+						Msg("Unexpected etcd error")
+					failRequest(ctx, "Backend consensus error.", 500)
+					return
+				}
+				if len(overlap) != 0 {
+					log.Debug().
+						Str("domain", domain).
+						Str("registered", overlap).
+						Msg("Register for a domain overlapping with the targets of another one.")
+					failRequest(ctx, fmt.Sprintf("domain overlaps with the targets of %s.", overlap), 403)
+					return
+				}
 				log.Debug().Str("domain", domain).Msg("Domain is free.")
 				h(ctx)
 			} else {
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func newTestRequest(domain string, root *RootDomain) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/?identity=agent")
+	ctx.SetUserValue("domain", domain)
+	ctx.SetUserValue("root", root)
+	return ctx
+}
+
+func slotPorts(t *testing.T, etcd client.KeysAPI) []string {
+	resp, err := etcd.Get(context.Background(), "/gatekeeper/slotfs", nil)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	ports := []string{}
+	for _, node := range resp.Node.Nodes {
+		ports = append(ports, strings.TrimPrefix(node.Key, "/gatekeeper/slotfs/"))
+	}
+	return ports
+}
+
+func TestMWithNewSlotFS(t *testing.T) {
+	tests := []struct {
+		name     string
+		dryRun   bool
+		targets  []string
+		used     []string
+		failAt   string
+		status   int
+		handler  int
+		wantLeft []string
+	}{
+		{
+			name:     "allocated",
+			targets:  []string{"pg"},
+			status:   200,
+			handler:  200,
+			wantLeft: []string{"2000", "2001"},
+		},
+		{
+			name:     "skips used ports",
+			targets:  []string{"pg"},
+			used:     []string{"2001"},
+			status:   200,
+			handler:  200,
+			wantLeft: []string{"2000", "2001", "2002"},
+		},
+		{
+			name:     "range exhausted",
+			targets:  []string{"pg", "redis", "web", "ssh"},
+			status:   503,
+			handler:  200,
+			wantLeft: nil,
+		},
+		{
+			name:     "etcd failure",
+			targets:  []string{"pg", "redis"},
+			failAt:   "/gatekeeper/slotfs/2002",
+			status:   500,
+			handler:  200,
+			wantLeft: nil,
+		},
+		{
+			name:     "dry run",
+			dryRun:   true,
+			targets:  []string{"pg"},
+			status:   200,
+			handler:  200,
+			wantLeft: nil,
+		},
+		{
+			name:     "request failure",
+			targets:  []string{"pg"},
+			status:   400,
+			handler:  400,
+			wantLeft: nil,
+		},
+		{
+			name:     "request failure keeps the used ports",
+			targets:  []string{"pg"},
+			used:     []string{"2000"},
+			status:   400,
+			handler:  400,
+			wantLeft: []string{"2000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			for _, port := range tt.used {
+				if _, err := etcd.Set(context.Background(), "/gatekeeper/slotfs/"+port, "{}", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			etcd.BeforeWrite = func(key string) error {
+				if key == tt.failAt {
+					return errors.New("etcd failure")
+				}
+				return nil
+			}
+			ctx := newTestRequest("sub", &RootDomain{Domain: "example.com"})
+			ctx.SetUserValue("gatekeeper", &gatekeeper.Meta{LowPort: 2000, HighPort: 2003})
+			ctx.SetUserValue("targets", tt.targets)
+			if tt.dryRun {
+				ctx.QueryArgs().Set("dry_run", "true")
+			}
+			MWithNewSlotFS(func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(tt.handler)
+			}, etcd)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d", got, tt.status)
+			}
+			if got := slotPorts(t, etcd); strings.Join(got, ",") != strings.Join(tt.wantLeft, ",") {
+				t.Errorf("slots = %v, want %v", got, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestMValidateDomainIsAvailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered []string
+		domain     string
+		status     int
+	}{
+		{"free", nil, "db", 200},
+		{"registered", []string{"db"}, "db", 403},
+		{"nested under a domain", []string{"db"}, "pg.db", 403},
+		{"nested under a domain with another case", []string{"DB"}, "pg.db", 403},
+		{"parent of a domain", []string{"pg.db"}, "db", 403},
+		{"two levels under a domain", []string{"db"}, "a.pg.db", 200},
+		{"two levels above a domain", []string{"a.pg.db"}, "db", 200},
+		{"sibling", []string{"web.prod"}, "db.prod", 200},
+		{"common suffix", []string{"db"}, "pgdb", 200},
+		{"other root", []string{"other.example/db"}, "pg.db", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			for _, domain := range tt.registered {
+				root := "example.com"
+				if idx := strings.Index(domain, "/"); idx >= 0 {
+					root, domain = domain[:idx], domain[idx+1:]
+				}
+				if _, err := etcd.Set(context.Background(), domainKey(root, domain), "{}", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx := newTestRequest(tt.domain, &RootDomain{Domain: "example.com"})
+			MValidateDomainIsAvailable(func(ctx *fasthttp.RequestCtx) {}, etcd)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d (%s)", got, tt.status, ctx.Response.Body())
+			}
+		})
+	}
+}
+
+func TestMValidateAuthenticationRequest(t *testing.T) {
+	owner, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerSigner, err := ssh.ParsePrivateKey(owner.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.ParsePrivateKey(other.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	valid := AuthRequestBody{Domain: "sub.example.com", Timestamp: now}
+
+	tests := []struct {
+		name     string
+		identity string
+		body     AuthRequestBody
+		signer   ssh.Signer
+		status   int
+	}{
+		{"valid", owner.ID.String(), valid, ownerSigner, 200},
+		{"other agent ID", other.ID.String(), valid, ownerSigner, 403},
+		{"unsigned", owner.ID.String(), valid, nil, 403},
+		{"signed by another key", owner.ID.String(), valid, otherSigner, 403},
+		{"signed for another domain", owner.ID.String(), AuthRequestBody{Domain: "other.example.com", Timestamp: now}, ownerSigner, 403},
+		{"expired signature", owner.ID.String(), AuthRequestBody{Domain: "sub.example.com", Timestamp: now - 3600}, ownerSigner, 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			lease := *owner
+			lease.DropSecrets()
+			value, err := json.Marshal(&lease)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := etcd.Set(context.Background(), domainKey("example.com", "sub"), string(value), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := newTestRequest("sub", &RootDomain{Domain: "example.com"})
+			ctx.Request.SetRequestURI("/?identity=" + tt.identity)
+			payload, _ := json.Marshal(tt.body)
+			if tt.signer != nil {
+				signature, err := SignRegisterRequest(tt.signer, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx.Request.Header.Set(RegisterSignatureHeader, signature)
+			}
+			ctx.Request.SetBody(payload)
+			called := false
+			MValidateAuthenticationRequest(func(ctx *fasthttp.RequestCtx) { called = true }, etcd)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d (%s)", got, tt.status, ctx.Response.Body())
+			}
+			if called != (tt.status == 200) {
+				t.Errorf("handler called = %v", called)
+			}
+		})
+	}
+}
@@ -3,8 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
 	"github.com/valyala/fasthttp"
 	"go.etcd.io/etcd/client"
 )
@@ -27,40 +32,137 @@ type RegisterResponse struct {
 	Err     *Error            `json:"error"`
 }
 
-// MWithNewAgentCredentials is a middleware that inject new agent credentials in the
-// context. The generated credentials can be accessed using `ctx.UserValue("credentials")`.
-// MWithNewAgentCredentials will fail with a 500 error code if there is an issue with the
-// credentials generation or the etcd comunication.
-func MWithNewAgentCredentials(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
+// MWithAgentCredentials is a middleware that inject the agent credentials in the
+// context, along with the agent description sent in the request body.
+// New credentials are generated, unless the request comes from a registered agent
+// (see RegisterRequestBody), in which case its identity is reused without its
+// private key. The credentials can be accessed using `ctx.UserValue("credentials")`,
+// and the description using `ctx.UserValue("agent")` (see MPersistAgent).
+// MWithAgentCredentials will fail with a 403 error code for an unknown agent or
+// a request not signed by its key, or a 500 error code if there is an issue with
+// the credentials generation or the etcd comunication.
+func MWithAgentCredentials(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		domain, _ := getDomain(ctx)
-		creds, err := GenerateAgentCredentials()
-
+		body, err := parseRegisterRequestBody(ctx)
 		if err != nil {
-			log.Error().
-				Str("error", err.Error()).
+			failRequest(ctx, "Invalid request body.", 400)
+			return
+		}
+
+		var creds *AgentCredentials
+		var info *AgentInfo
+		if len(body.AgentID) != 0 {
+			id, err := uuid.FromString(body.AgentID)
+			if err != nil {
+				failRequest(ctx, "Invalid agent ID.", 400)
+				return
+			}
+			info, err = GetAgent(etcd, id.String())
+			if err != nil {
+				if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+					failRequest(ctx, "Unknown agent.", 403)
+				} else {
+					failRequest(ctx, "Backend consensus error.", 500)
+				}
+				return
+			}
+			if len(info.PublicKey) == 0 {
+				// Agents registered before the agent metadatas
+				// only have an identity per domain.
+				failRequest(ctx, "Unknown agent.", 403)
+				return
+			}
+			if err := verifyAgentSignature(ctx, info.PublicKey, body.Domain, body.Timestamp); err != nil {
+				log.Warn().
+					Str("error", err.Error()).
+					Str("agent", id.String()).
+					Str("domain", domain).
+					Msg("Rejected agent registration.")
+				failRequest(ctx, "Invalid agent signature.", 403)
+				return
+			}
+			creds = &AgentCredentials{
+				ID:       id,
+				Identity: []byte(info.PublicKey + "\n"),
+			}
+			log.Debug().
+				Str("agent", creds.ID.String()).
 				Str("domain", domain).
-				Msg("Failed to generate agent credentials")
-			failRequest(ctx, "Credentials generation error.", 500)
+				Msg("Registering an additional domain for the agent.")
 		} else {
-			err = PersistAgentCredentials(etcd, *creds)
+			creds, err = GenerateAgentCredentials()
 			if err != nil {
 				log.Error().
 					Str("error", err.Error()).
 					Str("domain", domain).
-					Msg("Could not persist agent credentials")
+					Msg("Failed to generate agent credentials")
 				failRequest(ctx, "Credentials generation error.", 500)
-			} else {
-				ctx.SetUserValue("credentials", creds)
-				h(ctx)
+				return
+			}
+			info = &AgentInfo{
+				ID:         creds.ID.String(),
+				PublicKey:  strings.TrimSpace(string(creds.Identity)),
+				Registered: time.Now().UTC(),
 			}
 		}
+
+		info.Hostname = body.Hostname
+		info.Version = body.Version
+		info.Labels = body.Labels
+		info.Updated = time.Now().UTC()
+		ctx.SetUserValue("credentials", creds)
+		ctx.SetUserValue("agent", info)
+		h(ctx)
+	})
+}
+
+// verifyAgentSignature returns an error unless the request payload is signed
+// by `publicKey`, for the requested domain (`fqdn`) and recently (`timestamp`).
+func verifyAgentSignature(ctx *fasthttp.RequestCtx, publicKey string, fqdn string, timestamp int64) error {
+	signature := ctx.Request.Header.Peek(RegisterSignatureHeader)
+	if len(signature) == 0 {
+		return errors.New("missing signature")
+	}
+	if err := VerifyRegisterRequest(publicKey, ctx.PostBody(), string(signature)); err != nil {
+		return err
+	}
+	domain, _ := getDomain(ctx)
+	if !strings.EqualFold(fqdn, domain+"."+getRoot(ctx).Domain) {
+		return fmt.Errorf("signed for another domain (%s)", fqdn)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > RegisterSignatureMaxAge || age < -RegisterSignatureMaxAge {
+		return errors.New("expired signature")
+	}
+	return nil
+}
+
+// MPersistAgent is a middleware storing the agent description injected by
+// MWithAgentCredentials, once its domain is allocated. It will fail with
+// a 500 error code if there is an issue with the etcd communication.
+func MPersistAgent(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		info := ctx.UserValue("agent").(*AgentInfo)
+		if err := PersistAgent(etcd, *info); err != nil {
+			domain, _ := getDomain(ctx)
+			log.Error().
+				Str("error", err.Error()).
+				Str("domain", domain).
+				Msg("Could not persist agent in etcd.")
+			failRequest(ctx, "Credentials generation error.", 500)
+			return
+		}
+		h(ctx)
 	})
 }
 
 // MWithDomainLease is a middleware ensuring that the domain provided by an agent can
-// be allocated. If so, it will be allocated in the etcd and passed to subsequent handler.
-// Otherwise, it will return an HTTP 500 error.
+// be allocated. If so, it will be allocated in the etcd and passed to subsequent handler,
+// and released if the request fails afterwards. Otherwise, it will return an HTTP 500 error.
+// As the overlaps are checked before the allocation (see MValidateDomainIsAvailable), they
+// are checked again against the domains allocated meanwhile: the lease is released with a
+// 403 error code if it overlaps with an earlier one.
 func MWithDomainLease(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
 		domain, _ := getDomain(ctx)
@@ -78,9 +180,11 @@ func MWithDomainLease(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.R
 				Msg("Could not serialize credentials")
 			failRequest(ctx, "Domain allocation error.", 500)
 		} else {
-			_, err = etcd.Set(
+			key := domainKey(getRoot(ctx).Domain, domain)
+			var resp *client.Response
+			resp, err = etcd.Set(
 				context.Background(),
-				"/domains/"+domain,
+				key,
 				string(m),
 				&options,
 			)
@@ -91,17 +195,50 @@ func MWithDomainLease(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.R
 					Str("domain", domain).
 					Msg("Could not allocate domain")
 				failRequest(ctx, "Domain allocation error.", 500)
+			} else if overlap, err := overlappingDomain(etcd, getRoot(ctx).Domain, domain, resp.Node.CreatedIndex); err != nil || len(overlap) != 0 {
+				releaseDomain(etcd, key, resp.Node.ModifiedIndex)
+				if err != nil {
+					log.Error().
+						Str("error", err.Error()).
+						Str("domain", domain).
+						Msg("Could not check the domain overlaps")
+					failRequest(ctx, "Domain allocation error.", 500)
+				} else {
+					log.Debug().
+						Str("domain", domain).
+						Str("registered", overlap).
+						Msg("Domain allocated concurrently with an overlapping one.")
+					failRequest(ctx, fmt.Sprintf("domain overlaps with the targets of %s.", overlap), 403)
+				}
 			} else {
 				log.Info().
 					Str("agent", credentials.ID.String()).
 					Str("domain", domain).
 					Msg("Allocated domain")
 				h(ctx)
+				if ctx.Response.StatusCode() != fasthttp.StatusOK {
+					releaseDomain(etcd, key, resp.Node.ModifiedIndex)
+				}
 			}
 		}
 	})
 }
 
+// releaseDomain deletes the domain lease, unless it was modified since.
+func releaseDomain(etcd client.KeysAPI, key string, index uint64) {
+	_, err := etcd.Delete(context.Background(), key, &client.DeleteOptions{PrevIndex: index})
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Str("key", key).
+			Msg("Failed to release domain.")
+		return
+	}
+	log.Info().
+		Str("key", key).
+		Msg("Released domain.")
+}
+
 // registerHandlerWrapped serialize the generated agent credentials and return
 // them via JSON in the response body.
 func (api *Dispatcher) registerHandlerWrapped(ctx *fasthttp.RequestCtx) {
@@ -123,16 +260,25 @@ func (api *Dispatcher) registerHandlerWrapped(ctx *fasthttp.RequestCtx) {
 // It uses several middlewares to validate requests, and pass the valid
 // requests down to Dispatcher.registerHandlerWrapper
 func (api *Dispatcher) RegisterHandler(ctx *fasthttp.RequestCtx) {
-	MValidateDomain(
-		MValidateDomainIsAvailable(
-			MWithNewAgentCredentials(
-				MWithDomainLease(
-					api.registerHandlerWrapped,
+	MWithRootDomain(
+		MValidateDomain(
+			MValidateRootPolicy(
+				MValidateDomainIsAvailable(
+					MWithAgentCredentials(
+						MWithDomainLease(
+							MPersistAgent(
+								api.registerHandlerWrapped,
+								*api.etcd,
+							),
+							*api.etcd,
+						),
+						*api.etcd,
+					),
 					*api.etcd,
 				),
 				*api.etcd,
 			),
-			*api.etcd,
 		),
+		api,
 	)(ctx)
 }
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func TestVerifyRegisterRequest(t *testing.T) {
+	creds, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(creds.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"agent_id":"a"}`)
+	signature, err := SignRegisterRequest(signer, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		key       []byte
+		payload   string
+		signature string
+		wantErr   bool
+	}{
+		{"valid", creds.Identity, string(payload), signature, false},
+		{"other key", other.Identity, string(payload), signature, true},
+		{"other payload", creds.Identity, `{"agent_id":"b"}`, signature, true},
+		{"invalid encoding", creds.Identity, string(payload), "%%%", true},
+		{"invalid signature", creds.Identity, string(payload), "AAAA", true},
+		{"invalid key", []byte("ssh-rsa"), string(payload), signature, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyRegisterRequest(string(tt.key), []byte(tt.payload), tt.signature)
+			if tt.wantErr && err == nil {
+				t.Error("expected an error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegisterChain(t *testing.T) {
+	machine, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machineSigner, err := ssh.ParsePrivateKey(machine.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateAgentCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.ParsePrivateKey(other.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	known := RegisterRequestBody{
+		AgentID:   machine.ID.String(),
+		Hostname:  "new-host",
+		Domain:    "sub.example.com",
+		Timestamp: now,
+	}
+	with := func(f func(*RegisterRequestBody)) *RegisterRequestBody {
+		body := known
+		f(&body)
+		return &body
+	}
+
+	tests := []struct {
+		name   string
+		body   *RegisterRequestBody
+		signer ssh.Signer
+		// Modifies the payload after its signature
+		tamper    func(string) string
+		domainSet bool
+		failAt    string
+		status    int
+		wantLease bool
+		// Hostname of the known agent after the request
+		wantHostname string
+	}{
+		{name: "new agent", status: 200, wantLease: true, wantHostname: "old-host"},
+		{name: "new agent on a leased domain", domainSet: true, status: 500, wantHostname: "old-host"},
+		{name: "new agent record failure", failAt: "/agents/", status: 500, wantHostname: "old-host"},
+		{name: "known agent", body: &known, signer: machineSigner, status: 200, wantLease: true, wantHostname: "new-host"},
+		{name: "known agent record failure", body: &known, signer: machineSigner, failAt: "/agents/", status: 500, wantHostname: "old-host"},
+		{name: "unsigned", body: &known, status: 403, wantHostname: "old-host"},
+		{name: "signed by another key", body: &known, signer: otherSigner, status: 403, wantHostname: "old-host"},
+		{
+			name:   "tampered payload",
+			body:   &known,
+			signer: machineSigner,
+			tamper: func(s string) string { return strings.Replace(s, "new-host", "evil-host", 1) },
+			status: 403, wantHostname: "old-host",
+		},
+		{
+			name:   "signed for another domain",
+			body:   with(func(b *RegisterRequestBody) { b.Domain = "other.example.com" }),
+			signer: machineSigner,
+			status: 403, wantHostname: "old-host",
+		},
+		{
+			name:   "expired signature",
+			body:   with(func(b *RegisterRequestBody) { b.Timestamp = now - 3600 }),
+			signer: machineSigner,
+			status: 403, wantHostname: "old-host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			if err := PersistAgent(etcd, AgentInfo{
+				ID:        machine.ID.String(),
+				PublicKey: strings.TrimSpace(string(machine.Identity)),
+				Hostname:  "old-host",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.domainSet {
+				if _, err := etcd.Set(context.Background(), domainKey("example.com", "sub"), "{}", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			etcd.BeforeWrite = func(key string) error {
+				if tt.failAt != "" && strings.HasPrefix(key, tt.failAt) {
+					return errors.New("etcd failure")
+				}
+				return nil
+			}
+
+			ctx := newTestRequest("sub", &RootDomain{Domain: "example.com"})
+			if tt.body != nil {
+				payload, _ := json.Marshal(tt.body)
+				if tt.signer != nil {
+					signature, err := SignRegisterRequest(tt.signer, payload)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ctx.Request.Header.Set(RegisterSignatureHeader, signature)
+				}
+				if tt.tamper != nil {
+					payload = []byte(tt.tamper(string(payload)))
+				}
+				ctx.Request.SetBody(payload)
+			}
+			MWithAgentCredentials(
+				MWithDomainLease(
+					MPersistAgent(func(ctx *fasthttp.RequestCtx) {}, etcd),
+					etcd,
+				),
+				etcd,
+			)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d (%s)", got, tt.status, ctx.Response.Body())
+			}
+
+			etcd.BeforeWrite = nil
+			lease, err := etcd.Get(context.Background(), domainKey("example.com", "sub"), nil)
+			if tt.domainSet {
+				if err != nil || lease.Node.Value != "{}" {
+					t.Errorf("the existing lease was modified")
+				}
+			} else if (err == nil) != tt.wantLease {
+				t.Errorf("domain leased = %v, want %v", err == nil, tt.wantLease)
+			}
+			agents, err := listChildren(etcd, "/agents")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantAgents := 1
+			if tt.body == nil && tt.status == 200 {
+				wantAgents = 2
+			}
+			if len(agents) != wantAgents {
+				t.Errorf("%d agent records, want %d", len(agents), wantAgents)
+			}
+			info, err := GetAgent(etcd, machine.ID.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Hostname != tt.wantHostname {
+				t.Errorf("hostname = %s, want %s", info.Hostname, tt.wantHostname)
+			}
+		})
+	}
+}
+
+// concurrentLease leases another domain of the root right before or after the
+// first lease, as a registration racing past MValidateDomainIsAvailable would.
+type concurrentLease struct {
+	*etcdtest.KeysAPI
+	domain string
+	first  bool
+	done   bool
+}
+
+func (c *concurrentLease) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if c.done || !strings.HasPrefix(key, domainsKey("example.com")) {
+		return c.KeysAPI.Set(ctx, key, value, opts)
+	}
+	c.done = true
+	other := func() error {
+		_, err := c.KeysAPI.Set(ctx, domainKey("example.com", c.domain), "{}", nil)
+		return err
+	}
+	if c.first {
+		if err := other(); err != nil {
+			return nil, err
+		}
+		return c.KeysAPI.Set(ctx, key, value, opts)
+	}
+	resp, err := c.KeysAPI.Set(ctx, key, value, opts)
+	if err == nil {
+		err = other()
+	}
+	return resp, err
+}
+
+func TestMWithDomainLeaseConcurrentOverlap(t *testing.T) {
+	tests := []struct {
+		name      string
+		other     string
+		first     bool
+		status    int
+		wantLease bool
+	}{
+		{"parent leased before", "db", true, 403, false},
+		{"child leased before", "a.pg.db", true, 403, false},
+		{"parent leased after", "db", false, 200, true},
+		{"sibling leased before", "web.db", true, 200, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := &concurrentLease{KeysAPI: etcdtest.New(), domain: tt.other, first: tt.first}
+			ctx := newTestRequest("pg.db", &RootDomain{Domain: "example.com"})
+			MWithAgentCredentials(
+				MWithDomainLease(func(ctx *fasthttp.RequestCtx) {}, etcd),
+				etcd,
+			)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d (%s)", got, tt.status, ctx.Response.Body())
+			}
+			if _, err := etcd.Get(context.Background(), domainKey("example.com", "pg.db"), nil); (err == nil) != tt.wantLease {
+				t.Errorf("domain leased = %v, want %v", err == nil, tt.wantLease)
+			}
+			if _, err := etcd.Get(context.Background(), domainKey("example.com", tt.other), nil); err != nil {
+				t.Errorf("the concurrent lease was released: %v", err)
+			}
+		})
+	}
+}
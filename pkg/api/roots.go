@@ -0,0 +1,328 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+// DomainsKey is the etcd directory of the registered subdomains,
+// namespaced by root domain (/domains/<root>/<sub>).
+const DomainsKey = "/domains"
+
+// DomainCountsKey is the etcd directory of the number of subdomains registered
+// under each root domain (/domain_counts/<root>), enforcing their max_domains.
+// A missing counter is initialized from the registered subdomains.
+const DomainCountsKey = "/domain_counts"
+
+// Maximum number of attempts to update a domain counter modified concurrently
+const maxCounterRetries = 16
+
+// RootDomain is a root domain served by the API,
+// and the policy of the subdomains registered under it.
+type RootDomain struct {
+	Domain string `json:"domain" mapstructure:"domain"`
+	// Subdomain patterns allowed to be registered, empty means all
+	AllowedDomains []string `json:"allowed_domains,omitempty" mapstructure:"allowed_domains"`
+	// Maximum number of registered subdomains, 0 means unlimited
+	MaxDomains int `json:"max_domains,omitempty" mapstructure:"max_domains"`
+}
+
+// Validate returns an error if the root domain or its policy is invalid.
+func (r *RootDomain) Validate() error {
+	if !utils.IsValidDomain(r.Domain) {
+		return fmt.Errorf("invalid root domain %s", r.Domain)
+	}
+	for _, pattern := range r.AllowedDomains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid domain pattern %s", r.Domain, pattern)
+		}
+	}
+	if r.MaxDomains < 0 {
+		return fmt.Errorf("%s: negative max_domains", r.Domain)
+	}
+	return nil
+}
+
+// Allows returns true if the subdomain can be registered under the root domain.
+func (r *RootDomain) Allows(domain string) bool {
+	if len(r.AllowedDomains) == 0 {
+		return true
+	}
+	for _, pattern := range r.AllowedDomains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FQDN returns the complete name of the subdomain.
+func (r *RootDomain) FQDN(domain string) string {
+	return domain + "." + r.Domain
+}
+
+func domainsKey(root string) string {
+	return fmt.Sprintf("%s/%s", DomainsKey, strings.ToLower(root))
+}
+
+func domainKey(root string, domain string) string {
+	return fmt.Sprintf("%s/%s", domainsKey(root), domain)
+}
+
+func domainCountKey(root string) string {
+	return fmt.Sprintf("%s/%s", DomainCountsKey, strings.ToLower(root))
+}
+
+// isCompareFailure returns true if the error is a failed compare-and-swap.
+func isCompareFailure(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && (cerr.Code == client.ErrorCodeTestFailed ||
+		cerr.Code == client.ErrorCodeNodeExist ||
+		cerr.Code == client.ErrorCodeKeyNotFound)
+}
+
+// updateDomainCount applies `fn` to the number of subdomains registered under
+// the root with a compare-and-swap, the counter being left untouched if `fn`
+// returns false. It returns whether the counter was updated.
+func updateDomainCount(etcd client.KeysAPI, root string, fn func(count int) (int, bool)) (bool, error) {
+	key := domainCountKey(root)
+	for i := 0; i < maxCounterRetries; i++ {
+		var count int
+		options := &client.SetOptions{}
+		resp, err := etcd.Get(context.Background(), key, &client.GetOptions{Quorum: true})
+		if err != nil {
+			if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+				return false, err
+			}
+			domains, err := listChildren(etcd, domainsKey(root))
+			if err != nil {
+				return false, err
+			}
+			count = len(domains)
+			options.PrevExist = client.PrevNoExist
+		} else {
+			if count, err = strconv.Atoi(resp.Node.Value); err != nil {
+				return false, fmt.Errorf("%s: %s", key, err.Error())
+			}
+			options.PrevIndex = resp.Node.ModifiedIndex
+		}
+		next, ok := fn(count)
+		if !ok {
+			return false, nil
+		}
+		_, err = etcd.Set(context.Background(), key, strconv.Itoa(next), options)
+		if err == nil {
+			return true, nil
+		}
+		if !isCompareFailure(err) {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("%s: too many concurrent updates", key)
+}
+
+// reserveDomain counts a new subdomain under the root domain,
+// it returns false if the root domain already holds `max` subdomains.
+func reserveDomain(etcd client.KeysAPI, root string, max int) (bool, error) {
+	return updateDomainCount(etcd, root, func(count int) (int, bool) {
+		return count + 1, count < max
+	})
+}
+
+// releaseDomainCount uncounts a subdomain reserved by reserveDomain.
+func releaseDomainCount(etcd client.KeysAPI, root string) {
+	_, err := updateDomainCount(etcd, root, func(count int) (int, bool) {
+		return count - 1, count > 0
+	})
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Str("root", root).
+			Msg("Failed to release the domain reservation.")
+	}
+}
+
+// NewRootDomains merges the default root domain with the additional ones,
+// the policy of the default root being taken from `roots` if it is listed.
+func NewRootDomains(defaultRoot string, roots []RootDomain) ([]RootDomain, error) {
+	res := []RootDomain{{Domain: defaultRoot}}
+	seen := map[string]bool{}
+	for _, root := range roots {
+		if err := root.Validate(); err != nil {
+			return nil, err
+		}
+		if seen[strings.ToLower(root.Domain)] {
+			return nil, fmt.Errorf("duplicate root domain %s", root.Domain)
+		}
+		seen[strings.ToLower(root.Domain)] = true
+		if strings.EqualFold(root.Domain, defaultRoot) {
+			res[0] = root
+		} else {
+			res = append(res, root)
+		}
+	}
+	if err := res[0].Validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// rootForHost returns the root domain a request is addressed to, from its
+// Host header, or nil if the host is not one of the root domains served
+// (e.g: an IP address).
+func (api *Dispatcher) rootForHost(host string) *RootDomain {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for i := range api.roots {
+		if strings.EqualFold(api.roots[i].Domain, host) {
+			return &api.roots[i]
+		}
+	}
+	return nil
+}
+
+// MWithRootDomain is a middleware injecting the root domain the request is addressed
+// to in the context. The root domain can be accessed using `ctx.UserValue("root")`.
+// MWithRootDomain will fail with a 404 error code if the request Host is not a root
+// domain, so that registrations never land under a root the agent did not ask for.
+func MWithRootDomain(h fasthttp.RequestHandler, api *Dispatcher) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		root := api.rootForHost(string(ctx.Host()))
+		if root == nil {
+			log.Debug().
+				Str("host", string(ctx.Host())).
+				Msg("Request to an unknown root domain.")
+			failRequest(ctx, "Unknown root domain "+string(ctx.Host())+".", 404)
+			return
+		}
+		ctx.SetUserValue("root", root)
+		h(ctx)
+	})
+}
+
+// MValidateRootPolicy is a middleware enforcing the policy of the root domain on the
+// registrations. The subdomain is counted in the root domain max_domains before the
+// subsequent handler, and uncounted if the request fails (see reserveDomain).
+// It fails with a 403 error code if the subdomain is not allowed or the root
+// domain is full, or a 500 error code in case of an etcd failure.
+func MValidateRootPolicy(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		domain, _ := getDomain(ctx)
+		root := getRoot(ctx)
+		if !root.Allows(domain) {
+			log.Debug().
+				Str("root", root.Domain).
+				Str("domain", domain).
+				Msg("Domain not allowed by the root domain policy.")
+			failRequest(ctx, "Domain not allowed under "+root.Domain+".", 403)
+			return
+		}
+		if root.MaxDomains > 0 {
+			reserved, err := reserveDomain(etcd, root.Domain, root.MaxDomains)
+			if err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Str("root", root.Domain).
+					Msg("Failed to count the root domain subdomains.")
+				failRequest(ctx, "Backend consensus error.", 500)
+				return
+			}
+			if !reserved {
+				log.Warn().
+					Str("root", root.Domain).
+					Int("max_domains", root.MaxDomains).
+					Msg("Root domain is full.")
+				failRequest(ctx, "No more domains available under "+root.Domain+".", 403)
+				return
+			}
+		}
+		h(ctx)
+		if root.MaxDomains > 0 && ctx.Response.StatusCode() != fasthttp.StatusOK {
+			releaseDomainCount(etcd, root.Domain)
+		}
+	})
+}
+
+// listDomains returns the values of all the registered subdomains, by FQDN.
+func listDomains(etcd client.KeysAPI) (map[string]string, error) {
+	res := map[string]string{}
+	resp, err := etcd.Get(context.Background(), DomainsKey, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, rootNode := range resp.Node.Nodes {
+		if !rootNode.Dir {
+			continue
+		}
+		root := path.Base(rootNode.Key)
+		for _, node := range rootNode.Nodes {
+			if !node.Dir {
+				res[path.Base(node.Key)+"."+root] = node.Value
+			}
+		}
+	}
+	return res, nil
+}
+
+// migrateLegacyDomains moves the subdomains registered before the multiple
+// root domains (/domains/<sub>) under the default root domain, and resets
+// its domain counter (see DomainCountsKey).
+func migrateLegacyDomains(etcd client.KeysAPI, root string) error {
+	domains, err := listChildren(etcd, DomainsKey)
+	if err != nil {
+		return err
+	}
+	for domain, value := range domains {
+		_, err := etcd.Set(
+			context.Background(),
+			domainKey(root, domain),
+			value,
+			&client.SetOptions{PrevExist: client.PrevNoExist},
+		)
+		if err != nil {
+			cerr, ok := err.(client.Error)
+			if !ok || cerr.Code != client.ErrorCodeNodeExist {
+				return err
+			}
+			log.Warn().
+				Str("root", root).
+				Str("domain", domain).
+				Msg("Domain already registered under the root domain, dropping the legacy registration.")
+		}
+		if _, err := etcd.Delete(
+			context.Background(),
+			DomainsKey+"/"+domain,
+			&client.DeleteOptions{PrevValue: value},
+		); err != nil {
+			return err
+		}
+		log.Info().
+			Str("root", root).
+			Str("domain", domain).
+			Msg("Migrated domain under its root domain.")
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	// The root domain counter is initialized again with the migrated domains
+	_, err = etcd.Delete(context.Background(), domainCountKey(root), nil)
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+		return nil
+	}
+	return err
+}
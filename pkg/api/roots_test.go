@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func TestNewRootDomains(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultRoot string
+		roots       []RootDomain
+		want        []string
+		wantMax     int
+		wantErr     bool
+	}{
+		{"default only", "example.com", nil, []string{"example.com"}, 0, false},
+		{"additional roots", "example.com", []RootDomain{{Domain: "dev.example"}, {Domain: "prod.example"}}, []string{"example.com", "dev.example", "prod.example"}, 0, false},
+		{"default root policy", "example.com", []RootDomain{{Domain: "dev.example"}, {Domain: "Example.com", MaxDomains: 3}}, []string{"Example.com", "dev.example"}, 3, false},
+		{"invalid default root", "localhost", nil, nil, 0, true},
+		{"invalid root", "example.com", []RootDomain{{Domain: "-dev.example"}}, nil, 0, true},
+		{"duplicate root", "example.com", []RootDomain{{Domain: "dev.example"}, {Domain: "Dev.Example"}}, nil, 0, true},
+		{"invalid pattern", "example.com", []RootDomain{{Domain: "dev.example", AllowedDomains: []string{"["}}}, nil, 0, true},
+		{"negative max domains", "example.com", []RootDomain{{Domain: "dev.example", MaxDomains: -1}}, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots, err := NewRootDomains(tt.defaultRoot, tt.roots)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, root := range roots {
+				got = append(got, root.Domain)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("roots = %v, want %v", got, tt.want)
+			}
+			if roots[0].MaxDomains != tt.wantMax {
+				t.Errorf("default root max_domains = %d, want %d", roots[0].MaxDomains, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestRootForHost(t *testing.T) {
+	api := &Dispatcher{roots: []RootDomain{{Domain: "example.com"}, {Domain: "dev.example"}}}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:9321", "example.com"},
+		{"Dev.Example:9321", "dev.example"},
+		{"dev.example.", "dev.example"},
+		{"127.0.0.1:9321", ""},
+		{"[::1]:9321", ""},
+		{"sub.example.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			root := api.rootForHost(tt.host)
+			got := ""
+			if root != nil {
+				got = root.Domain
+			}
+			if got != tt.want {
+				t.Errorf("rootForHost(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetHost(tt.host)
+			called := false
+			MWithRootDomain(func(ctx *fasthttp.RequestCtx) { called = true }, api)(ctx)
+			if called != (tt.want != "") {
+				t.Errorf("handler called = %v, status %d", called, ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestMValidateRootPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		root       RootDomain
+		registered int
+		// Counter stored before the request, empty if it does not exist
+		counter   string
+		domain    string
+		handler   int
+		status    int
+		wantCount string
+	}{
+		{"unlimited", RootDomain{Domain: "example.com"}, 5, "", "db", 200, 200, ""},
+		{"not allowed", RootDomain{Domain: "example.com", AllowedDomains: []string{"web-*"}}, 0, "", "db", 200, 403, ""},
+		{"allowed", RootDomain{Domain: "example.com", AllowedDomains: []string{"web-*", "db-*"}}, 0, "", "db-1", 200, 200, ""},
+		{"counter initialized", RootDomain{Domain: "example.com", MaxDomains: 3}, 2, "", "db", 200, 200, "3"},
+		{"full", RootDomain{Domain: "example.com", MaxDomains: 2}, 2, "", "db", 200, 403, ""},
+		{"counter reached", RootDomain{Domain: "example.com", MaxDomains: 2}, 0, "2", "db", 200, 403, "2"},
+		{"counter incremented", RootDomain{Domain: "example.com", MaxDomains: 3}, 0, "1", "db", 200, 200, "2"},
+		{"released on failure", RootDomain{Domain: "example.com", MaxDomains: 3}, 0, "1", "db", 500, 500, "1"},
+		{"invalid counter", RootDomain{Domain: "example.com", MaxDomains: 3}, 0, "x", "db", 200, 500, "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			for i := 0; i < tt.registered; i++ {
+				if _, err := etcd.Set(context.Background(), domainKey("example.com", "sub"+string(rune('a'+i))), "{}", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.counter != "" {
+				if _, err := etcd.Set(context.Background(), domainCountKey("example.com"), tt.counter, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root := tt.root
+			ctx := newTestRequest(tt.domain, &root)
+			MValidateRootPolicy(func(ctx *fasthttp.RequestCtx) {
+				ctx.SetStatusCode(tt.handler)
+			}, etcd)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.status {
+				t.Errorf("status = %d, want %d (%s)", got, tt.status, ctx.Response.Body())
+			}
+			count := ""
+			if resp, err := etcd.Get(context.Background(), domainCountKey("example.com"), nil); err == nil {
+				count = resp.Node.Value
+			}
+			if count != tt.wantCount {
+				t.Errorf("domain counter = %q, want %q", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestReserveDomainConcurrently(t *testing.T) {
+	const max = 5
+	etcd := etcdtest.New()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reserved := 0
+	for i := 0; i < 4*max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := reserveDomain(etcd, "example.com", max)
+			for err != nil && strings.Contains(err.Error(), "too many concurrent updates") {
+				ok, err = reserveDomain(etcd, "example.com", max)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != max {
+		t.Errorf("%d domains reserved, want %d", reserved, max)
+	}
+}
+
+func TestReserveDomainEtcdFailure(t *testing.T) {
+	etcd := etcdtest.New()
+	etcd.BeforeWrite = func(key string) error { return errors.New("etcd failure") }
+	if ok, err := reserveDomain(etcd, "example.com", 5); ok || err == nil {
+		t.Errorf("reserveDomain() = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestMigrateLegacyDomains(t *testing.T) {
+	tests := []struct {
+		name     string
+		legacy   map[string]string
+		existing map[string]string
+		counter  bool
+		want     map[string]string
+	}{
+		{
+			name:   "nothing to migrate",
+			legacy: nil, counter: true,
+			want: map[string]string{},
+		},
+		{
+			name:   "migrated",
+			legacy: map[string]string{"db": "a", "web": "b"}, counter: true,
+			want: map[string]string{"db": "a", "web": "b"},
+		},
+		{
+			name:     "already registered under the root",
+			legacy:   map[string]string{"db": "a", "web": "b"},
+			existing: map[string]string{"db": "c"},
+			want:     map[string]string{"db": "c", "web": "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etcd := etcdtest.New()
+			for domain, value := range tt.legacy {
+				if _, err := etcd.Set(context.Background(), DomainsKey+"/"+domain, value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for domain, value := range tt.existing {
+				if _, err := etcd.Set(context.Background(), domainKey("example.com", domain), value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.counter {
+				if _, err := etcd.Set(context.Background(), domainCountKey("example.com"), "0", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := migrateLegacyDomains(etcd, "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			legacy, err := listChildren(etcd, DomainsKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(legacy) != 0 {
+				t.Errorf("legacy domains left: %v", legacy)
+			}
+			got, err := listChildren(etcd, domainsKey("example.com"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("domains = %v, want %v", got, tt.want)
+			}
+			for domain, value := range tt.want {
+				if got[domain] != value {
+					t.Errorf("domain %s = %q, want %q", domain, got[domain], value)
+				}
+			}
+			_, err = etcd.Get(context.Background(), domainCountKey("example.com"), nil)
+			if counterLeft := err == nil; counterLeft != (tt.counter && len(tt.legacy) == 0) {
+				t.Errorf("domain counter left = %v", counterLeft)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+)
+
+// APIToken grants a user the visibility of the domains matching its patterns.
+// Tokens are persisted in etcd under `/tokens/<sha256(token)>`,
+// so that the secret itself is never stored.
+type APIToken struct {
+	User string `json:"user"`
+	// Subdomains patterns (e.g: `dev-*`), `*` matches all the domains.
+	Domains []string `json:"domains"`
+}
+
+const tokenBytes = 32
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "/tokens/" + hex.EncodeToString(sum[:])
+}
+
+// Allows returns true if the subdomain matches one of the token patterns.
+func (t *APIToken) Allows(domain string) bool {
+	for _, pattern := range t.Domains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateToken generates a new token for the user, and persists it in etcd.
+func CreateToken(etcd client.KeysAPI, user string, domains []string) (string, error) {
+	if len(user) == 0 {
+		return "", errors.New("empty user")
+	}
+	for _, pattern := range domains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", errors.New("invalid domain pattern " + pattern)
+		}
+	}
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	payload, err := json.Marshal(APIToken{User: user, Domains: domains})
+	if err != nil {
+		return "", err
+	}
+	if _, err := etcd.Set(
+		context.Background(),
+		tokenKey(token),
+		string(payload),
+		&client.SetOptions{PrevExist: client.PrevNoExist},
+	); err != nil {
+		return "", err
+	}
+	log.Info().
+		Str("user", user).
+		Strs("domains", domains).
+		Msg("Created API token.")
+	return token, nil
+}
+
+// RevokeToken removes the token from etcd.
+func RevokeToken(etcd client.KeysAPI, token string) error {
+	_, err := etcd.Delete(context.Background(), tokenKey(token), nil)
+	return err
+}
+
+// getToken returns the token which authenticated the request.
+func getToken(ctx *fasthttp.RequestCtx) *APIToken {
+	if token, ok := ctx.UserValue("token").(*APIToken); ok {
+		return token
+	}
+	return nil
+}
+
+// MValidateAPIToken authenticates the request with the `Authorization: Bearer <token>`
+// header, and injects the token in the context under `token`.
+// It will fail with a 401 error code if the token is missing or unknown.
+func MValidateAPIToken(h fasthttp.RequestHandler, etcd client.KeysAPI) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		auth := string(ctx.Request.Header.Peek("Authorization"))
+		if !strings.HasPrefix(auth, "Bearer ") {
+			failRequest(ctx, "Missing API token.", 401)
+			return
+		}
+		resp, err := etcd.Get(context.Background(), tokenKey(strings.TrimPrefix(auth, "Bearer ")), nil)
+		if err != nil {
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+				failRequest(ctx, "Invalid API token.", 401)
+			} else {
+				failRequest(ctx, "Backend consensus error", 500)
+			}
+			return
+		}
+		token := &APIToken{}
+		if err := json.Unmarshal([]byte(resp.Node.Value), token); err != nil {
+			log.Warn().Str("error", err.Error()).Msg("Failed to deserialize API token.")
+			failRequest(ctx, "Invalid API token.", 401)
+			return
+		}
+		ctx.SetUserValue("token", token)
+		h(ctx)
+	})
+}
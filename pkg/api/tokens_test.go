@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.etcd.io/etcd/client"
+
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		domain  string
+		want    bool
+	}{
+		{"all domains", []string{"*"}, "db", true},
+		{"all domains with several labels", []string{"*"}, "db-1.prod", true},
+		{"exact match", []string{"db"}, "db", true},
+		{"prefix", []string{"dev-*"}, "dev-db", true},
+		{"prefix mismatch", []string{"dev-*"}, "prod-db", false},
+		{"second pattern", []string{"dev-*", "prod-*"}, "prod-db", true},
+		{"case sensitive", []string{"dev-*"}, "DEV-db", false},
+		{"invalid pattern", []string{"["}, "db", false},
+		{"no pattern", nil, "db", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &APIToken{User: "user", Domains: tt.domains}
+			if got := token.Allows(tt.domain); got != tt.want {
+				t.Errorf("Allows(%q) = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMValidateAPIToken(t *testing.T) {
+	etcd := etcdtest.New()
+	token, err := CreateToken(etcd, "user", []string{"dev-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := CreateToken(etcd, "user", []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeToken(etcd, revoked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateToken(etcd, "user", []string{"["}); err == nil {
+		t.Error("token created with an invalid pattern")
+	}
+	if _, err := CreateToken(etcd, "", []string{"*"}); err == nil {
+		t.Error("token created without user")
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"valid", "Bearer " + token, 200},
+		{"missing", "", 401},
+		{"not a bearer token", token, 401},
+		{"unknown", "Bearer unknown", 401},
+		{"revoked", "Bearer " + revoked, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			if tt.header != "" {
+				ctx.Request.Header.Set("Authorization", tt.header)
+			}
+			var got *APIToken
+			MValidateAPIToken(func(ctx *fasthttp.RequestCtx) {
+				got = getToken(ctx)
+			}, etcd)(ctx)
+			if status := ctx.Response.StatusCode(); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if (got != nil) != (tt.status == 200) {
+				t.Errorf("token injected = %v", got != nil)
+			}
+			if got != nil && (got.User != "user" || !got.Allows("dev-db")) {
+				t.Errorf("unexpected token %+v", got)
+			}
+		})
+	}
+}
+
+// unreachableEtcd fails the reads the way the etcd client does
+// when no member of the cluster is reachable.
+type unreachableEtcd struct {
+	client.KeysAPI
+}
+
+func (unreachableEtcd) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	return nil, &client.ClusterError{Errors: []error{errors.New("connection refused")}}
+}
+
+func TestUnreachableEtcd(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Authorization", "Bearer token")
+	MValidateAPIToken(func(ctx *fasthttp.RequestCtx) {
+		t.Error("request authenticated without etcd")
+	}, unreachableEtcd{})(ctx)
+	if status := ctx.Response.StatusCode(); status != 500 {
+		t.Errorf("status = %d, want 500", status)
+	}
+	if _, err := listChildren(unreachableEtcd{}, DomainsKey); err == nil {
+		t.Error("listChildren() succeeded without etcd")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"regexp"
 
+	"github.com/Xide/rssh/pkg/utils"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
 )
@@ -23,6 +24,50 @@ func getDomain(ctx *fasthttp.RequestCtx) (string, error) {
 	return ctx.UserValue("domain").(string), nil
 }
 
+// parseAuthRequestBody decodes the optional authentication payload.
+// An empty body is valid and results in an empty policy.
+func parseAuthRequestBody(ctx *fasthttp.RequestCtx) (*AuthRequestBody, error) {
+	body := &AuthRequestBody{}
+	if len(ctx.PostBody()) == 0 {
+		return body, nil
+	}
+	if err := json.Unmarshal(ctx.PostBody(), body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// parseRegisterRequestBody decodes the optional registration payload.
+// An empty body is valid and results in a new anonymous agent.
+func parseRegisterRequestBody(ctx *fasthttp.RequestCtx) (*RegisterRequestBody, error) {
+	body := &RegisterRequestBody{}
+	if len(ctx.PostBody()) == 0 {
+		return body, nil
+	}
+	if err := json.Unmarshal(ctx.PostBody(), body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func getRoot(ctx *fasthttp.RequestCtx) *RootDomain {
+	return ctx.UserValue("root").(*RootDomain)
+}
+
+func getAllowedKeys(ctx *fasthttp.RequestCtx) []string {
+	if keys, ok := ctx.UserValue("allowed_keys").([]string); ok {
+		return keys
+	}
+	return nil
+}
+
+func getTargets(ctx *fasthttp.RequestCtx) []string {
+	if targets, ok := ctx.UserValue("targets").([]string); ok {
+		return targets
+	}
+	return nil
+}
+
 func respond(ctx *fasthttp.RequestCtx, v interface{}) error {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -55,10 +100,19 @@ func failRequest(ctx *fasthttp.RequestCtx, msg string, code int) {
 }
 
 // ValidateDomain returns an error if the parameter is not a valid subdomain
-// We only allow alphanumeric characters
+// Subdomains are one or several DNS labels (e.g: db-1.prod)
 func ValidateDomain(domain string) error {
-	if match, _ := regexp.MatchString("^[a-zA-Z0-9]+$", domain); !match {
+	if !utils.IsValidLabels(domain) {
 		return errors.New("illegal characters in requested domain")
 	}
 	return nil
 }
+
+// ValidateTargetName returns an error if the parameter is not a valid target name
+// Target names are lowercase DNS labels, so that they can be used as a subdomain
+func ValidateTargetName(name string) error {
+	if match, _ := regexp.MatchString("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$", name); !match {
+		return errors.New("illegal characters in target name")
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Package asciicast records and plays back terminal sessions
+// in the asciicast v2 format (https://docs.asciinema.org/manual/asciicast/v2/).
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types
+const (
+	// Output is data written to the terminal
+	Output = "o"
+	// Input is data typed by the user
+	Input = "i"
+	// Resize is a terminal size change, formatted as `WIDTHxHEIGHT`
+	Resize = "r"
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version       int               `json:"version"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Timestamp     int64             `json:"timestamp,omitempty"`
+	IdleTimeLimit float64           `json:"idle_time_limit,omitempty"`
+	Command       string            `json:"command,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+// Event is a timed chunk of the terminal stream.
+type Event struct {
+	// Seconds elapsed since the beginning of the recording
+	Time float64
+	Type string
+	Data string
+}
+
+// MarshalJSON encodes the event as a `[time, type, data]` array.
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+// UnmarshalJSON decodes a `[time, type, data]` array.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	raw := []interface{}{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return errors.New("invalid asciicast event")
+	}
+	t, ok1 := raw[0].(float64)
+	kind, ok2 := raw[1].(string)
+	data, ok3 := raw[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return errors.New("invalid asciicast event")
+	}
+	e.Time, e.Type, e.Data = t, kind, data
+	return nil
+}
+
+// Writer records the events of a session. The header is written
+// with the first event, or by Start. It is safe for concurrent use.
+type Writer struct {
+	lock    sync.Mutex
+	w       io.Writer
+	header  Header
+	started bool
+	start   time.Time
+	// Incomplete UTF-8 sequence at the end of the last chunk, by event type
+	pending map[string][]byte
+}
+
+// NewWriter returns a writer recording to `w`, with a 80x24 terminal by default.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:       w,
+		header:  Header{Version: 2, Width: 80, Height: 24},
+		pending: map[string][]byte{},
+	}
+}
+
+// Update applies `fn` to the header if it has not been written yet,
+// and returns false otherwise.
+func (r *Writer) Update(fn func(h *Header)) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started {
+		return false
+	}
+	fn(&r.header)
+	return true
+}
+
+// Start writes the header, if not already done.
+func (r *Writer) Start() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.startLocked()
+}
+
+func (r *Writer) startLocked() error {
+	if r.started {
+		return nil
+	}
+	r.started = true
+	r.start = time.Now()
+	r.header.Version = 2
+	r.header.Timestamp = r.start.Unix()
+	b, err := json.Marshal(r.header)
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+// splitUTF8 returns the longest prefix of `b` that does not end
+// with an incomplete UTF-8 sequence, and the remaining bytes.
+func splitUTF8(b []byte) ([]byte, []byte) {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if utf8.FullRune(b[len(b)-i:]) {
+			return b, nil
+		}
+		return b[:len(b)-i], b[len(b)-i:]
+	}
+	return b, nil
+}
+
+// WriteEvent records data of the given event type.
+// Multi-byte characters split across calls are kept whole.
+func (r *Writer) WriteEvent(kind string, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.startLocked(); err != nil {
+		return err
+	}
+	buf := append(r.pending[kind], data...)
+	complete, rest := splitUTF8(buf)
+	r.pending[kind] = append([]byte{}, rest...)
+	if len(complete) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(Event{
+		Time: time.Since(r.start).Seconds(),
+		Type: kind,
+		Data: string(complete),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+// Resize records a terminal size change.
+func (r *Writer) Resize(width int, height int) error {
+	return r.WriteEvent(Resize, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// OutputWriter returns an io.Writer recording Output events.
+func (r *Writer) OutputWriter() io.Writer {
+	return eventWriter{r, Output}
+}
+
+// InputWriter returns an io.Writer recording Input events.
+func (r *Writer) InputWriter() io.Writer {
+	return eventWriter{r, Input}
+}
+
+type eventWriter struct {
+	r    *Writer
+	kind string
+}
+
+func (e eventWriter) Write(p []byte) (int, error) {
+	if err := e.r.WriteEvent(e.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Play writes the output events of the recording read from `r` to `w`,
+// respecting their timing divided by `speed`. Pauses are capped to
+// `idleLimit` (or the header idle time limit) when it is not zero.
+func Play(r io.Reader, w io.Writer, speed float64, idleLimit time.Duration) error {
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("empty recording")
+	}
+	header := Header{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return err
+	}
+	if header.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	if idleLimit == 0 && header.IdleTimeLimit > 0 {
+		idleLimit = time.Duration(header.IdleTimeLimit * float64(time.Second))
+	}
+
+	last := 0.0
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		delay := time.Duration((e.Time - last) * float64(time.Second))
+		last = e.Time
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		time.Sleep(time.Duration(float64(delay) / speed))
+		if e.Type != Output {
+			continue
+		}
+		if _, err := io.WriteString(w, e.Data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,192 @@
+package asciicast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitUTF8(t *testing.T) {
+	euro := []byte("€") // 3 bytes
+	tests := []struct {
+		name     string
+		data     []byte
+		wantHead string
+		wantRest []byte
+	}{
+		{"empty", nil, "", nil},
+		{"ascii", []byte("abc"), "abc", nil},
+		{"complete rune", append([]byte("a"), euro...), "a€", nil},
+		{"first byte of a rune", append([]byte("a"), euro[0]), "a", euro[:1]},
+		{"two bytes of a rune", append([]byte("a"), euro[:2]...), "a", euro[:2]},
+		{"only an incomplete rune", euro[:2], "", euro[:2]},
+		{"invalid continuation bytes", []byte{'a', 0x80, 0x80, 0x80, 0x80}, "a\x80\x80\x80\x80", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, rest := splitUTF8(tt.data)
+			if string(head) != tt.wantHead || !bytes.Equal(rest, tt.wantRest) {
+				t.Errorf("splitUTF8(%q) = %q, %q, want %q, %q", tt.data, head, rest, tt.wantHead, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    Event
+		wantErr bool
+	}{
+		{"output", `[1.5,"o","ls\r\n"]`, Event{1.5, Output, "ls\r\n"}, false},
+		{"input", `[0.25,"i","\u0003"]`, Event{0.25, Input, "\x03"}, false},
+		{"resize", `[2,"r","100x40"]`, Event{2, Resize, "100x40"}, false},
+		{"not an array", `{"time":1}`, Event{}, true},
+		{"missing data", `[1,"o"]`, Event{}, true},
+		{"invalid time", `["1","o","x"]`, Event{}, true},
+		{"invalid data", `[1,"o",2]`, Event{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Event{}
+			err := json.Unmarshal([]byte(tt.raw), &e)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", e)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e != tt.want {
+				t.Errorf("event = %+v, want %+v", e, tt.want)
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again := Event{}
+			if err := json.Unmarshal(b, &again); err != nil || again != e {
+				t.Errorf("round trip = %+v, %v, want %+v", again, err, e)
+			}
+		})
+	}
+}
+
+// readRecording parses the header and the events of a recording.
+func readRecording(t *testing.T, data []byte) (Header, []Event) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	header := Header{}
+	if !scanner.Scan() {
+		t.Fatal("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{}
+	for scanner.Scan() {
+		e := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return header, events
+}
+
+func TestWriter(t *testing.T) {
+	euro := []byte("€")
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if !w.Update(func(h *Header) { h.Width, h.Title = 120, "session" }) {
+		t.Fatal("header not updated before the first event")
+	}
+	w.InputWriter().Write([]byte("ls\r"))
+	// Multi-byte character split across writes
+	w.OutputWriter().Write(append([]byte("a"), euro[:1]...))
+	w.OutputWriter().Write(euro[1:])
+	w.Resize(100, 40)
+	if w.Update(func(h *Header) { h.Width = 10 }) {
+		t.Error("header updated after the first event")
+	}
+
+	header, events := readRecording(t, buf.Bytes())
+	if header.Version != 2 || header.Width != 120 || header.Height != 24 || header.Title != "session" || header.Timestamp == 0 {
+		t.Errorf("unexpected header %+v", header)
+	}
+	want := []Event{{0, Input, "ls\r"}, {0, Output, "a"}, {0, Output, "€"}, {0, Resize, "100x40"}}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+	for i, e := range events {
+		if e.Type != want[i].Type || e.Data != want[i].Data {
+			t.Errorf("event %d = %+v, want %+v", i, e, want[i])
+		}
+		if i > 0 && e.Time < events[i-1].Time {
+			t.Errorf("event %d is older than the previous one", i)
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	recording := strings.Join([]string{
+		`{"version":2,"width":80,"height":24}`,
+		`[0.001,"o","$ "]`,
+		`[0.002,"i","ls\r"]`,
+		``,
+		`[0.003,"o","ls\r\n"]`,
+		`[0.004,"r","100x40"]`,
+		`[0.005,"o","file\r\n"]`,
+	}, "\n")
+	tests := []struct {
+		name    string
+		data    string
+		speed   float64
+		want    string
+		wantErr bool
+	}{
+		{"output only", recording, 1000, "$ ls\r\nfile\r\n", false},
+		{"invalid speed", recording, 0, "", true},
+		{"empty recording", "", 1, "", true},
+		{"unsupported version", `{"version":1}`, 1, "", true},
+		{"invalid event", `{"version":2}` + "\n" + `[1,"o"]`, 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := Play(strings.NewReader(tt.data), out, tt.speed, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("played %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayIdleLimit(t *testing.T) {
+	recording := `{"version":2,"idle_time_limit":0.01}` + "\n" + `[3600,"o","done"]`
+	start := time.Now()
+	out := &bytes.Buffer{}
+	if err := Play(strings.NewReader(recording), out, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle time limit ignored, played in %s", elapsed)
+	}
+	if out.String() != "done" {
+		t.Errorf("played %q", out.String())
+	}
+}
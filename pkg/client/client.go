@@ -0,0 +1,239 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/Xide/rssh/pkg/gatekeeper"
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Client connects SSH clients to the domains exposed through RSSH,
+// discovering the gatekeeper from the API of the root domain.
+type Client struct {
+	// Port on which the API listen to requests on the root domain
+	APIPort uint16 `json:"api_port" mapstructure:"api_port"`
+	// Private key offered to the gatekeeper, in addition to the ssh-agent keys
+	IdentityFile string `json:"identity_file" mapstructure:"identity_file"`
+	// API token used to list the domains visible to the user
+	Token string `json:"token" mapstructure:"token"`
+	// Reach the API over HTTPS (e.g: behind a TLS reverse proxy),
+	// the gatekeeper host keys it publishes are then trusted
+	APITLS bool `json:"api_tls" mapstructure:"api_tls"`
+	// known_hosts file pinning the gatekeeper host keys
+	KnownHosts string `json:"known_hosts" mapstructure:"known_hosts"`
+	// Skip the verification of the gatekeeper host key
+	Insecure bool `json:"insecure" mapstructure:"insecure"`
+	// RSSH root domains, configured in the `api` section
+	RootDomains []string `json:"-" mapstructure:"-"`
+}
+
+// apiURL returns the URL of the API endpoint on the root domain.
+func (c *Client) apiURL(root string, endpoint string) string {
+	scheme := "http"
+	if c.APITLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(root, strconv.Itoa(int(c.APIPort))), endpoint)
+}
+
+// rootDomain returns the root domain serving the requested name
+// (see utils.SplitDomainRequest). Target names (target.sub.root)
+// are only resolved under the configured root domains.
+func (c *Client) rootDomain(fqdn string) (string, error) {
+	_, root, err := utils.SplitDomainRequest(fqdn, c.RootDomains)
+	return root, err
+}
+
+// Gatekeeper fetches the gatekeeper metadatas from the API of the root domain.
+func (c *Client) Gatekeeper(root string) (*gatekeeper.Meta, error) {
+	httpClient := &http.Client{Timeout: requestTimeout}
+	resp, err := httpClient.Get(c.apiURL(root, "/meta/gatekeeper"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	gkResp := api.GatekeeperResponse{}
+	if err := json.Unmarshal(body, &gkResp); err != nil {
+		return nil, err
+	}
+	if gkResp.Err != nil {
+		return nil, errors.New(gkResp.Err.Msg)
+	}
+	if gkResp.Infos == nil {
+		return nil, errors.New("empty gatekeeper metadatas")
+	}
+	return gkResp.Infos, nil
+}
+
+// discover returns the root domain serving the request and its gatekeeper.
+func (c *Client) discover(request string) (string, *gatekeeper.Meta, error) {
+	fqdn, _ := utils.SplitTargetRequest(request)
+	root, err := c.rootDomain(fqdn)
+	if err != nil {
+		return "", nil, err
+	}
+	gk, err := c.Gatekeeper(root)
+	if err != nil {
+		log.Debug().
+			Str("root", root).
+			Str("error", err.Error()).
+			Msg("No RSSH API found.")
+		return "", nil, err
+	}
+	return root, gk, nil
+}
+
+// authMethods returns the keys of the ssh-agent and of the identity file.
+// The gatekeeper accepts any key, only the domains allowed keys are enforced,
+// keyboard interactive is used as a fallback for clients without keys.
+func (c *Client) authMethods() ([]ssh.AuthMethod, error) {
+	signers := []ssh.Signer{}
+	if c.IdentityFile != "" {
+		b, err := ioutil.ReadFile(c.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Debug().
+				Str("error", err.Error()).
+				Msg("Could not reach ssh-agent.")
+		} else if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+			signers = append(signers, agentSigners...)
+		}
+	}
+	return []ssh.AuthMethod{
+		ssh.PublicKeys(signers...),
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return make([]string, len(questions)), nil
+		}),
+	}, nil
+}
+
+// hostKeyCallback returns the verification of the gatekeeper host key, which
+// fails closed: the keys pinned in the known_hosts file are checked first, and
+// the keys published by the API are only trusted when it is reached over TLS.
+func (c *Client) hostKeyCallback(root string, gk *gatekeeper.Meta) (ssh.HostKeyCallback, error) {
+	gkAddr := net.JoinHostPort(root, strconv.Itoa(int(gk.SSHPort)))
+	if c.KnownHosts != "" {
+		return knownhosts.New(c.KnownHosts)
+	}
+	if c.Insecure {
+		log.Warn().
+			Str("gatekeeper", gkAddr).
+			Msg("Skipping the gatekeeper host key verification.")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	if !c.APITLS {
+		return nil, fmt.Errorf(
+			"cannot verify the host key of the gatekeeper %s, the API is reached over plain HTTP: "+
+				"pin it in a known_hosts file (e.g: `ssh-keyscan -p %d %s`), or reach the API over TLS",
+			gkAddr, gk.SSHPort, root,
+		)
+	}
+	callback, err := gk.HostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	if callback == nil {
+		return nil, fmt.Errorf("the gatekeeper %s does not publish its host key", gkAddr)
+	}
+	return callback, nil
+}
+
+// dial connects to the gatekeeper serving the request.
+func (c *Client) dial(request string) (*ssh.Client, error) {
+	root, gk, err := c.discover(request)
+	if err != nil {
+		return nil, err
+	}
+	gkAddr := net.JoinHostPort(root, strconv.Itoa(int(gk.SSHPort)))
+	callback, err := c.hostKeyCallback(root, gk)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := c.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().
+		Str("gatekeeper", gkAddr).
+		Str("request", request).
+		Msg("Connecting to gatekeeper.")
+	return ssh.Dial("tcp", gkAddr, &ssh.ClientConfig{
+		User:            "rssh",
+		Auth:            auth,
+		HostKeyCallback: callback,
+		Timeout:         requestTimeout,
+	})
+}
+
+// bridge runs a proxy session of the request on the gatekeeper
+// connection, until one side of the streams is closed.
+func bridge(conn *ssh.Client, request string, stdin io.Reader, stdout io.Writer) error {
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = os.Stderr
+	err = session.Run(request)
+	if _, ok := err.(*ssh.ExitMissingError); ok {
+		// The gatekeeper closes the proxy session without exit status
+		return nil
+	}
+	return err
+}
+
+// Connect bridges the streams with the domain (or `domain:target`)
+// requested, through the gatekeeper of its root domain.
+func (c *Client) Connect(request string, stdin io.Reader, stdout io.Writer) error {
+	conn, err := c.dial(request)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return bridge(conn, request, stdin, stdout)
+}
+
+// SSHConfig returns the ~/.ssh/config block routing the host
+// patterns through `rssh connect`.
+func SSHConfig(patterns []string, command string) string {
+	var b strings.Builder
+	for _, pattern := range patterns {
+		fmt.Fprintf(&b, "Host %s\n", pattern)
+		fmt.Fprintf(&b, "    ProxyCommand %s %%h\n\n", command)
+	}
+	return b.String()
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Xide/rssh/pkg/gatekeeper"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	hostKey := newTestKey(t)
+	otherKey := newTestKey(t)
+	published := &gatekeeper.Meta{
+		SSHPort:  2223,
+		HostKeys: []string{strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))},
+	}
+	unpublished := &gatekeeper.Meta{SSHPort: 2223}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("example.com:2223")}, hostKey)
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		client     Client
+		gk         *gatekeeper.Meta
+		wantErr    bool
+		acceptHost bool
+		acceptAny  bool
+	}{
+		{"plain http", Client{}, published, true, false, false},
+		{"known hosts", Client{KnownHosts: knownHosts}, unpublished, false, true, false},
+		{"known hosts before insecure", Client{KnownHosts: knownHosts, Insecure: true}, published, false, true, false},
+		{"api over tls", Client{APITLS: true}, published, false, true, false},
+		{"api over tls without host key", Client{APITLS: true}, unpublished, true, false, false},
+		{"insecure", Client{Insecure: true}, unpublished, false, true, true},
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2223}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callback, err := tt.client.hostKeyCallback("example.com", tt.gk)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := callback("example.com:2223", addr, hostKey); (err == nil) != tt.acceptHost {
+				t.Errorf("host key accepted = %v, want %v", err == nil, tt.acceptHost)
+			}
+			if err := callback("example.com:2223", addr, otherKey); (err == nil) != tt.acceptAny {
+				t.Errorf("other key accepted = %v, want %v", err == nil, tt.acceptAny)
+			}
+		})
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		client Client
+		want   string
+	}{
+		{Client{APIPort: 9321}, "http://example.com:9321/meta/gatekeeper"},
+		{Client{APIPort: 443, APITLS: true}, "https://example.com:443/meta/gatekeeper"},
+	}
+	for _, tt := range tests {
+		if got := tt.client.apiURL("example.com", "/meta/gatekeeper"); got != tt.want {
+			t.Errorf("apiURL() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestRootDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		roots   []string
+		fqdn    string
+		want    string
+		wantErr bool
+	}{
+		{"configured root", []string{"example.com"}, "db-1.prod.example.com", "example.com", false},
+		{"target under a configured root", []string{"example.com"}, "pg.db.example.com", "example.com", false},
+		{"most specific root", []string{"example.com", "prod.example.com"}, "db.prod.example.com", "prod.example.com", false},
+		{"unconfigured root", nil, "sub.example.com", "example.com", false},
+		{"ambiguous", nil, "pg.sub.example.com", "", true},
+		{"not a subdomain", nil, "example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{RootDomains: tt.roots}
+			got, err := c.rootDomain(tt.fqdn)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("rootDomain() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Xide/rssh/pkg/api"
+	"github.com/Xide/rssh/pkg/gatekeeper"
+)
+
+// Domains lists the domains of the root domain visible with the client token.
+func (c *Client) Domains(root string) ([]api.DomainInfo, error) {
+	if len(c.Token) == 0 {
+		return nil, errors.New("an API token is required to list the domains")
+	}
+	req, err := http.NewRequest("GET", c.apiURL(root, "/domains"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	httpClient := &http.Client{Timeout: requestTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	domainsResp := api.DomainsResponse{}
+	if err := json.Unmarshal(body, &domainsResp); err != nil {
+		return nil, err
+	}
+	if domainsResp.Err != nil {
+		return nil, errors.New(domainsResp.Err.Msg)
+	}
+	return domainsResp.Domains, nil
+}
+
+// DomainHosts returns the host names of the domains, and of their named targets.
+func DomainHosts(domains []api.DomainInfo) []string {
+	hosts := []string{}
+	for _, d := range domains {
+		hosts = append(hosts, d.Domain)
+		for _, t := range d.Targets {
+			if t.Name != gatekeeper.DefaultTarget {
+				hosts = append(hosts, t.Name+"."+d.Domain)
+			}
+		}
+	}
+	return hosts
+}
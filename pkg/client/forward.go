@@ -0,0 +1,85 @@
+package client
+
+import (
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// forwarder shares a gatekeeper connection between the local
+// connections, reconnecting when it has been lost.
+type forwarder struct {
+	client  *Client
+	request string
+	conn    *ssh.Client
+	lock    sync.Mutex
+}
+
+func (f *forwarder) gatekeeper() (*ssh.Client, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.conn == nil {
+		conn, err := f.client.dial(f.request)
+		if err != nil {
+			return nil, err
+		}
+		f.conn = conn
+		go func() {
+			conn.Wait()
+			f.lock.Lock()
+			if f.conn == conn {
+				f.conn = nil
+			}
+			f.lock.Unlock()
+		}()
+	}
+	return f.conn, nil
+}
+
+func (f *forwarder) handle(local net.Conn) {
+	defer local.Close()
+	conn, err := f.gatekeeper()
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Str("request", f.request).
+			Msg("Could not connect to gatekeeper.")
+		return
+	}
+	log.Debug().
+		Str("client_addr", local.RemoteAddr().String()).
+		Str("request", f.request).
+		Msg("Forwarding connection.")
+	if err := bridge(conn, f.request, local, local); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Str("request", f.request).
+			Msg("Forwarded connection failed.")
+	}
+}
+
+// Forward listens on the local address and bridges each accepted
+// connection with the domain (or `domain:target`) requested,
+// through the gatekeeper proxy sessions.
+func (c *Client) Forward(request string, listenAddr string) error {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Info().
+		Str("addr", ln.Addr().String()).
+		Str("request", request).
+		Msg("Forwarding local connections.")
+
+	f := &forwarder{client: c, request: request}
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go f.handle(local)
+	}
+}
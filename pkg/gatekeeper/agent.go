@@ -3,31 +3,14 @@ package gatekeeper
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/rs/zerolog/log"
 	"go.etcd.io/etcd/client"
+	gossh "golang.org/x/crypto/ssh"
 )
 
-func (g *GateKeeper) getSlotFS() (*client.Nodes, error) {
-	slotFs, err := (*g.etcd).Get(context.Background(), "/gatekeeper/slotfs", nil)
-	if err != nil {
-		log.Error().
-			Str("error", err.Error()).
-			Msg("Failed to load Gk slotFS")
-		return nil, err
-	}
-	if slotFs == nil || slotFs.Node == nil {
-		log.Error().
-			Str("error", err.Error()).
-			Msg("Request while Gk slotFS does not exists.")
-		return nil, errors.New("empty gatekeeper slotFS")
-	}
-	return &slotFs.Node.Nodes, nil
-}
-
 func (g *GateKeeper) getSlot(etcdNode *client.Node) (*AgentSlot, error) {
 	slot := &AgentSlot{}
 	err := json.Unmarshal([]byte(etcdNode.Value), slot)
@@ -42,40 +25,35 @@ func (g *GateKeeper) setSlot(slot *AgentSlot, key string) error {
 	if err != nil {
 		return err
 	}
-	if _, err = (*g.etcd).Set(context.Background(), key, string(payload), nil); err != nil {
+	resp, err := (*g.etcd).Set(context.Background(), key, string(payload), nil)
+	if err != nil {
 		return err
 	}
+	g.slots.set(slot, resp.Node.ModifiedIndex)
 	return nil
 }
 
-func (g *GateKeeper) getFirstSlotForFn(fn func(*AgentSlot) bool) (*AgentSlot, error) {
-	slots, err := g.getSlotFS()
+// getSlotForPort returns the slot bound to `port`. Slots missing from the
+// cache are read from etcd, as agents may request them before the watch
+// delivered their allocation.
+func (g *GateKeeper) getSlotForPort(port uint16) (*AgentSlot, error) {
+	if slot, ok := g.slots.forPort(port); ok {
+		return slot, nil
+	}
+	resp, err := (*g.etcd).Get(context.Background(), fmt.Sprintf("%s/%d", SlotFSKey, port), nil)
 	if err != nil {
 		return nil, err
 	}
-	for _, rSlot := range *slots {
-		slot, err := g.getSlot(rSlot)
-		if err != nil {
-			log.Warn().
-				Str("error", err.Error()).
-				Msg("Unable to deserialize slot from etcd.")
-			continue
-		}
-		if fn(slot) {
-			return slot, nil
-		}
+	slot, err := g.getSlot(resp.Node)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("getFirstSlotForFn: nothing matched in slotFS")
-}
-
-func (g *GateKeeper) getSlotForPort(port uint16) (*AgentSlot, error) {
-	return g.getFirstSlotForFn(func(sl *AgentSlot) bool {
-		return uint16(port) == sl.Port
-	})
+	g.slots.set(slot, resp.Node.ModifiedIndex)
+	return slot, nil
 }
 
 func (g *GateKeeper) setSlotForPort(slot *AgentSlot, port uint16) error {
-	return g.setSlot(slot, fmt.Sprintf("/gatekeeper/slotfs/%d", port))
+	return g.setSlot(slot, fmt.Sprintf("%s/%d", SlotFSKey, port))
 }
 
 func (g *GateKeeper) reversePortForwardHandler(etcd client.KeysAPI) func(ssh.Context, string, uint32) bool {
@@ -85,6 +63,20 @@ func (g *GateKeeper) reversePortForwardHandler(etcd client.KeysAPI) func(ssh.Con
 			Uint32("port", port).
 			Msg("Port forward request")
 
+		if !g.track(&g.collectors) {
+			log.Debug().
+				Str("client_addr", host).
+				Uint32("port", port).
+				Msg("Gatekeeper is shutting down, denied port forward.")
+			return false
+		}
+		accepted := false
+		defer func() {
+			if !accepted {
+				g.collectors.Done()
+			}
+		}()
+
 		slot, err := g.getSlotForPort(uint16(port))
 		if err != nil {
 			log.Debug().
@@ -112,7 +104,14 @@ func (g *GateKeeper) reversePortForwardHandler(etcd client.KeysAPI) func(ssh.Con
 				Msg("Failed to reserve establish slot in etcd.")
 			return false
 		}
-		go g.collectClosedSession(ctx, slot)
+		released := g.bindSlot(ctx, uint16(port))
+		g.trackConn(ctx)
+		g.advertiseHostKeys(ctx)
+		accepted = true
+		go func() {
+			defer g.collectors.Done()
+			g.collectClosedSession(ctx, slot, released)
+		}()
 		log.Debug().
 			Str("client_addr", host).
 			Uint32("port", port).
@@ -120,3 +119,66 @@ func (g *GateKeeper) reversePortForwardHandler(etcd client.KeysAPI) func(ssh.Con
 		return true
 	}
 }
+
+// bindSlot records that the slot is forwarded by the agent connection,
+// so that only this connection can report on its health or release it.
+// The returned channel is closed once the slot is released.
+func (g *GateKeeper) bindSlot(ctx ssh.Context, port uint16) <-chan struct{} {
+	g.boundLock.Lock()
+	defer g.boundLock.Unlock()
+	if g.bound == nil {
+		g.bound = map[string]map[uint16]chan struct{}{}
+	}
+	if g.bound[ctx.SessionID()] == nil {
+		g.bound[ctx.SessionID()] = map[uint16]chan struct{}{}
+	}
+	released := make(chan struct{})
+	g.bound[ctx.SessionID()][port] = released
+	return released
+}
+
+// unbindSlot releases a slot bound by the agent connection, if any.
+func (g *GateKeeper) unbindSlot(ctx ssh.Context, port uint16) {
+	g.boundLock.Lock()
+	defer g.boundLock.Unlock()
+	released, ok := g.bound[ctx.SessionID()][port]
+	if !ok {
+		return
+	}
+	close(released)
+	delete(g.bound[ctx.SessionID()], port)
+	if len(g.bound[ctx.SessionID()]) == 0 {
+		delete(g.bound, ctx.SessionID())
+		delete(g.conns, ctx.SessionID())
+	}
+}
+
+func (g *GateKeeper) isBound(ctx ssh.Context, port uint16) bool {
+	g.boundLock.Lock()
+	defer g.boundLock.Unlock()
+	_, ok := g.bound[ctx.SessionID()][port]
+	return ok
+}
+
+// cancelPortForwardHandler stops forwarding a single slot of an agent
+// connection, so that agents sharing a connection between several domains
+// can release one of them without closing the others.
+func (g *GateKeeper) cancelPortForwardHandler(forwardHandler *ssh.ForwardedTCPHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		payload := struct {
+			BindAddr string
+			BindPort uint32
+		}{}
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			return false, []byte{}
+		}
+		ok, data := forwardHandler.HandleSSHRequest(ctx, srv, req)
+		if ok {
+			log.Debug().
+				Uint32("port", payload.BindPort).
+				Msg("Cancelled port forward")
+			g.unbindSlot(ctx, uint16(payload.BindPort))
+		}
+		return ok, data
+	}
+}
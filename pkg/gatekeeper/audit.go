@@ -0,0 +1,227 @@
+package gatekeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/etcd/client"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Termination reasons of the proxied sessions
+const (
+	ReasonUnsupported        = "unsupported_request"
+	ReasonNotFound           = "domain_not_found"
+	ReasonDenied             = "access_denied"
+	ReasonBackendDown        = "backend_down"
+	ReasonBackendUnreachable = "backend_unreachable"
+	ReasonClientClosed       = "client_closed"
+	ReasonAgentClosed        = "agent_closed"
+	ReasonShutdown           = "gatekeeper_shutdown"
+)
+
+// AuditEtcdKey is the etcd directory in which the audit records
+// are created in order by the etcd sink.
+const AuditEtcdKey = "/audit/sessions"
+
+// AuditRecord describe a client session proxied (or refused) by the gatekeeper.
+type AuditRecord struct {
+	ClientAddr string `json:"client_addr"`
+	User       string `json:"user"`
+	// SHA256 fingerprint of the key the client signed in with, empty
+	// for the keyboard interactive method
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Name requested by the client (e.g: pg.sub.root)
+	Request string `json:"request"`
+	// Resolved slot, empty if the request could not be routed
+	Domain  string    `json:"domain,omitempty"`
+	Root    string    `json:"root,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Port    uint16    `json:"port,omitempty"`
+	AgentID string    `json:"agent_id,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Bytes sent by the client to the agent
+	BytesIn int64 `json:"bytes_in"`
+	// Bytes sent by the agent to the client
+	BytesOut int64  `json:"bytes_out"`
+	Reason   string `json:"reason"`
+	// Asciicast files of the recorded sessions
+	Recordings []string `json:"recordings,omitempty"`
+}
+
+// AuditSink persists the audit records.
+type AuditSink interface {
+	Write(record *AuditRecord) error
+	Close() error
+}
+
+// fileSink appends the records as JSON lines to a file.
+type fileSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func (s *fileSink) Write(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
+
+// syslogSink sends the records as JSON messages to syslog.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) Write(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(b))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// etcdSink stores the records in order under AuditEtcdKey.
+type etcdSink struct {
+	etcd client.KeysAPI
+}
+
+func (s *etcdSink) Write(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.etcd.CreateInOrder(context.Background(), AuditEtcdKey, string(b), nil)
+	return err
+}
+
+func (s *etcdSink) Close() error {
+	return nil
+}
+
+// NewAuditSink parses the sink specification:
+//   - `file:///path/to/audit.jsonl` (or a path) appends JSON lines to the file
+//   - `syslog` logs to the local syslog daemon, `syslog://host:port` to a remote one (UDP)
+//   - `etcd` stores the records under AuditEtcdKey
+func NewAuditSink(spec string, etcd *client.KeysAPI) (AuditSink, error) {
+	switch {
+	case spec == "etcd":
+		if etcd == nil {
+			return nil, errors.New("etcd audit sink requires an etcd connection")
+		}
+		return &etcdSink{etcd: *etcd}, nil
+	case spec == "syslog" || strings.HasPrefix(spec, "syslog://"):
+		var (
+			w   *syslog.Writer
+			err error
+		)
+		if spec == "syslog" {
+			w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "rssh-gatekeeper")
+		} else {
+			w, err = syslog.Dial("udp", strings.TrimPrefix(spec, "syslog://"), syslog.LOG_INFO|syslog.LOG_AUTH, "rssh-gatekeeper")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{w: w}, nil
+	default:
+		path := spec
+		if strings.HasPrefix(spec, "file://") {
+			u, err := url.Parse(spec)
+			if err != nil {
+				return nil, err
+			}
+			path = u.Path
+		}
+		if len(path) == 0 {
+			return nil, errors.New("empty audit log path")
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSink{f: f}, nil
+	}
+}
+
+// WithAudit records the client sessions in the sink described by `spec`
+// (see NewAuditSink). It must be called after WithEtcdE for the etcd sink.
+func (g *GateKeeper) WithAudit(spec string) error {
+	sink, err := NewAuditSink(spec, g.etcd)
+	if err != nil {
+		return err
+	}
+	g.audit = sink
+	log.Info().Str("sink", spec).Msg("Audit log enabled.")
+	return nil
+}
+
+// newAuditRecord starts the record of a client session.
+func newAuditRecord(s ssh.Session) *AuditRecord {
+	record := &AuditRecord{
+		ClientAddr: s.RemoteAddr().String(),
+		User:       s.User(),
+		Start:      time.Now().UTC(),
+	}
+	if key := authenticatedKey(s.Context().(ssh.Context)); key != nil {
+		record.Fingerprint = gossh.FingerprintSHA256(key)
+	}
+	return record
+}
+
+// withSlot records the slot resolved for the session.
+func (r *AuditRecord) withSlot(slot *AgentSlot) *AuditRecord {
+	r.Domain = slot.Domain
+	r.Root = slot.Root
+	r.Target = slot.TargetName()
+	r.Port = slot.Port
+	r.AgentID = slot.AgentID
+	return r
+}
+
+// recordSession closes the record with the termination reason and writes it to the sink.
+func (g *GateKeeper) recordSession(record *AuditRecord, reason string) {
+	record.End = time.Now().UTC()
+	record.Reason = reason
+	log.Info().
+		Str("client_addr", record.ClientAddr).
+		Str("request", record.Request).
+		Str("agent_id", record.AgentID).
+		Int64("bytes_in", record.BytesIn).
+		Int64("bytes_out", record.BytesOut).
+		Dur("duration", record.End.Sub(record.Start)).
+		Str("reason", reason).
+		Msg("Client session ended.")
+	if g.audit == nil {
+		return
+	}
+	if err := g.audit.Write(record); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Str("client_addr", record.ClientAddr).
+			Str("request", record.Request).
+			Msg("Failed to write audit record.")
+	}
+}
@@ -2,13 +2,12 @@ package gatekeeper
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"go.etcd.io/etcd/client"
@@ -34,6 +33,17 @@ type Meta struct {
 	SSHPort  uint16
 	LowPort  uint16
 	HighPort uint16
+	// Port of the SSH over WebSocket transport, 0 if disabled
+	WSPort uint16
+	WSTLS  bool
+	// Public host key, in the authorized_keys format
+	HostKey string
+	// All the advertised host keys, including the keys of an
+	// ongoing rotation, in the authorized_keys format
+	HostKeys []string `json:",omitempty"`
+	// Public key of the recorded sessions, in the authorized_keys format.
+	// Empty if the recording is disabled.
+	RecordingKey string `json:",omitempty"`
 }
 
 // GateKeeper is the public SSH server exposing the forwarded agents.
@@ -43,17 +53,59 @@ type GateKeeper struct {
 	etcd     *client.KeysAPI
 	backends []Gate
 	clients  []AgentSlot
-	hostKey  gossh.Signer
+	// In-memory index of the slotFS
+	slots *slotCache
+	// RSSH root domains served, the default one first
+	roots []string
+	// Host keys file, and the served keys (the handshake key first)
+	hostKeyPath  string
+	hostKeys     []gossh.Signer
+	hostKeysLock sync.RWMutex
+	// Slots forwarded by each agent connection, by session ID,
+	// with the channel closed once they are released.
+	bound     map[string]map[uint16]chan struct{}
+	boundLock sync.Mutex
+	// SSH over WebSocket listener configuration
+	wsAddr string
+	wsCert string
+	wsKey  string
+	// Sink of the client sessions audit records, nil if disabled
+	audit AuditSink
+	// Sessions recording directory, and recorded subdomains patterns
+	recordDir     string
+	recordDomains []string
+	recordKey     gossh.Signer
+	// Record the client input along with the terminal output
+	recordInput bool
+	// Agent connections forwarding slots, by session ID
+	conns map[string]gossh.Conn
+	// Set on shutdown, new sessions and forwards are refused
+	draining  bool
+	drainLock sync.Mutex
+	// Active client sessions, and slots awaiting garbage collection
+	sessions   sync.WaitGroup
+	collectors sync.WaitGroup
+	// Index of the metadatas announced in etcd
+	announced uint64
+	wsServer  *http.Server
+	// Health endpoints listener, disabled if the port is 0
+	healthAddr   string
+	healthPort   uint16
+	healthServer *http.Server
+	// Set once the SSH server is listening
+	listening bool
+	// Number of active client sessions
+	activeSessions int64
 }
 
 // WithEtcdE instanciate an etcd client and connect to the cluster.
 // the resulting api keys are persisted in the GateKeeper.
-func (g *GateKeeper) WithEtcdE(etcdEndpoints []string) error {
+func (g *GateKeeper) WithEtcdE(etcdConfig utils.EtcdConfig) error {
 	var k *client.KeysAPI
 	if err := utils.WithFixedIntervalRetry(
 		func() error {
 			var err error
-			k, err = utils.GetEtcdKey(etcdEndpoints)
+			k, err = utils.GetEtcdKey(etcdConfig)
 			return err
 		},
 		5,
@@ -65,11 +117,14 @@ func (g *GateKeeper) WithEtcdE(etcdEndpoints []string) error {
 	g.etcd = k
 	// Clear any potential remaining datas from previous gatekeepers
 	// WILL prevent multiple gatekeepers to run at the same time.
-	_, err := (*k).Delete(context.Background(), "/gatekeeper/slotfs", &client.DeleteOptions{Recursive: true})
-	if err != nil && err.(client.Error).Code != client.ErrorCodeKeyNotFound {
-		return err
+	_, err := (*k).Delete(context.Background(), SlotFSKey, &client.DeleteOptions{Recursive: true})
+	if err != nil {
+		if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+			return err
+		}
 	}
-	return nil
+	g.slots = newSlotCache()
+	return g.slots.run(*k)
 }
 
 // WithPortRange sets the range on which the gatekeeper will try to
@@ -80,6 +135,13 @@ func (g *GateKeeper) WithPortRange(low uint16, high uint16) *GateKeeper {
 	return g
 }
 
+// WithRootDomains sets the RSSH root domains of the requested names,
+// the default one first (see getSlotForRequest).
+func (g *GateKeeper) WithRootDomains(roots []string) *GateKeeper {
+	g.roots = roots
+	return g
+}
+
 // Run is the entrypoint of the Gatekeeper.
 // it announce itself to etcd and then starts the SSH server.
 func (g *GateKeeper) Run() error {
@@ -87,6 +149,15 @@ func (g *GateKeeper) Run() error {
 	if err != nil {
 		return err
 	}
+	if g.healthPort != 0 {
+		go func() {
+			if err := g.serveHealth(); err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("Health server exited unexpectedly.")
+			}
+		}()
+	}
 	return g.initSSHServer()
 }
 
@@ -98,10 +169,11 @@ func (g *GateKeeper) announce() error {
 	}
 
 	log.Debug().Msg("Starting to announce API to etcd")
-	_, err = (*g.etcd).Set(context.Background(), "/meta/gatekeeper", string(m), nil)
+	resp, err := (*g.etcd).Set(context.Background(), "/meta/gatekeeper", string(m), nil)
 	if err != nil {
 		return err
 	}
+	g.announced = resp.Node.ModifiedIndex
 
 	log.Info().Msg("Gatekeeper registered in etcd.")
 	return nil
@@ -120,25 +192,39 @@ func NewGateKeeper(addr string, port uint16) (*GateKeeper, error) {
 	}, nil
 }
 
-// collectClosedSession removes from the runtime a connection that has been
-// closed by the agent.
-func (g *GateKeeper) collectClosedSession(ctx ssh.Context, slot *AgentSlot) {
-	payload, err := json.Marshal(slot)
-	if err != nil {
-		log.Warn().
-			Str("error", err.Error()).
-			Msg("Failed to marshal slot for etcd garbage collection.")
-		return
+// collectClosedSession removes from the runtime a slot that has been
+// released, or whose connection has been closed by the agent.
+func (g *GateKeeper) collectClosedSession(ctx ssh.Context, slot *AgentSlot, released <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-released:
 	}
-	<-ctx.Done()
+	g.unbindSlot(ctx, slot.Port)
 
-	if _, err := (*g.etcd).Delete(
-		context.Background(),
-		fmt.Sprintf("/gatekeeper/slotfs/%d", slot.Port),
-		&client.DeleteOptions{
-			PrevValue: string(payload),
-		},
-	); err != nil {
+	// The slot may have been updated since (e.g: health reports),
+	// only delete it if it still belongs to the same agent target,
+	// agents sharing their identity across several domains.
+	key := fmt.Sprintf("%s/%d", SlotFSKey, slot.Port)
+	resp, err := (*g.etcd).Get(context.Background(), key, nil)
+	if err == nil {
+		current, err := g.getSlot(resp.Node)
+		if err == nil && (current.AgentID != slot.AgentID ||
+			current.FQDN() != slot.FQDN() ||
+			current.TargetName() != slot.TargetName()) {
+			log.Debug().
+				Str("domain", slot.Domain).
+				Msg("Slot reallocated, skipping garbage collection.")
+			return
+		}
+		_, err = (*g.etcd).Delete(
+			context.Background(),
+			key,
+			&client.DeleteOptions{
+				PrevIndex: resp.Node.ModifiedIndex,
+			},
+		)
+	}
+	if err != nil {
 		log.Warn().
 			Str("error", err.Error()).
 			Str("domain", slot.Domain).
@@ -151,40 +237,62 @@ func (g *GateKeeper) collectClosedSession(ctx ssh.Context, slot *AgentSlot) {
 
 // WithHostKey loads the private key at `path` and create a new signer from it.
 // if the file does not exist (or can't be read from), a new host key will be
-// generated and stored at `path`
+// generated and stored at `path`. The keys of an ongoing rotation
+// (see StageHostKey) are advertised alongside it.
 func (g *GateKeeper) WithHostKey(path string) error {
-	var key *rsa.PrivateKey
-	b, err := ioutil.ReadFile(path)
+	keys, err := loadHostKeys(path)
 	if err != nil {
-		log.Info().Msg("Generating new host key")
-		key, err = rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			log.Error().Str("error", err.Error()).Msg("Failed to generate host key")
-			return err
-		}
-		payload := x509.MarshalPKCS1PrivateKey(key)
-		err = ioutil.WriteFile(path, payload, 0600)
-		if err != nil {
-			log.Warn().
-				Str("error", err.Error()).
-				Msg("Failed to persist private key, identity WILL change if the gatekeeper is restarted")
-		}
-	} else {
-		log.Debug().Str("path", path).Msg("Imported host key.")
-		key, err = x509.ParsePKCS1PrivateKey(b)
-		if err != nil {
-			log.Error().Str("error", err.Error()).Msg("Failed to parse host key")
-			return err
-		}
-	}
-	g.hostKey, err = gossh.NewSignerFromKey(key)
-	if err != nil {
-		log.Error().Str("error", err.Error()).Msg("Failed to import host key from private key")
+		log.Error().Str("error", err.Error()).Msg("Failed to import host key")
 		return err
 	}
+	log.Debug().Str("path", path).Int("advertised", len(keys)).Msg("Imported host key.")
+	g.hostKeyPath = path
+	g.setHostKeys(keys)
 	return nil
 }
 
+// authenticatedKeyExtension is the permissions extension holding
+// the public key a client authenticated with, in the wire format.
+const authenticatedKeyExtension = "rssh-authenticated-key"
+
+// authenticatedKey returns the public key the client connection authenticated
+// with, or nil for the keyboard interactive method. Unlike `Session.PublicKey`,
+// keys offered but not signed by the client are never returned.
+func authenticatedKey(ctx ssh.Context) ssh.PublicKey {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok || conn.Permissions == nil {
+		return nil
+	}
+	blob, ok := conn.Permissions.Extensions[authenticatedKeyExtension]
+	if !ok {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey([]byte(blob))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// publicKeyHandler accepts any key. Keys are also checked when the client only
+// queries them, the permissions of a key only become the connection permissions
+// once the client proved to own it (see authenticatedKey).
+func publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	ctx.SetValue(ssh.ContextKeyPermissions, &ssh.Permissions{
+		Permissions: &gossh.Permissions{
+			Extensions: map[string]string{authenticatedKeyExtension: string(key.Marshal())},
+		},
+	})
+	return true
+}
+
+// keyboardInteractiveHandler accepts the clients without keys,
+// they are only allowed to connect to the domains without allowed keys.
+func keyboardInteractiveHandler(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+	ctx.SetValue(ssh.ContextKeyPermissions, &ssh.Permissions{Permissions: &gossh.Permissions{}})
+	return true
+}
+
 // initSSHServer creates a new SSH server with
 // - routing logic through command
 // - reverse port forwarding logic for agents
@@ -192,22 +300,57 @@ func (g *GateKeeper) initSSHServer() error {
 	if g.srv != nil {
 		return errors.New("SSH server already initialized")
 	}
-	if g.hostKey == nil {
+	if len(g.currentHostKeys()) == 0 {
 		return errors.New("Host key missing")
 	}
 	addr := fmt.Sprintf("%s:%d", g.Meta.SSHAddr, g.Meta.SSHPort)
+	forwardHandler := &ssh.ForwardedTCPHandler{}
 	server := ssh.Server{
-		Addr:        addr,
-		HostSigners: []ssh.Signer{g.hostKey},
-		Handler:     ssh.Handler(g.proxyCommandHandler()),
+		Addr:                          addr,
+		HostSigners:                   []ssh.Signer{hostSigner{g}},
+		ServerConfigCallback:          g.hostKeysConfig,
+		Handler:                       ssh.Handler(g.proxyCommandHandler()),
 		ReversePortForwardingCallback: ssh.ReversePortForwardingCallback(g.reversePortForwardHandler(*g.etcd)),
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":          forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward":   g.cancelPortForwardHandler(forwardHandler),
+			HealthRequestType:        g.healthReportHandler,
+			HostKeysProveRequestType: g.hostKeysProveHandler,
+		},
+		// Any key is accepted, it is only recorded to enforce
+		// the domains allowed keys. Clients without keys can still
+		// connect through the keyboard interactive method.
+		PublicKeyHandler:           publicKeyHandler,
+		KeyboardInteractiveHandler: keyboardInteractiveHandler,
 	}
 	g.srv = &server
+	if g.Meta.WSPort != 0 {
+		go func() {
+			if err := g.serveWebSocket(&server); err != nil {
+				log.Error().
+					Str("error", err.Error()).
+					Msg("SSH over WebSocket server exited unexpectedly.")
+			}
+		}()
+	}
 	log.Info().
 		Str("addr", g.Meta.SSHAddr).
 		Uint16("port", g.Meta.SSHPort).
 		Msg("starting SSH server")
-	err := server.ListenAndServe()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Msg("SSH server failed to listen.")
+		return err
+	}
+	g.drainLock.Lock()
+	g.listening = true
+	g.drainLock.Unlock()
+	err = server.Serve(ln)
+	if err == ssh.ErrServerClosed {
+		return nil
+	}
 	if err != nil {
 		log.Error().
 			Str("error", err.Error()).
@@ -0,0 +1,149 @@
+package gatekeeper
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testContext is the part of ssh.Context used by the auth handlers.
+type testContext struct {
+	ssh.Context
+	values map[interface{}]interface{}
+}
+
+func newTestContext() *testContext {
+	return &testContext{values: map[interface{}]interface{}{}}
+}
+
+func (ctx *testContext) SetValue(key, value interface{}) { ctx.values[key] = value }
+
+func (ctx *testContext) Value(key interface{}) interface{} { return ctx.values[key] }
+
+func (ctx *testContext) Permissions() *ssh.Permissions {
+	return ctx.values[ssh.ContextKeyPermissions].(*ssh.Permissions)
+}
+
+// The SSH server keeps the permissions returned for each key and only applies
+// those of the key the client signed, or of the keyboard interactive method.
+func TestAuthHandlersPermissions(t *testing.T) {
+	owned := newTestSigner(t).PublicKey()
+	stolen := newTestSigner(t).PublicKey()
+	ctx := newTestContext()
+
+	publicKeyHandler(ctx, owned)
+	ownedPerms := ctx.Permissions().Permissions
+	publicKeyHandler(ctx, stolen)
+	if got := ownedPerms.Extensions[authenticatedKeyExtension]; got != string(owned.Marshal()) {
+		t.Errorf("permissions of the signed key were overwritten by a queried key")
+	}
+	keyboardInteractiveHandler(ctx, nil)
+	if _, ok := ctx.Permissions().Extensions[authenticatedKeyExtension]; ok {
+		t.Errorf("keyboard interactive permissions hold a queried key")
+	}
+}
+
+// serveAuthenticatedKey starts an SSH server answering the fingerprint of
+// the key the session authenticated with, or "none", as found in its audit record.
+func serveAuthenticatedKey(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ssh.Server{
+		HostSigners: []ssh.Signer{newTestSigner(t)},
+		Handler: func(s ssh.Session) {
+			record := newAuditRecord(s)
+			if key := authenticatedKey(s.Context().(ssh.Context)); key == nil && record.Fingerprint == "" {
+				io.WriteString(s, "none")
+			} else if key != nil && record.Fingerprint == gossh.FingerprintSHA256(key) {
+				io.WriteString(s, record.Fingerprint)
+			} else {
+				io.WriteString(s, "audit mismatch: "+record.Fingerprint)
+			}
+		},
+		PublicKeyHandler:           publicKeyHandler,
+		KeyboardInteractiveHandler: keyboardInteractiveHandler,
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestAuthenticatedKey(t *testing.T) {
+	addr := serveAuthenticatedKey(t)
+	owned := newTestSigner(t)
+	keyboardInteractive := gossh.KeyboardInteractive(
+		func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return make([]string, len(questions)), nil
+		},
+	)
+	tests := []struct {
+		name string
+		auth []gossh.AuthMethod
+		want string
+	}{
+		{
+			name: "signed key",
+			auth: []gossh.AuthMethod{gossh.PublicKeys(owned)},
+			want: gossh.FingerprintSHA256(owned.PublicKey()),
+		},
+		{
+			name: "keyboard interactive",
+			auth: []gossh.AuthMethod{keyboardInteractive},
+			want: "none",
+		},
+		{
+			name: "keyboard interactive after a rejected key",
+			auth: []gossh.AuthMethod{gossh.PublicKeys(), keyboardInteractive},
+			want: "none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+				User:            "test",
+				Auth:            tt.auth,
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			session, err := conn.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			out, err := session.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := session.Shell(); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := ioutil.ReadAll(out)
+			if string(got) != tt.want {
+				t.Errorf("authenticated key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package gatekeeper
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// HealthRequestType is the global request sent by agents
+// to report the health of the target bound to a slot.
+const HealthRequestType = "health@rssh"
+
+// HealthReport is the payload of a HealthRequestType request.
+type HealthReport struct {
+	Port    uint32
+	Healthy bool
+}
+
+// healthReportHandler persists the target health reported by an agent
+// in its slot, so that clients can be told why a session can't be opened.
+func (g *GateKeeper) healthReportHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	report := HealthReport{}
+	if err := gossh.Unmarshal(req.Payload, &report); err != nil {
+		log.Debug().
+			Str("error", err.Error()).
+			Msg("Invalid health report.")
+		return false, nil
+	}
+	port := uint16(report.Port)
+	if !g.isBound(ctx, port) {
+		log.Debug().
+			Uint32("port", report.Port).
+			Msg("Health report for a slot not bound by the agent.")
+		return false, nil
+	}
+	slot, err := g.getSlotForPort(port)
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Uint32("port", report.Port).
+			Msg("Health report for an unknown slot.")
+		return false, nil
+	}
+	if slot.Healthy != nil && *slot.Healthy == report.Healthy {
+		return true, nil
+	}
+	slot.Healthy = &report.Healthy
+	if err := g.setSlotForPort(slot, port); err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Uint32("port", report.Port).
+			Msg("Failed to persist target health.")
+		return false, nil
+	}
+	log.Info().
+		Str("domain", slot.Domain).
+		Str("target", slot.TargetName()).
+		Bool("healthy", report.Healthy).
+		Msg("Target health changed.")
+	return true, nil
+}
@@ -0,0 +1,102 @@
+package gatekeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xide/rssh/pkg/utils"
+)
+
+// Maximum time spent by a readiness check
+const healthTimeout = 2 * time.Second
+
+// healthStatus is the response of the health endpoints,
+// with the number of active client sessions.
+type healthStatus struct {
+	utils.HealthStatus
+	Sessions int64 `json:"sessions"`
+}
+
+// WithHealth enables the HTTP health endpoints on `addr:port`,
+// for orchestrators to monitor the gatekeeper.
+func (g *GateKeeper) WithHealth(addr string, port uint16) *GateKeeper {
+	g.healthAddr = addr
+	g.healthPort = port
+	return g
+}
+
+// serveHealth serves the liveness (/health/live)
+// and readiness (/health/ready) endpoints.
+func (g *GateKeeper) serveHealth() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/live", g.liveHandler)
+	mux.HandleFunc("/health/ready", g.readyHandler)
+	httpServer := &http.Server{
+		Addr:    net.JoinHostPort(g.healthAddr, fmt.Sprintf("%d", g.healthPort)),
+		Handler: mux,
+	}
+	g.drainLock.Lock()
+	g.healthServer = httpServer
+	g.drainLock.Unlock()
+	log.Info().
+		Str("addr", g.healthAddr).
+		Uint16("port", g.healthPort).
+		Msg("starting health server")
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (g *GateKeeper) writeHealth(w http.ResponseWriter, status utils.HealthStatus) {
+	payload, err := json.Marshal(healthStatus{
+		HealthStatus: status,
+		Sessions:     atomic.LoadInt64(&g.activeSessions),
+	})
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Failed to serialize healthcheck infos.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(payload)
+}
+
+// liveHandler reports that the gatekeeper process is running.
+func (g *GateKeeper) liveHandler(w http.ResponseWriter, r *http.Request) {
+	g.writeHealth(w, utils.NewHealthStatus())
+}
+
+// readyHandler reports if the gatekeeper can handle new sessions: etcd is
+// reachable and the SSH server is listening (and not draining).
+func (g *GateKeeper) readyHandler(w http.ResponseWriter, r *http.Request) {
+	g.drainLock.Lock()
+	listener := utils.HealthCheck{Name: "ssh", Ok: g.listening && !g.draining}
+	switch {
+	case g.draining:
+		listener.Detail = "draining"
+	case g.listening:
+		listener.Detail = fmt.Sprintf("listening on %s:%d", g.Meta.SSHAddr, g.Meta.SSHPort)
+	default:
+		listener.Detail = "not listening"
+	}
+	g.drainLock.Unlock()
+	g.writeHealth(w, utils.NewHealthStatus(
+		utils.CheckEtcdQuorum(*g.etcd, "/meta/gatekeeper", healthTimeout),
+		listener,
+	))
+}
@@ -0,0 +1,380 @@
+package gatekeeper
+
+import (
+	"bytes"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host keys extension, used by the clients
+// to learn the keys of the gatekeeper before a rotation.
+const (
+	HostKeysRequestType      = "hostkeys-00@openssh.com"
+	HostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+)
+
+// Suffixes of the host key files during a rotation, relative to the
+// current host key: the next key is advertised before being promoted,
+// and the previous one is advertised until the rotation is finished.
+const (
+	NextHostKeySuffix = ".next"
+	OldHostKeySuffix  = ".old"
+)
+
+// Host key roles during a rotation
+const (
+	HostKeyCurrent = "current"
+	HostKeyNext    = "next"
+	HostKeyOld     = "old"
+)
+
+// HostKeyFile is one of the host key files of the gatekeeper.
+type HostKeyFile struct {
+	Role string `json:"role" yaml:"role"`
+	Path string `json:"path" yaml:"path"`
+	// Public key, in the authorized_keys format
+	PublicKey   string `json:"public_key" yaml:"public_key"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+}
+
+var hostKeysAdvertised = &struct{ name string }{"hostkeys-advertised"}
+
+func hostKeyPaths(path string) map[string]string {
+	return map[string]string{
+		HostKeyCurrent: path,
+		HostKeyNext:    path + NextHostKeySuffix,
+		HostKeyOld:     path + OldHostKeySuffix,
+	}
+}
+
+// readHostKey reads a DER encoded host key: the RSA keys of the previous
+// versions are stored in the PKCS#1 format, the ed25519 keys in PKCS#8.
+func readHostKey(path string) (gossh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(b); err == nil {
+		return gossh.NewSignerFromKey(key)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if k, ok := key.(stded25519.PrivateKey); ok {
+		// The SSH package only signs with its own ed25519 type
+		key = ed25519.PrivateKey(k)
+	}
+	return gossh.NewSignerFromKey(key)
+}
+
+// newHostKey generates an ed25519 host key, and its PKCS#8 encoding.
+func newHostKey() (gossh.Signer, []byte, error) {
+	_, key, err := stded25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(ed25519.PrivateKey(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, der, nil
+}
+
+// generateHostKey creates a new host key at `path`, which must not exist.
+func generateHostKey(path string) (gossh.Signer, error) {
+	signer, der, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(der); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func authorizedKey(key gossh.PublicKey) string {
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+// loadHostKeys reads the current host key at `path`, and the next and old
+// keys of an ongoing rotation. The current key is generated if it does not exist.
+func loadHostKeys(path string) ([]gossh.Signer, error) {
+	current, err := readHostKey(path)
+	if os.IsNotExist(err) {
+		log.Info().Msg("Generating new host key")
+		current, err = generateHostKey(path)
+		if err != nil && !os.IsExist(err) {
+			log.Warn().
+				Str("error", err.Error()).
+				Msg("Failed to persist private key, identity WILL change if the gatekeeper is restarted")
+			current, _, err = newHostKey()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []gossh.Signer{current}
+	for _, role := range []string{HostKeyNext, HostKeyOld} {
+		signer, err := readHostKey(hostKeyPaths(path)[role])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().
+			Str("role", role).
+			Str("fingerprint", gossh.FingerprintSHA256(signer.PublicKey())).
+			Msg("Imported rotation host key.")
+		keys = append(keys, signer)
+	}
+	return keys, nil
+}
+
+// setHostKeys replaces the served host keys, the first one being used
+// in the handshakes, and updates the published metadatas accordingly.
+func (g *GateKeeper) setHostKeys(keys []gossh.Signer) {
+	published := []string{}
+	for _, key := range keys {
+		published = append(published, authorizedKey(key.PublicKey()))
+	}
+	g.hostKeysLock.Lock()
+	defer g.hostKeysLock.Unlock()
+	g.hostKeys = keys
+	g.Meta.HostKey = published[0]
+	g.Meta.HostKeys = published
+}
+
+// currentHostKeys returns the served host keys, the handshake key first.
+func (g *GateKeeper) currentHostKeys() []gossh.Signer {
+	g.hostKeysLock.RLock()
+	defer g.hostKeysLock.RUnlock()
+	return g.hostKeys
+}
+
+// ReloadHostKeys reads the host key files again and announces the new keys,
+// the established connections are left untouched.
+func (g *GateKeeper) ReloadHostKeys() error {
+	keys, err := loadHostKeys(g.hostKeyPath)
+	if err != nil {
+		return err
+	}
+	g.setHostKeys(keys)
+	log.Info().
+		Str("host_key", gossh.FingerprintSHA256(keys[0].PublicKey())).
+		Int("advertised", len(keys)).
+		Msg("Reloaded host keys.")
+	return g.announce()
+}
+
+// hostKeysConfig returns the SSH configuration of a new connection, serving
+// the host keys of a rotation along with the current key when their algorithms
+// differ (e.g: RSA and ed25519), for the clients knowing only one of them.
+// The current key is added afterwards by the server (see hostSigner),
+// and replaces any other key of the same algorithm.
+func (g *GateKeeper) hostKeysConfig(ctx ssh.Context) *gossh.ServerConfig {
+	config := &gossh.ServerConfig{}
+	keys := g.currentHostKeys()
+	for i := len(keys) - 1; i > 0; i-- {
+		config.AddHostKey(keys[i])
+	}
+	return config
+}
+
+// hostSigner signs the handshakes with the current host key
+// of the gatekeeper, which may change when the keys are reloaded.
+type hostSigner struct {
+	g *GateKeeper
+}
+
+func (s hostSigner) PublicKey() gossh.PublicKey {
+	return s.g.currentHostKeys()[0].PublicKey()
+}
+
+func (s hostSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.g.currentHostKeys()[0].Sign(rand, data)
+}
+
+// advertiseHostKeys sends all the host keys to the client connection,
+// once per connection, for OpenSSH clients to update their known hosts.
+func (g *GateKeeper) advertiseHostKeys(ctx ssh.Context) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok || ctx.Value(hostKeysAdvertised) != nil {
+		return
+	}
+	ctx.SetValue(hostKeysAdvertised, true)
+	payload := []byte{}
+	for _, key := range g.currentHostKeys() {
+		payload = append(payload, gossh.Marshal(&struct{ Key []byte }{key.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(HostKeysRequestType, false, payload); err != nil {
+		log.Debug().
+			Str("error", err.Error()).
+			Msg("Failed to advertise host keys.")
+	}
+}
+
+// hostKeysProveHandler proves the ownership of the advertised host keys,
+// by signing the session identifier with each of the requested keys.
+func (g *GateKeeper) hostKeysProveHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	sessionID, err := hex.DecodeString(ctx.SessionID())
+	if err != nil {
+		return false, nil
+	}
+	keys := g.currentHostKeys()
+	res := []byte{}
+	rest := req.Payload
+	for len(rest) > 0 {
+		blob := struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}{}
+		if err := gossh.Unmarshal(rest, &blob); err != nil {
+			return false, nil
+		}
+		rest = blob.Rest
+		var signer gossh.Signer
+		for _, key := range keys {
+			if bytes.Equal(key.PublicKey().Marshal(), blob.Key) {
+				signer = key
+			}
+		}
+		if signer == nil {
+			return false, nil
+		}
+		sig, err := signer.Sign(rand.Reader, gossh.Marshal(&struct {
+			Type      string
+			SessionID []byte
+			Key       []byte
+		}{HostKeysProveRequestType, sessionID, blob.Key}))
+		if err != nil {
+			return false, nil
+		}
+		res = append(res, gossh.Marshal(&struct{ Sig []byte }{gossh.Marshal(sig)})...)
+	}
+	return true, res
+}
+
+// HostKeyCallback returns a callback accepting any of the host keys
+// published by the gatekeeper, nil if none has been published.
+func (m *Meta) HostKeyCallback() (gossh.HostKeyCallback, error) {
+	published := m.HostKeys
+	if len(published) == 0 && m.HostKey != "" {
+		published = []string{m.HostKey}
+	}
+	if len(published) == 0 {
+		return nil, nil
+	}
+	keys := [][]byte{}
+	for _, raw := range published {
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(raw))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.Marshal())
+	}
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		for _, k := range keys {
+			if bytes.Equal(k, key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %s is not published by the gatekeeper", gossh.FingerprintSHA256(key))
+	}, nil
+}
+
+// ListHostKeys returns the host key files of the rotation at `path`.
+func ListHostKeys(path string) ([]HostKeyFile, error) {
+	res := []HostKeyFile{}
+	for _, role := range []string{HostKeyCurrent, HostKeyNext, HostKeyOld} {
+		keyPath := hostKeyPaths(path)[role]
+		signer, err := readHostKey(keyPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, HostKeyFile{
+			Role:        role,
+			Path:        keyPath,
+			PublicKey:   authorizedKey(signer.PublicKey()),
+			Fingerprint: gossh.FingerprintSHA256(signer.PublicKey()),
+		})
+	}
+	return res, nil
+}
+
+// StageHostKey generates the next host key of the rotation at `path`.
+// Once reloaded, the gatekeeper advertises it alongside the current key.
+func StageHostKey(path string) (*HostKeyFile, error) {
+	if _, err := os.Stat(path + OldHostKeySuffix); err == nil {
+		return nil, errors.New("a previous rotation is not finished")
+	}
+	signer, err := generateHostKey(path + NextHostKeySuffix)
+	if os.IsExist(err) {
+		return nil, errors.New("a host key is already staged")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &HostKeyFile{
+		Role:        HostKeyNext,
+		Path:        path + NextHostKeySuffix,
+		PublicKey:   authorizedKey(signer.PublicKey()),
+		Fingerprint: gossh.FingerprintSHA256(signer.PublicKey()),
+	}, nil
+}
+
+// PromoteHostKey makes the staged host key the current one.
+// Once reloaded, the gatekeeper uses it in the handshakes,
+// and still advertises the previous key.
+func PromoteHostKey(path string) error {
+	if _, err := os.Stat(path + NextHostKeySuffix); err != nil {
+		return errors.New("no host key staged")
+	}
+	if _, err := os.Stat(path + OldHostKeySuffix); err == nil {
+		return errors.New("a previous rotation is not finished")
+	}
+	if err := os.Rename(path, path+OldHostKeySuffix); err != nil {
+		return err
+	}
+	return os.Rename(path+NextHostKeySuffix, path)
+}
+
+// FinishHostKeyRotation removes the previous host key.
+// Once reloaded, the gatekeeper stops advertising it.
+func FinishHostKeyRotation(path string) error {
+	if _, err := os.Stat(path + NextHostKeySuffix); err == nil {
+		return errors.New("the staged host key is not promoted")
+	}
+	err := os.Remove(path + OldHostKeySuffix)
+	if os.IsNotExist(err) {
+		return errors.New("no rotation in progress")
+	}
+	return err
+}
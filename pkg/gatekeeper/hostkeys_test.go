@@ -0,0 +1,134 @@
+package gatekeeper
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// writeLegacyHostKey writes an RSA host key in the format of the previous versions.
+func writeLegacyHostKey(t *testing.T, path string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, x509.MarshalPKCS1PrivateKey(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshakeHostKey returns the host key served to a client accepting only `algo`.
+func handshakeHostKey(t *testing.T, g *GateKeeper, algo string) (gossh.PublicKey, error) {
+	config := g.hostKeysConfig(nil)
+	config.AddHostKey(hostSigner{g})
+	config.NoClientAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		server, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		gossh.NewServerConn(server, config)
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var served gossh.PublicKey
+	_, _, _, err = gossh.NewClientConn(client, "gatekeeper", &gossh.ClientConfig{
+		User:              "test",
+		HostKeyAlgorithms: []string{algo},
+		HostKeyCallback: func(_ string, _ net.Addr, key gossh.PublicKey) error {
+			served = key
+			return nil
+		},
+	})
+	return served, err
+}
+
+func TestHostKeyRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		legacy    bool
+		steps     []func(string) error
+		wantTypes []string
+	}{
+		{"generated", false, nil, []string{gossh.KeyAlgoED25519}},
+		{"legacy key", true, nil, []string{gossh.KeyAlgoRSA}},
+		{
+			"staged",
+			true,
+			[]func(string) error{func(p string) error { _, err := StageHostKey(p); return err }},
+			[]string{gossh.KeyAlgoRSA, gossh.KeyAlgoED25519},
+		},
+		{
+			"promoted",
+			true,
+			[]func(string) error{
+				func(p string) error { _, err := StageHostKey(p); return err },
+				PromoteHostKey,
+			},
+			[]string{gossh.KeyAlgoED25519, gossh.KeyAlgoRSA},
+		},
+		{
+			"finished",
+			true,
+			[]func(string) error{
+				func(p string) error { _, err := StageHostKey(p); return err },
+				PromoteHostKey,
+				FinishHostKeyRotation,
+			},
+			[]string{gossh.KeyAlgoED25519},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "host_key")
+			if tt.legacy {
+				writeLegacyHostKey(t, path)
+			}
+			if _, err := loadHostKeys(path); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				if err := step(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			keys, err := loadHostKeys(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tt.wantTypes) {
+				t.Fatalf("loaded %d host keys, want %d", len(keys), len(tt.wantTypes))
+			}
+			g := &GateKeeper{}
+			g.setHostKeys(keys)
+			for i, key := range keys {
+				if got := key.PublicKey().Type(); got != tt.wantTypes[i] {
+					t.Errorf("host key %d type = %s, want %s", i, got, tt.wantTypes[i])
+				}
+				// Every key of the rotation is served to the clients knowing its algorithm
+				served, err := handshakeHostKey(t, g, tt.wantTypes[i])
+				if err != nil {
+					t.Fatalf("%s handshake: %v", tt.wantTypes[i], err)
+				}
+				if string(served.Marshal()) != string(key.PublicKey().Marshal()) {
+					t.Errorf("%s handshake served another key", tt.wantTypes[i])
+				}
+			}
+		})
+	}
+}
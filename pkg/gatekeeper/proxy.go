@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/rs/zerolog/log"
@@ -13,13 +14,61 @@ import (
 	"github.com/Xide/rssh/pkg/utils"
 )
 
-func (g *GateKeeper) getSlotForDomain(domain string) (*AgentSlot, error) {
-	return g.getFirstSlotForFn(func(sl *AgentSlot) bool {
-		return strings.Compare(sl.Domain, domain) == 0
-	})
+// isDefaultRoot returns true if root is the default root domain,
+// or if the root domains are not configured.
+func (g *GateKeeper) isDefaultRoot(root string) bool {
+	return len(g.roots) == 0 || strings.EqualFold(g.roots[0], root)
 }
 
-func (g *GateKeeper) setupForward(s ssh.Session, slot *AgentSlot) {
+// getSlotForDomain returns the slot of the domain target. The slots allocated
+// before the multiple root domains are only found under the default root.
+func (g *GateKeeper) getSlotForDomain(domain string, root string, target string) (*AgentSlot, error) {
+	slot, ok := g.slots.forDomain(domain+"."+strings.ToLower(root), target)
+	if !ok && g.isDefaultRoot(root) {
+		slot, ok = g.slots.forDomain(domain+".", target)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no slot for target %s of %s.%s", target, domain, root)
+	}
+	return slot, nil
+}
+
+// getSlotForRequest resolves the name requested by a client, the subdomain
+// being everything before the root domain (see utils.SplitDomainRequest).
+// The target is selected either with a `:target` suffix (sub.root:pg), or as
+// the first label of the name (pg.sub.root) when no domain is registered under it.
+// The API refuses to register both a domain and its direct subdomains, so that
+// the second form never matches a domain and the target of another one.
+func (g *GateKeeper) getSlotForRequest(request string) (*AgentSlot, error) {
+	fqdn, target := utils.SplitTargetRequest(request)
+	if len(target) > 0 {
+		subDomain, rootDomain, err := utils.SplitDomainRequest(fqdn, g.roots)
+		if err != nil {
+			return nil, err
+		}
+		return g.getSlotForDomain(subDomain, rootDomain, target)
+	}
+	subDomain, rootDomain, err := utils.SplitDomainRequest(fqdn, g.roots)
+	if err == nil {
+		var slot *AgentSlot
+		if slot, err = g.getSlotForDomain(subDomain, rootDomain, DefaultTarget); err == nil {
+			return slot, nil
+		}
+	}
+	labels := strings.SplitN(fqdn, ".", 2)
+	if len(labels) < 2 {
+		return nil, err
+	}
+	targetDomain, targetRoot, serr := utils.SplitDomainRequest(labels[1], g.roots)
+	if serr != nil {
+		return nil, err
+	}
+	return g.getSlotForDomain(targetDomain, targetRoot, labels[0])
+}
+
+// setupForward bridges the client session with the agent slot until either
+// side closes the connection, and completes the audit record.
+func (g *GateKeeper) setupForward(s ssh.Session, slot *AgentSlot, record *AuditRecord) string {
 	// 127.0.0.1 is assumed here as we can only have one
 	// active gatekeeper at the same time.
 	backendAddr := fmt.Sprintf("127.0.0.1:%d", slot.Port)
@@ -30,37 +79,46 @@ func (g *GateKeeper) setupForward(s ssh.Session, slot *AgentSlot) {
 			Str("destination", backendAddr).
 			Str("error", err.Error()).
 			Msg("Failed to dial backend.")
-		return
+		return ReasonBackendUnreachable
 	}
 	log.Debug().
 		Str("domain", slot.Domain).
 		Str("destination", backendAddr).
 		Msg("Connected to backend, starting forward.")
+	agentDone := make(chan struct{})
+	clientDone := make(chan struct{})
 	go func() {
-		defer s.Close()
-		defer conn.Close()
-		io.Copy(s, conn)
+		defer close(agentDone)
+		record.BytesOut, _ = io.Copy(s, conn)
 		log.Debug().
 			Str("domain", slot.Domain).
 			Str("destination", backendAddr).
 			Msg("Agent side socket interrupted")
 	}()
 	go func() {
-		defer s.Close()
-		defer conn.Close()
-		io.Copy(conn, s)
+		defer close(clientDone)
+		record.BytesIn, _ = io.Copy(conn, s)
 		log.Debug().
 			Str("domain", slot.Domain).
 			Str("destination", backendAddr).
 			Msg("Client side socket interrupted")
 	}()
+	reason := ReasonClientClosed
 	select {
 	case <-s.Context().Done():
-		log.Debug().
-			Str("domain", slot.Domain).
-			Str("destination", backendAddr).
-			Msg("Proxy command finished.")
+	case <-clientDone:
+	case <-agentDone:
+		reason = ReasonAgentClosed
 	}
+	s.Close()
+	conn.Close()
+	<-agentDone
+	<-clientDone
+	log.Debug().
+		Str("domain", slot.Domain).
+		Str("destination", backendAddr).
+		Msg("Proxy command finished.")
+	return reason
 }
 
 func parseRequestedDomain(s ssh.Session) (string, error) {
@@ -74,22 +132,55 @@ func parseRequestedDomain(s ssh.Session) (string, error) {
 
 func (g *GateKeeper) proxyCommandHandler() func(ssh.Session) {
 	return func(s ssh.Session) {
+		record := newAuditRecord(s)
+		if !g.track(&g.sessions) {
+			io.WriteString(s, "Gatekeeper is shutting down, retry later.")
+			g.recordSession(record, ReasonShutdown)
+			return
+		}
+		defer g.sessions.Done()
+		atomic.AddInt64(&g.activeSessions, 1)
+		defer atomic.AddInt64(&g.activeSessions, -1)
+		g.advertiseHostKeys(s.Context().(ssh.Context))
 		destDomain, err := parseRequestedDomain(s)
-		subDomain, _ := utils.SplitDomainRequest(destDomain)
 		if err != nil {
 			io.WriteString(s, fmt.Sprintf("Unsupported connection request."))
+			g.recordSession(record, ReasonUnsupported)
 			return
 		}
+		record.Request = destDomain
 		log.Debug().Str("domain", destDomain).Msg("Client requested proxy")
-		slot, err := g.getSlotForDomain(subDomain)
+		slot, err := g.getSlotForRequest(destDomain)
 		if err != nil {
 			log.Warn().
 				Str("error", err.Error()).
-				Str("domain", subDomain).
+				Str("domain", destDomain).
 				Msg("Domain not found")
 			io.WriteString(s, fmt.Sprintf("Domain %s not found.", destDomain))
+			g.recordSession(record, ReasonNotFound)
+			return
+		}
+		record.withSlot(slot)
+		// Clients of slots with allowed keys must have signed in with one
+		// of them, the keyboard interactive method is refused.
+		if !slot.IsAllowed(authenticatedKey(s.Context().(ssh.Context))) {
+			log.Warn().
+				Str("domain", slot.Domain).
+				Str("client_addr", s.RemoteAddr().String()).
+				Msg("Client key not allowed for domain.")
+			io.WriteString(s, fmt.Sprintf("Access to domain %s denied.", destDomain))
+			g.recordSession(record, ReasonDenied)
+		} else if !slot.IsHealthy() {
+			log.Warn().
+				Str("domain", slot.Domain).
+				Str("target", slot.TargetName()).
+				Msg("Target backend is down.")
+			io.WriteString(s, fmt.Sprintf("Target %s is registered but its backend is down.", destDomain))
+			g.recordSession(record, ReasonBackendDown)
+		} else if g.isRecorded(slot) {
+			g.recordSession(record, g.terminateSession(s, slot, record))
 		} else {
-			g.setupForward(s, slot)
+			g.recordSession(record, g.setupForward(s, slot, record))
 		}
 	}
 }
@@ -0,0 +1,59 @@
+package gatekeeper
+
+import "testing"
+
+func TestGetSlotForRequest(t *testing.T) {
+	slots := []*AgentSlot{
+		{Port: 2000, Domain: "db", Root: "example.com"},
+		{Port: 2001, Domain: "db", Root: "example.com", Target: "pg"},
+		{Port: 2002, Domain: "db-1.prod", Root: "example.com"},
+		{Port: 2003, Domain: "db-1.prod", Root: "example.com", Target: "web"},
+		{Port: 2004, Domain: "db", Root: "other.example"},
+		// Allocated before the multiple root domains
+		{Port: 2005, Domain: "legacy"},
+	}
+	tests := []struct {
+		name     string
+		roots    []string
+		request  string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{"domain", nil, "db.example.com", 2000, false},
+		{"target suffix", nil, "db.example.com:pg", 2001, false},
+		{"target label", nil, "pg.db.example.com", 2001, false},
+		{"unknown target", nil, "db.example.com:redis", 0, true},
+		{"unknown target label", nil, "redis.db.example.com", 0, true},
+		{"unknown domain", nil, "web.example.com", 0, true},
+		{"ambiguous without roots", nil, "db-1.prod.example.com", 0, true},
+		{"multiple levels", []string{"example.com"}, "db-1.prod.example.com", 2002, false},
+		{"multiple levels target suffix", []string{"example.com"}, "db-1.prod.example.com:web", 2003, false},
+		{"multiple levels target label", []string{"example.com"}, "web.db-1.prod.example.com", 2003, false},
+		{"other root", []string{"example.com", "other.example"}, "db.other.example", 2004, false},
+		{"case insensitive root", []string{"example.com"}, "db.Example.COM", 2000, false},
+		{"legacy slot under the default root", []string{"example.com"}, "legacy.example.com", 2005, false},
+		{"legacy slot under another root", []string{"example.com", "other.example"}, "legacy.other.example", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GateKeeper{slots: newSlotCache()}
+			g.WithRootDomains(tt.roots)
+			for i, slot := range slots {
+				g.slots.set(slot, uint64(i+1))
+			}
+			slot, err := g.getSlotForRequest(tt.request)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got slot %d", slot.Port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slot.Port != tt.wantPort {
+				t.Errorf("slot = %d, want %d", slot.Port, tt.wantPort)
+			}
+		})
+	}
+}
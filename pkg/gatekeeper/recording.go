@@ -0,0 +1,422 @@
+package gatekeeper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/Xide/rssh/pkg/asciicast"
+)
+
+const backendTimeout = 10 * time.Second
+
+var errBackendUnreachable = errors.New("backend unreachable")
+
+// loadRecordingKey loads the ed25519 seed at `path`, or generates it if
+// the file does not exist. RSA keys are only usable with SHA-1 signatures
+// by this SSH implementation, which are refused by recent OpenSSH versions.
+func loadRecordingKey(path string) (gossh.Signer, error) {
+	seed, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Info().Str("path", path).Msg("Generating new recording key")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed = key.Seed()
+		if err := ioutil.WriteFile(path, seed, 0600); err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Msg("Failed to persist recording key, identity WILL change if the gatekeeper is restarted")
+		}
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid recording key")
+	}
+	return gossh.NewSignerFromKey(ed25519.NewKeyFromSeed(seed))
+}
+
+// WithRecording enables the recording of the sessions to the subdomains matching
+// one of the `domains` patterns (e.g: `prod-*`), as asciicast files in `dir`.
+// The key at `keyFile` is the host key presented to the clients of recorded
+// domains, and the key used to log in to their backends (see terminateSession).
+// The client input is only recorded if `input` is set, as it may contain
+// secrets typed without echo.
+func (g *GateKeeper) WithRecording(dir string, keyFile string, domains []string, input bool) error {
+	for _, pattern := range domains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid recorded domain pattern %s", pattern)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := loadRecordingKey(keyFile)
+	if err != nil {
+		return err
+	}
+	g.recordDir = dir
+	g.recordDomains = domains
+	g.recordKey = key
+	g.recordInput = input
+	g.Meta.RecordingKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key.PublicKey())))
+	log.Info().
+		Str("directory", dir).
+		Strs("domains", domains).
+		Bool("input", input).
+		Str("key", g.Meta.RecordingKey).
+		Msg("Session recording enabled.")
+	return nil
+}
+
+// isRecorded returns true if the sessions to the slot domain must be recorded.
+func (g *GateKeeper) isRecorded(slot *AgentSlot) bool {
+	for _, pattern := range g.recordDomains {
+		if ok, _ := path.Match(pattern, slot.Domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionConn exposes the proxy session as a network connection,
+// on which the client SSH connection is terminated.
+type sessionConn struct {
+	ssh.Session
+	read    int64
+	written int64
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	n, err := c.Session.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Write(p []byte) (int, error) {
+	n, err := c.Session.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *sessionConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sessionConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sessionConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dialBackend opens an SSH connection to the agent backend of the slot.
+func (g *GateKeeper) dialBackend(slot *AgentSlot, user string, auth gossh.AuthMethod) (*gossh.Client, error) {
+	addr := fmt.Sprintf("127.0.0.1:%d", slot.Port)
+	conn, err := net.DialTimeout("tcp", addr, backendTimeout)
+	if err != nil {
+		log.Warn().
+			Str("domain", slot.Domain).
+			Str("destination", addr).
+			Str("error", err.Error()).
+			Msg("Failed to dial backend.")
+		return nil, errBackendUnreachable
+	}
+	c, chans, reqs, err := gossh.NewClientConn(conn, addr, &gossh.ClientConfig{
+		User: user,
+		Auth: []gossh.AuthMethod{auth},
+		// The backend is only reachable through the agent tunnel,
+		// its key is logged for the audit trail.
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			log.Debug().
+				Str("domain", slot.Domain).
+				Str("fingerprint", gossh.FingerprintSHA256(key)).
+				Msg("Backend host key.")
+			return nil
+		},
+		Timeout: backendTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
+
+// terminateSession terminates the client SSH connection at the gatekeeper,
+// and relays its sessions to a new SSH connection to the backend, recording them.
+// Password and keyboard-interactive authentications are relayed to the backend.
+// Clients authenticated by one of the domain allowed keys are logged in
+// to the backend with the recording key.
+func (g *GateKeeper) terminateSession(s ssh.Session, slot *AgentSlot, record *AuditRecord) string {
+	conn := &sessionConn{Session: s}
+	var (
+		lock        sync.Mutex
+		backend     *gossh.Client
+		unreachable bool
+	)
+	authenticated := func(c *gossh.Client, err error) (*gossh.Permissions, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			unreachable = err == errBackendUnreachable
+			return nil, err
+		}
+		backend = c
+		return &gossh.Permissions{}, nil
+	}
+	config := &gossh.ServerConfig{
+		PasswordCallback: func(c gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			return authenticated(g.dialBackend(slot, c.User(), gossh.Password(string(password))))
+		},
+		KeyboardInteractiveCallback: func(c gossh.ConnMetadata, challenge gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			return authenticated(g.dialBackend(slot, c.User(), gossh.KeyboardInteractive(
+				func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					return challenge(user, instruction, questions, echos)
+				},
+			)))
+		},
+		PublicKeyCallback: func(c gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			// Without a restriction, anyone would be logged in with the recording key
+			if len(slot.AllowedKeys) == 0 || !slot.IsAllowed(key) {
+				return nil, errors.New("public key not allowed")
+			}
+			return &gossh.Permissions{
+				Extensions: map[string]string{"fingerprint": gossh.FingerprintSHA256(key)},
+			}, nil
+		},
+	}
+	config.AddHostKey(g.recordKey)
+
+	sconn, chans, reqs, err := gossh.NewServerConn(conn, config)
+	record.BytesIn, record.BytesOut = atomic.LoadInt64(&conn.read), atomic.LoadInt64(&conn.written)
+	if err != nil {
+		lock.Lock()
+		defer lock.Unlock()
+		if backend != nil {
+			backend.Close()
+		}
+		log.Warn().
+			Str("domain", slot.Domain).
+			Str("error", err.Error()).
+			Msg("Recorded session handshake failed.")
+		if unreachable {
+			return ReasonBackendUnreachable
+		}
+		return ReasonDenied
+	}
+	defer sconn.Close()
+	go gossh.DiscardRequests(reqs)
+
+	lock.Lock()
+	if backend == nil {
+		// Public key authentication, the client key has been verified
+		backend, err = g.dialBackend(slot, sconn.User(), gossh.PublicKeys(g.recordKey))
+	}
+	lock.Unlock()
+	if err != nil {
+		log.Warn().
+			Str("domain", slot.Domain).
+			Str("user", sconn.User()).
+			Str("error", err.Error()).
+			Msg("Backend refused the recording key.")
+		if err == errBackendUnreachable {
+			return ReasonBackendUnreachable
+		}
+		return ReasonDenied
+	}
+	defer backend.Close()
+	record.User = sconn.User()
+
+	var agentClosed int32
+	go func() {
+		backend.Wait()
+		atomic.StoreInt32(&agentClosed, 1)
+		sconn.Close()
+	}()
+
+	dir := filepath.Join(g.recordDir, slot.Domain)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Str("directory", dir).
+			Msg("Could not create recordings directory.")
+		return ReasonDenied
+	}
+	var wg sync.WaitGroup
+	prefix := fmt.Sprintf("%s-%s", record.Start.Format("20060102T150405Z"), hex.EncodeToString(sconn.SessionID()[:4]))
+	n := 0
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(gossh.Prohibited, "only sessions are allowed on recorded domains")
+			continue
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%s-%d.cast", prefix, n))
+		n++
+		record.Recordings = append(record.Recordings, file)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.relaySession(nc, backend, file, fmt.Sprintf("%s@%s", sconn.User(), record.Request))
+		}()
+	}
+	backend.Close()
+	wg.Wait()
+	record.BytesIn, record.BytesOut = atomic.LoadInt64(&conn.read), atomic.LoadInt64(&conn.written)
+	if atomic.LoadInt32(&agentClosed) == 1 {
+		return ReasonAgentClosed
+	}
+	return ReasonClientClosed
+}
+
+// SSH requests payloads
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+type execRequest struct {
+	Command string
+}
+
+// recordRequest updates the recording with the session request.
+func recordRequest(cast *asciicast.Writer, req *gossh.Request) {
+	switch req.Type {
+	case "pty-req":
+		pty := ptyRequest{}
+		if gossh.Unmarshal(req.Payload, &pty) == nil {
+			cast.Update(func(h *asciicast.Header) {
+				// Clients without a terminal send a 0x0 size
+				if pty.Columns > 0 && pty.Rows > 0 {
+					h.Width, h.Height = int(pty.Columns), int(pty.Rows)
+				}
+				h.Env = map[string]string{"TERM": pty.Term}
+			})
+		}
+	case "window-change":
+		wc := windowChangeRequest{}
+		if gossh.Unmarshal(req.Payload, &wc) == nil {
+			if !cast.Update(func(h *asciicast.Header) {
+				h.Width, h.Height = int(wc.Columns), int(wc.Rows)
+			}) {
+				cast.Resize(int(wc.Columns), int(wc.Rows))
+			}
+		}
+	case "exec", "subsystem":
+		exec := execRequest{}
+		if gossh.Unmarshal(req.Payload, &exec) == nil {
+			cast.Update(func(h *asciicast.Header) {
+				h.Command = exec.Command
+			})
+		}
+		cast.Start()
+	case "shell":
+		cast.Start()
+	}
+}
+
+// relaySession bridges a client session with a new backend session,
+// recording the terminal output in `file`, and the input if enabled.
+func (g *GateKeeper) relaySession(nc gossh.NewChannel, backend *gossh.Client, file string, title string) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error().
+			Str("error", err.Error()).
+			Str("file", file).
+			Msg("Could not create session recording.")
+		nc.Reject(gossh.ResourceShortage, "session recording unavailable")
+		return
+	}
+	defer f.Close()
+	bch, breqs, err := backend.OpenChannel("session", nc.ExtraData())
+	if err != nil {
+		nc.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	cch, creqs, err := nc.Accept()
+	if err != nil {
+		bch.Close()
+		return
+	}
+	cast := asciicast.NewWriter(f)
+	cast.Update(func(h *asciicast.Header) {
+		h.Title = title
+	})
+	log.Info().
+		Str("file", file).
+		Str("title", title).
+		Msg("Recording session.")
+
+	go func() {
+		for req := range creqs {
+			switch req.Type {
+			case "auth-agent-req@openssh.com", "x11-req":
+				// Channels opened by the backend are not relayed
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+			recordRequest(cast, req)
+			ok, err := bch.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, nil)
+			}
+		}
+		bch.Close()
+	}()
+	backendDone := make(chan struct{})
+	go func() {
+		defer close(backendDone)
+		for req := range breqs {
+			ok, err := cch.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, nil)
+			}
+		}
+	}()
+	go func() {
+		var input io.Reader = cch
+		if g.recordInput {
+			input = io.TeeReader(cch, cast.InputWriter())
+		}
+		io.Copy(bch, input)
+		bch.CloseWrite()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(cch, io.TeeReader(bch, cast.OutputWriter()))
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(cch.Stderr(), io.TeeReader(bch.Stderr(), cast.OutputWriter()))
+	}()
+	wg.Wait()
+	cch.CloseWrite()
+	// Exit status is sent before the backend closes the channel
+	<-backendDone
+	cch.Close()
+	log.Debug().Str("file", file).Msg("Session recording finished.")
+}
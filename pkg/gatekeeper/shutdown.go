@@ -0,0 +1,153 @@
+package gatekeeper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/etcd/client"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ReconnectRequestType is the global request sent to the agents
+// before the gatekeeper closes their connection on shutdown.
+const ReconnectRequestType = "reconnect@rssh"
+
+// ReconnectHint is the payload of a ReconnectRequestType request.
+type ReconnectHint struct {
+	// Seconds to wait before reconnecting, for the next instance to start
+	Delay uint32
+}
+
+const (
+	// Delay hinted to the agents before reconnecting
+	reconnectDelay = 5 * time.Second
+	// Maximum time spent removing the slots of the closed agent connections
+	cleanupTimeout = 5 * time.Second
+)
+
+// track adds a running task to `wg`, unless the gatekeeper is draining.
+func (g *GateKeeper) track(wg *sync.WaitGroup) bool {
+	g.drainLock.Lock()
+	defer g.drainLock.Unlock()
+	if g.draining {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+// trackConn records the agent connection forwarding slots,
+// to send it a reconnect hint on shutdown.
+func (g *GateKeeper) trackConn(ctx ssh.Context) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+	g.boundLock.Lock()
+	defer g.boundLock.Unlock()
+	if g.conns == nil {
+		g.conns = map[string]gossh.Conn{}
+	}
+	g.conns[ctx.SessionID()] = conn
+}
+
+// waitGroup waits for `wg` until the context is done,
+// and returns false if it has not completed.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// hintAgents asks the connected agents to reconnect after reconnectDelay.
+func (g *GateKeeper) hintAgents() {
+	g.boundLock.Lock()
+	defer g.boundLock.Unlock()
+	payload := gossh.Marshal(&ReconnectHint{Delay: uint32(reconnectDelay / time.Second)})
+	for _, conn := range g.conns {
+		if _, _, err := conn.SendRequest(ReconnectRequestType, false, payload); err != nil {
+			log.Debug().
+				Str("error", err.Error()).
+				Str("agent_addr", conn.RemoteAddr().String()).
+				Msg("Failed to send reconnect hint.")
+		}
+	}
+	log.Info().Int("agents", len(g.conns)).Msg("Sent reconnect hint to agents.")
+}
+
+// withdraw removes the gatekeeper metadatas from etcd,
+// unless they have been overwritten by another instance.
+func (g *GateKeeper) withdraw() {
+	if g.announced == 0 {
+		return
+	}
+	_, err := (*g.etcd).Delete(
+		context.Background(),
+		"/meta/gatekeeper",
+		&client.DeleteOptions{PrevIndex: g.announced},
+	)
+	if err != nil {
+		log.Warn().
+			Str("error", err.Error()).
+			Msg("Gatekeeper metadatas not withdrawn.")
+		return
+	}
+	log.Info().Msg("Gatekeeper unregistered from etcd.")
+}
+
+// Shutdown drains the gatekeeper: new client sessions and agent forwards are
+// refused, and the active client sessions are awaited until the context is done.
+// The agents are then asked to reconnect later, their connections are closed
+// and their slots removed from etcd along with the gatekeeper metadatas.
+func (g *GateKeeper) Shutdown(ctx context.Context) error {
+	g.drainLock.Lock()
+	g.draining = true
+	wsServer := g.wsServer
+	healthServer := g.healthServer
+	g.drainLock.Unlock()
+	log.Info().Msg("Draining gatekeeper.")
+
+	if g.srv != nil {
+		// The server shutdown closes the listeners, then waits for all the
+		// connections, agents included, until they are closed below.
+		go g.srv.Shutdown(context.Background())
+	}
+	if wsServer != nil {
+		wsServer.Close()
+	}
+	if waitGroup(ctx, &g.sessions) {
+		log.Info().Msg("All client sessions finished.")
+	} else {
+		log.Warn().Msg("Drain deadline reached, closing the remaining client sessions.")
+	}
+
+	g.hintAgents()
+	if g.srv != nil {
+		g.srv.Close()
+	}
+	cleanup, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if !waitGroup(cleanup, &g.collectors) {
+		log.Warn().Msg("Some agent slots were not removed from etcd.")
+	}
+	g.withdraw()
+	g.slots.close()
+	if g.audit != nil {
+		g.audit.Close()
+	}
+	if healthServer != nil {
+		healthServer.Close()
+	}
+	return nil
+}
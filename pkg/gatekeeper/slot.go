@@ -4,17 +4,75 @@ import (
 	"errors"
 	"strings"
 
+	"github.com/gliderlabs/ssh"
 	"github.com/rs/zerolog/log"
 )
 
+// DefaultTarget is the name of the target selected
+// when the client does not request one explicitly.
+const DefaultTarget = "default"
+
 // AgentSlot represents a pending or active authorized connection
 // to the GateKeeper.
 type AgentSlot struct {
 	// Subdomain on which the agent is registered
-	Domain      string `json:"domain"`
+	Domain string `json:"domain"`
+	// Root domain of the subdomain, empty for the slots
+	// allocated before the multiple root domains
+	Root        string `json:"root,omitempty"`
 	Port        uint16 `json:"port"`
 	AgentID     string `json:"agentID"`
 	Established bool   `json:"established"`
+	// Authorized keys allowed to connect, empty means everyone
+	AllowedKeys []string `json:"allowedKeys,omitempty"`
+	// Name of the agent target bound to this slot, empty means DefaultTarget
+	Target string `json:"target,omitempty"`
+	// Last health reported by the agent for the target, nil if unknown
+	Healthy *bool `json:"healthy,omitempty"`
+}
+
+// IsHealthy returns false only if the agent reported the target as down.
+func (s *AgentSlot) IsHealthy() bool {
+	return s.Healthy == nil || *s.Healthy
+}
+
+// FQDN returns the complete domain of the slot, ending with a dot
+// for the slots allocated before the multiple root domains.
+func (s *AgentSlot) FQDN() string {
+	return s.Domain + "." + strings.ToLower(s.Root)
+}
+
+// TargetName returns the name of the target bound to this slot.
+func (s *AgentSlot) TargetName() string {
+	if len(s.Target) == 0 {
+		return DefaultTarget
+	}
+	return s.Target
+}
+
+// IsAllowed returns true if the client key is authorized
+// to connect to this slot.
+func (s *AgentSlot) IsAllowed(key ssh.PublicKey) bool {
+	if len(s.AllowedKeys) == 0 {
+		return true
+	}
+	if key == nil {
+		return false
+	}
+	for _, k := range s.AllowedKeys {
+		allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("domain", s.Domain).
+				Msg("Ignoring invalid allowed key.")
+			continue
+		}
+		if ssh.KeysEqual(allowed, key) {
+			return true
+		}
+	}
+	return false
 }
 
 func (g *GateKeeper) allocateAgentSlot(domain string) (*AgentSlot, error) {
@@ -0,0 +1,37 @@
+package gatekeeper
+
+import (
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAgentSlotIsAllowed(t *testing.T) {
+	allowed := newTestSigner(t).PublicKey()
+	other := newTestSigner(t).PublicKey()
+	allowedKeys := []string{
+		"not a key",
+		strings.TrimSpace(string(gossh.MarshalAuthorizedKey(allowed))),
+	}
+	tests := []struct {
+		name        string
+		allowedKeys []string
+		key         gossh.PublicKey
+		want        bool
+	}{
+		{"open slot, keyboard interactive", nil, nil, true},
+		{"open slot, any key", nil, other, true},
+		{"allowed key", allowedKeys, allowed, true},
+		{"other key", allowedKeys, other, false},
+		{"keyboard interactive", allowedKeys, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot := &AgentSlot{Domain: "test", AllowedKeys: tt.allowedKeys}
+			if got := slot.IsAllowed(tt.key); got != tt.want {
+				t.Errorf("IsAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
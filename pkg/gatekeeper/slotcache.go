@@ -0,0 +1,263 @@
+package gatekeeper
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/etcd/client"
+)
+
+// SlotFSKey is the etcd directory of the agent slots, by port.
+const SlotFSKey = "/gatekeeper/slotfs"
+
+// Delay before watching the slotFS again after an error
+const watchRetryDelay = time.Second
+
+// slotCache is an in-memory index of the slotFS by port and by FQDN,
+// loaded once and kept up to date from an etcd watch.
+// The slots are indexed along with the etcd index of their last
+// modification, so that a write of the gatekeeper recorded before
+// its watch event is not overwritten by older events.
+type slotCache struct {
+	lock     sync.RWMutex
+	byPort   map[uint16]*cachedSlot
+	byDomain map[string]map[string]*cachedSlot
+	// Etcd index of the deleted slots
+	deleted map[uint16]uint64
+	// Etcd index the cache is synchronized with
+	index uint64
+	stop  context.CancelFunc
+}
+
+type cachedSlot struct {
+	slot  AgentSlot
+	index uint64
+}
+
+func newSlotCache() *slotCache {
+	return &slotCache{
+		byPort:   map[uint16]*cachedSlot{},
+		byDomain: map[string]map[string]*cachedSlot{},
+		deleted:  map[uint16]uint64{},
+	}
+}
+
+func slotPort(key string) (uint16, error) {
+	port, err := strconv.ParseUint(path.Base(key), 10, 16)
+	return uint16(port), err
+}
+
+// put indexes the slot modified at the etcd `index`,
+// unless the cache already holds a more recent state.
+// The caller must hold the lock.
+func (c *slotCache) put(slot *AgentSlot, index uint64) {
+	if current, ok := c.byPort[slot.Port]; ok {
+		if current.index > index {
+			return
+		}
+		c.unindex(current)
+	} else if c.deleted[slot.Port] > index {
+		return
+	}
+	delete(c.deleted, slot.Port)
+	entry := &cachedSlot{slot: *slot, index: index}
+	c.byPort[slot.Port] = entry
+	if c.byDomain[slot.FQDN()] == nil {
+		c.byDomain[slot.FQDN()] = map[string]*cachedSlot{}
+	}
+	c.byDomain[slot.FQDN()][slot.TargetName()] = entry
+}
+
+// remove drops the slot bound to `port`, deleted at the etcd `index`.
+// The caller must hold the lock.
+func (c *slotCache) remove(port uint16, index uint64) {
+	if current, ok := c.byPort[port]; ok {
+		if current.index > index {
+			return
+		}
+		c.unindex(current)
+		delete(c.byPort, port)
+	}
+	c.deleted[port] = index
+}
+
+// unindex removes the domain index entry of the slot.
+// The caller must hold the lock.
+func (c *slotCache) unindex(entry *cachedSlot) {
+	targets := c.byDomain[entry.slot.FQDN()]
+	if targets[entry.slot.TargetName()] == entry {
+		delete(targets, entry.slot.TargetName())
+	}
+	if len(targets) == 0 {
+		delete(c.byDomain, entry.slot.FQDN())
+	}
+}
+
+// set indexes a slot written by the gatekeeper, without waiting for the watch.
+func (c *slotCache) set(slot *AgentSlot, index uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.put(slot, index)
+}
+
+// forPort returns a copy of the slot bound to `port`.
+func (c *slotCache) forPort(port uint16) (*AgentSlot, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.byPort[port]
+	if !ok {
+		return nil, false
+	}
+	slot := entry.slot
+	return &slot, true
+}
+
+// forDomain returns a copy of the slot of the domain target (see AgentSlot.FQDN).
+func (c *slotCache) forDomain(fqdn string, target string) (*AgentSlot, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.byDomain[fqdn][target]
+	if !ok {
+		return nil, false
+	}
+	slot := entry.slot
+	return &slot, true
+}
+
+// load replaces the cache content with the slotFS.
+func (c *slotCache) load(etcd client.KeysAPI) error {
+	resp, err := etcd.Get(context.Background(), SlotFSKey, &client.GetOptions{Quorum: true})
+	var nodes client.Nodes
+	var index uint64
+	if err != nil {
+		cerr, ok := err.(client.Error)
+		if !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+			return err
+		}
+		index = cerr.Index
+	} else {
+		nodes = resp.Node.Nodes
+		index = resp.Index
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.byPort = map[uint16]*cachedSlot{}
+	c.byDomain = map[string]map[string]*cachedSlot{}
+	c.deleted = map[uint16]uint64{}
+	c.index = index
+	for _, node := range nodes {
+		if node.Dir {
+			continue
+		}
+		slot := &AgentSlot{}
+		if err := json.Unmarshal([]byte(node.Value), slot); err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("key", node.Key).
+				Msg("Unable to deserialize slot from etcd.")
+			continue
+		}
+		c.put(slot, node.ModifiedIndex)
+	}
+	log.Debug().
+		Int("slots", len(c.byPort)).
+		Uint64("index", index).
+		Msg("Loaded slotFS cache.")
+	return nil
+}
+
+// apply updates the cache with a watch event. The watch resumes after the
+// index of the event: the index of the response is the etcd index when the
+// watch started, which can be ahead of the events still queued.
+func (c *slotCache) apply(resp *client.Response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	node := resp.Node
+	if node.ModifiedIndex > c.index {
+		c.index = node.ModifiedIndex
+	}
+	switch resp.Action {
+	case "set", "create", "update", "compareAndSwap":
+		if node.Dir {
+			return
+		}
+		slot := &AgentSlot{}
+		if err := json.Unmarshal([]byte(node.Value), slot); err != nil {
+			log.Warn().
+				Str("error", err.Error()).
+				Str("key", node.Key).
+				Msg("Unable to deserialize slot from etcd.")
+			return
+		}
+		c.put(slot, node.ModifiedIndex)
+	case "delete", "expire", "compareAndDelete":
+		if node.Key == SlotFSKey {
+			for port := range c.byPort {
+				c.remove(port, node.ModifiedIndex)
+			}
+			return
+		}
+		port, err := slotPort(node.Key)
+		if err != nil {
+			return
+		}
+		c.remove(port, node.ModifiedIndex)
+	}
+}
+
+// run loads the slotFS and follows its changes until the cache is closed.
+func (c *slotCache) run(etcd client.KeysAPI) error {
+	if err := c.load(etcd); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop = cancel
+	go c.watch(ctx, etcd)
+	return nil
+}
+
+func (c *slotCache) watch(ctx context.Context, etcd client.KeysAPI) {
+	for {
+		c.lock.RLock()
+		index := c.index
+		c.lock.RUnlock()
+		watcher := etcd.Watcher(SlotFSKey, &client.WatcherOptions{
+			AfterIndex: index,
+			Recursive:  true,
+		})
+		for {
+			resp, err := watcher.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
+					// The watch fell behind the etcd history, start over.
+					log.Debug().Msg("SlotFS watch index cleared, reloading the cache.")
+					err = c.load(etcd)
+				}
+				if err != nil {
+					log.Warn().
+						Str("error", err.Error()).
+						Msg("SlotFS watch interrupted.")
+					time.Sleep(watchRetryDelay)
+				}
+				break
+			}
+			c.apply(resp)
+		}
+	}
+}
+
+// close stops following the slotFS changes.
+func (c *slotCache) close() {
+	if c.stop != nil {
+		c.stop()
+	}
+}
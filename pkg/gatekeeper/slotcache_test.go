@@ -0,0 +1,298 @@
+package gatekeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.etcd.io/etcd/client"
+
+	"github.com/Xide/rssh/pkg/utils/etcdtest"
+)
+
+func testSlot(port uint16, domain string, agentID string) *AgentSlot {
+	return &AgentSlot{Domain: domain, Root: "example.com", Port: port, AgentID: agentID}
+}
+
+func slotEvent(action string, slot *AgentSlot, index uint64) *client.Response {
+	payload, _ := json.Marshal(slot)
+	return &client.Response{
+		Action: action,
+		Index:  index,
+		Node: &client.Node{
+			Key:           fmt.Sprintf("%s/%d", SlotFSKey, slot.Port),
+			Value:         string(payload),
+			ModifiedIndex: index,
+		},
+	}
+}
+
+func TestSlotCacheOrdering(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(c *slotCache)
+		// Agent bound to port 2000 and to the sub domain, empty if none
+		want string
+	}{
+		{
+			"put",
+			func(c *slotCache) { c.set(testSlot(2000, "sub", "a"), 5) },
+			"a",
+		},
+		{
+			"newer put",
+			func(c *slotCache) {
+				c.set(testSlot(2000, "sub", "a"), 5)
+				c.set(testSlot(2000, "sub", "b"), 6)
+			},
+			"b",
+		},
+		{
+			"older put is ignored",
+			func(c *slotCache) {
+				c.set(testSlot(2000, "sub", "b"), 6)
+				c.set(testSlot(2000, "sub", "a"), 5)
+			},
+			"b",
+		},
+		{
+			"remove",
+			func(c *slotCache) {
+				c.set(testSlot(2000, "sub", "a"), 5)
+				c.apply(slotEvent("delete", testSlot(2000, "sub", ""), 6))
+			},
+			"",
+		},
+		{
+			"older remove is ignored",
+			func(c *slotCache) {
+				c.set(testSlot(2000, "sub", "a"), 6)
+				c.apply(slotEvent("delete", testSlot(2000, "sub", ""), 5))
+			},
+			"a",
+		},
+		{
+			"put older than a remove is ignored",
+			func(c *slotCache) {
+				c.apply(slotEvent("delete", testSlot(2000, "sub", ""), 6))
+				c.apply(slotEvent("set", testSlot(2000, "sub", "a"), 5))
+			},
+			"",
+		},
+		{
+			"put after a remove",
+			func(c *slotCache) {
+				c.apply(slotEvent("delete", testSlot(2000, "sub", ""), 5))
+				c.apply(slotEvent("create", testSlot(2000, "sub", "a"), 6))
+			},
+			"a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSlotCache()
+			tt.ops(c)
+			byPort, okPort := c.forPort(2000)
+			byDomain, okDomain := c.forDomain("sub.example.com", DefaultTarget)
+			if tt.want == "" {
+				if okPort || okDomain {
+					t.Errorf("slot still indexed (port %v, domain %v)", okPort, okDomain)
+				}
+				return
+			}
+			if !okPort || byPort.AgentID != tt.want {
+				t.Errorf("forPort() = %v, want agent %s", byPort, tt.want)
+			}
+			if !okDomain || byDomain.AgentID != tt.want {
+				t.Errorf("forDomain() = %v, want agent %s", byDomain, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotCacheDomainMove(t *testing.T) {
+	c := newSlotCache()
+	c.set(testSlot(2000, "old", "a"), 5)
+	c.set(testSlot(2000, "new", "a"), 6)
+	if _, ok := c.forDomain("old.example.com", DefaultTarget); ok {
+		t.Error("the previous domain of the slot is still indexed")
+	}
+	if _, ok := c.forDomain("new.example.com", DefaultTarget); !ok {
+		t.Error("the new domain of the slot is not indexed")
+	}
+}
+
+func TestSlotCacheResumeIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// Index of the event, and etcd index of the response
+		events [][2]uint64
+		want   uint64
+	}{
+		{"single event", [][2]uint64{{5, 5}}, 5},
+		{"queued events", [][2]uint64{{5, 9}, {7, 9}}, 7},
+		{"older event", [][2]uint64{{7, 9}, {5, 9}}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSlotCache()
+			c.index = 2
+			for i, event := range tt.events {
+				resp := slotEvent("set", testSlot(uint16(2000+i), "sub", "a"), event[0])
+				resp.Index = event[1]
+				c.apply(resp)
+			}
+			if c.index != tt.want {
+				t.Errorf("resume index = %d, want %d", c.index, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotCacheApplyDirectory(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    *client.Response
+		wantLeft []uint16
+	}{
+		{
+			"slotFS deleted",
+			&client.Response{Action: "delete", Index: 10, Node: &client.Node{Key: SlotFSKey, Dir: true, ModifiedIndex: 10}},
+			nil,
+		},
+		{
+			"slotFS expired",
+			&client.Response{Action: "expire", Index: 10, Node: &client.Node{Key: SlotFSKey, Dir: true, ModifiedIndex: 10}},
+			nil,
+		},
+		{
+			"slotFS deleted before a slot update",
+			&client.Response{Action: "delete", Index: 6, Node: &client.Node{Key: SlotFSKey, Dir: true, ModifiedIndex: 6}},
+			[]uint16{2002},
+		},
+		{
+			"slotFS created",
+			&client.Response{Action: "create", Index: 10, Node: &client.Node{Key: SlotFSKey, Dir: true, ModifiedIndex: 10}},
+			[]uint16{2000, 2001, 2002},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSlotCache()
+			c.set(testSlot(2000, "a", "a"), 2)
+			c.set(testSlot(2001, "b", "b"), 3)
+			c.set(testSlot(2002, "c", "c"), 8)
+			c.apply(tt.event)
+			left := map[uint16]bool{}
+			for _, port := range tt.wantLeft {
+				left[port] = true
+			}
+			for _, port := range []uint16{2000, 2001, 2002} {
+				if _, ok := c.forPort(port); ok != left[port] {
+					t.Errorf("slot %d indexed = %v, want %v", port, ok, left[port])
+				}
+			}
+			if c.index != tt.event.Index {
+				t.Errorf("cache index = %d, want %d", c.index, tt.event.Index)
+			}
+		})
+	}
+}
+
+func TestSlotCacheLoad(t *testing.T) {
+	etcd := etcdtest.New()
+	c := newSlotCache()
+	if err := c.load(etcd); err != nil {
+		t.Fatalf("loading a missing slotFS: %v", err)
+	}
+	for i, slot := range []*AgentSlot{testSlot(2000, "a", "a"), testSlot(2001, "b", "b")} {
+		payload, _ := json.Marshal(slot)
+		if _, err := etcd.Set(context.Background(), fmt.Sprintf("%s/%d", SlotFSKey, 2000+i), string(payload), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := etcd.Set(context.Background(), SlotFSKey+"/2002", "not json", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.set(testSlot(2003, "stale", "stale"), 1)
+	if err := c.load(etcd); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.byPort) != 2 || c.index != etcd.Index() {
+		t.Errorf("loaded %d slots at index %d, want 2 at %d", len(c.byPort), c.index, etcd.Index())
+	}
+	if slot, ok := c.forDomain("b.example.com", DefaultTarget); !ok || slot.Port != 2001 {
+		t.Errorf("forDomain() = %v", slot)
+	}
+}
+
+// scanSlotFS is the lookup used before the slot cache: the whole slotFS
+// is read from etcd and deserialized until a slot matches.
+func scanSlotFS(etcd client.KeysAPI, fn func(*AgentSlot) bool) (*AgentSlot, error) {
+	resp, err := etcd.Get(context.Background(), SlotFSKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		slot := &AgentSlot{}
+		if err := json.Unmarshal([]byte(node.Value), slot); err != nil {
+			continue
+		}
+		if fn(slot) {
+			return slot, nil
+		}
+	}
+	return nil, fmt.Errorf("nothing matched in slotFS")
+}
+
+// BenchmarkSlotLookup compares the slotFS scan with the cache lookups,
+// for a gatekeeper holding 5000 slots.
+func BenchmarkSlotLookup(b *testing.B) {
+	const slots = 5000
+	etcd := etcdtest.New()
+	for i := 0; i < slots; i++ {
+		payload, _ := json.Marshal(testSlot(uint16(2000+i), fmt.Sprintf("agent%d", i), fmt.Sprintf("id%d", i)))
+		if _, err := etcd.Set(context.Background(), fmt.Sprintf("%s/%d", SlotFSKey, 2000+i), string(payload), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c := newSlotCache()
+	if err := c.load(etcd); err != nil {
+		b.Fatal(err)
+	}
+	// Look up the slots spread over the slotFS
+	port := func(i int) uint16 { return uint16(2000 + i*7919%slots) }
+
+	b.Run("etcd scan by port", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p := port(i)
+			if _, err := scanSlotFS(etcd, func(s *AgentSlot) bool { return s.Port == p }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("etcd scan by domain", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fqdn := fmt.Sprintf("agent%d.example.com", port(i)-2000)
+			if _, err := scanSlotFS(etcd, func(s *AgentSlot) bool { return s.FQDN() == fqdn }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cache by port", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok := c.forPort(port(i)); !ok {
+				b.Fatal("slot not found")
+			}
+		}
+	})
+	b.Run("cache by domain", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fqdn := fmt.Sprintf("agent%d.example.com", port(i)-2000)
+			if _, ok := c.forDomain(fqdn, DefaultTarget); !ok {
+				b.Fatal("slot not found")
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package gatekeeper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is the HTTP endpoint on which SSH is tunneled through WebSocket.
+const WebSocketPath = "/ssh"
+
+// wsListener hands over the connections tunneled through WebSocket
+// to the SSH server, as if they were accepted on a TCP listener.
+type wsListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wsConn notifies the HTTP handler once the SSH server
+// is done with the connection.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// RemoteAddr returns the HTTP client address,
+// instead of the WebSocket origin.
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (l *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws, done: make(chan struct{})}
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		conn.remote = addr
+	}
+	select {
+	case l.conns <- conn:
+		// Returning from the handler closes the WebSocket
+		<-conn.done
+	case <-l.closed:
+	}
+}
+
+// WithWebSocket enables the SSH over WebSocket transport on `addr:port`,
+// for agents that can only reach the gatekeeper over HTTP(S).
+// TLS is enabled when both `certFile` and `keyFile` are provided.
+func (g *GateKeeper) WithWebSocket(addr string, port uint16, certFile string, keyFile string) *GateKeeper {
+	g.wsAddr = addr
+	g.wsCert = certFile
+	g.wsKey = keyFile
+	g.Meta.WSPort = port
+	g.Meta.WSTLS = len(certFile) > 0 && len(keyFile) > 0
+	return g
+}
+
+// serveWebSocket accepts WebSocket upgrades on WebSocketPath and
+// serves the tunneled SSH connections with `server`.
+func (g *GateKeeper) serveWebSocket(server *ssh.Server) error {
+	addr := net.JoinHostPort(g.wsAddr, fmt.Sprintf("%d", g.Meta.WSPort))
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l := &wsListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		addr:   tcpAddr,
+	}
+	go server.Serve(l)
+
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Server{
+		Handler: l.handle,
+		// Agents are not browsers, any origin is accepted.
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+	})
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	g.drainLock.Lock()
+	g.wsServer = httpServer
+	g.drainLock.Unlock()
+	log.Info().
+		Str("addr", g.wsAddr).
+		Uint16("port", g.Meta.WSPort).
+		Bool("tls", g.Meta.WSTLS).
+		Msg("starting SSH over WebSocket server")
+	if g.Meta.WSTLS {
+		err = httpServer.ListenAndServeTLS(g.wsCert, g.wsKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	l.Close()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -2,13 +2,133 @@ package utils
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 	"go.etcd.io/etcd/client"
 )
 
+// EtcdConfig is the configuration of the connection to the etcd cluster,
+// loaded from the `etcd` section of the configuration.
+type EtcdConfig struct {
+	Endpoints []string
+	// PEM encoded CA certificate used to verify the cluster
+	CAFile string
+	// PEM encoded client certificate and private key
+	CertFile string
+	KeyFile  string
+	// etcd authentication credentials
+	Username string
+	Password string
+}
+
+// GetEtcdConfig returns the etcd configuration from the
+// cli > env > config file > defaults, and validates it.
+func GetEtcdConfig() (EtcdConfig, error) {
+	cfg := EtcdConfig{
+		Endpoints: SplitParts(viper.GetStringSlice("etcd.endpoints")),
+		CAFile:    viper.GetString("etcd.ca_file"),
+		CertFile:  viper.GetString("etcd.cert_file"),
+		KeyFile:   viper.GetString("etcd.key_file"),
+		Username:  viper.GetString("etcd.username"),
+		Password:  viper.GetString("etcd.password"),
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c *EtcdConfig) hasTLS() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// Validate returns an error naming the invalid setting, if any.
+func (c *EtcdConfig) Validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("etcd.endpoints: at least one endpoint is required")
+	}
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("etcd.endpoints: invalid endpoint %q, expected http(s)://host:port", e)
+		}
+		if c.hasTLS() && u.Scheme != "https" {
+			return fmt.Errorf("etcd.endpoints: %s must use https when etcd TLS settings are set", e)
+		}
+		if c.Username != "" && u.Scheme != "https" {
+			log.Warn().
+				Str("endpoint", e).
+				Msg("etcd credentials are sent in clear text, use an https endpoint.")
+		}
+	}
+	if c.Username == "" && c.Password != "" {
+		return errors.New("etcd.username: required when etcd.password is set")
+	}
+	if c.Username != "" && c.Password == "" {
+		return errors.New("etcd.password: required when etcd.username is set")
+	}
+	_, err := c.tlsConfig()
+	return err
+}
+
+// tlsConfig loads the TLS settings, nil if none is set.
+func (c *EtcdConfig) tlsConfig() (*tls.Config, error) {
+	if !c.hasTLS() {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd.ca_file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("etcd.ca_file: no PEM certificate found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile == "" && c.KeyFile != "" {
+		return nil, errors.New("etcd.cert_file: required when etcd.key_file is set")
+	}
+	if c.CertFile != "" && c.KeyFile == "" {
+		return nil, errors.New("etcd.key_file: required when etcd.cert_file is set")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd.cert_file / etcd.key_file: %s", err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// transport returns the HTTP transport to the cluster,
+// client.DefaultTransport if TLS is not configured.
+func (c *EtcdConfig) transport() (client.CancelableTransport, error) {
+	tlsCfg, err := c.tlsConfig()
+	if err != nil || tlsCfg == nil {
+		return client.DefaultTransport, err
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsCfg,
+	}, nil
+}
+
 // WithFixedIntervalRetry calls the function `fn` `retry` times,
 // waiting for the duration indicated by the `wait` parameter between
 // two calls.
@@ -27,10 +147,17 @@ func WithFixedIntervalRetry(fn func() error, retry uint, wait time.Duration) err
 
 // GetEtcdKey configure an etcd client, connects, check the health
 // of the quorum and return the object used to interact with it.
-func GetEtcdKey(etcdEndpoints []string) (*client.KeysAPI, error) {
+func GetEtcdKey(etcdConfig EtcdConfig) (*client.KeysAPI, error) {
+	etcdEndpoints := etcdConfig.Endpoints
+	transport, err := etcdConfig.transport()
+	if err != nil {
+		return nil, err
+	}
 	cfg := client.Config{
 		Endpoints:               etcdEndpoints,
-		Transport:               client.DefaultTransport,
+		Transport:               transport,
+		Username:                etcdConfig.Username,
+		Password:                etcdConfig.Password,
 		HeaderTimeoutPerRequest: time.Second,
 	}
 	c, err := client.New(cfg)
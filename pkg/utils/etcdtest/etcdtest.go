@@ -0,0 +1,242 @@
+// Package etcdtest provides an in-memory etcd v2 keys API for the tests.
+package etcdtest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.etcd.io/etcd/client"
+)
+
+// KeysAPI is an in-memory implementation of the etcd keys API, supporting
+// the conditional writes and (recursive) reads used by rssh. Directories are
+// implicit: they exist as long as a key is stored under them. Watches and TTLs
+// are not supported.
+type KeysAPI struct {
+	lock  sync.Mutex
+	nodes map[string]*client.Node
+	index uint64
+	// Called before each write, a non-nil error fails the write.
+	BeforeWrite func(key string) error
+}
+
+// New returns an empty keys API.
+func New() *KeysAPI {
+	return &KeysAPI{nodes: map[string]*client.Node{}}
+}
+
+func keyNotFound(key string, index uint64) error {
+	return client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key, Index: index}
+}
+
+func testFailed(key string, index uint64) error {
+	return client.Error{Code: client.ErrorCodeTestFailed, Message: "Compare failed", Cause: key, Index: index}
+}
+
+func clean(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// Index returns the index of the last write.
+func (k *KeysAPI) Index() uint64 {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.index
+}
+
+// isDir returns true if keys are stored under `key`.
+// The caller must hold the lock.
+func (k *KeysAPI) isDir(key string) bool {
+	for name := range k.nodes {
+		if strings.HasPrefix(name, key+"/") || key == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// dir builds the node of the directory `key`.
+// The caller must hold the lock.
+func (k *KeysAPI) dir(key string, recursive bool) *client.Node {
+	node := &client.Node{Key: key, Dir: true}
+	children := map[string]bool{}
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	for name := range k.nodes {
+		if strings.HasPrefix(name, prefix) {
+			children[prefix+strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+		}
+	}
+	names := []string{}
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if leaf, ok := k.nodes[name]; ok {
+			copied := *leaf
+			node.Nodes = append(node.Nodes, &copied)
+		} else if recursive {
+			node.Nodes = append(node.Nodes, k.dir(name, true))
+		} else {
+			node.Nodes = append(node.Nodes, &client.Node{Key: name, Dir: true})
+		}
+	}
+	return node
+}
+
+// Get implements client.KeysAPI.
+func (k *KeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key = clean(key)
+	if node, ok := k.nodes[key]; ok {
+		copied := *node
+		return &client.Response{Action: "get", Node: &copied, Index: k.index}, nil
+	}
+	if !k.isDir(key) {
+		return nil, keyNotFound(key, k.index)
+	}
+	return &client.Response{
+		Action: "get",
+		Node:   k.dir(key, opts != nil && opts.Recursive),
+		Index:  k.index,
+	}, nil
+}
+
+// Set implements client.KeysAPI.
+func (k *KeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key = clean(key)
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+	if opts.Dir {
+		return nil, errors.New("etcdtest: explicit directories are not supported")
+	}
+	if k.isDir(key) {
+		return nil, client.Error{Code: client.ErrorCodeNotFile, Message: "Not a file", Cause: key, Index: k.index}
+	}
+	prev, exists := k.nodes[key]
+	switch {
+	case opts.PrevExist == client.PrevNoExist && exists:
+		return nil, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key, Index: k.index}
+	case opts.PrevExist == client.PrevExist && !exists:
+		return nil, keyNotFound(key, k.index)
+	case (opts.PrevValue != "" || opts.PrevIndex != 0) && !exists:
+		return nil, keyNotFound(key, k.index)
+	case opts.PrevValue != "" && prev.Value != opts.PrevValue,
+		opts.PrevIndex != 0 && prev.ModifiedIndex != opts.PrevIndex:
+		return nil, testFailed(key, k.index)
+	}
+	if k.BeforeWrite != nil {
+		if err := k.BeforeWrite(key); err != nil {
+			return nil, err
+		}
+	}
+	k.index++
+	node := &client.Node{Key: key, Value: value, CreatedIndex: k.index, ModifiedIndex: k.index}
+	action := "set"
+	switch {
+	case opts.PrevExist == client.PrevNoExist:
+		action = "create"
+	case opts.PrevValue != "" || opts.PrevIndex != 0:
+		action = "compareAndSwap"
+	}
+	if exists {
+		node.CreatedIndex = prev.CreatedIndex
+	}
+	k.nodes[key] = node
+	copied := *node
+	resp := &client.Response{Action: action, Node: &copied, Index: k.index}
+	if exists {
+		resp.PrevNode = prev
+	}
+	return resp, nil
+}
+
+// Delete implements client.KeysAPI.
+func (k *KeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key = clean(key)
+	if opts == nil {
+		opts = &client.DeleteOptions{}
+	}
+	prev, exists := k.nodes[key]
+	if !exists {
+		if !k.isDir(key) {
+			return nil, keyNotFound(key, k.index)
+		}
+		if !opts.Recursive {
+			return nil, client.Error{Code: client.ErrorCodeNotFile, Message: "Not a file", Cause: key, Index: k.index}
+		}
+		if k.BeforeWrite != nil {
+			if err := k.BeforeWrite(key); err != nil {
+				return nil, err
+			}
+		}
+		k.index++
+		for name := range k.nodes {
+			if strings.HasPrefix(name, key+"/") || key == "/" {
+				delete(k.nodes, name)
+			}
+		}
+		return &client.Response{
+			Action: "delete",
+			Node:   &client.Node{Key: key, Dir: true, ModifiedIndex: k.index},
+			Index:  k.index,
+		}, nil
+	}
+	if opts.PrevValue != "" && prev.Value != opts.PrevValue ||
+		opts.PrevIndex != 0 && prev.ModifiedIndex != opts.PrevIndex {
+		return nil, testFailed(key, k.index)
+	}
+	if k.BeforeWrite != nil {
+		if err := k.BeforeWrite(key); err != nil {
+			return nil, err
+		}
+	}
+	k.index++
+	delete(k.nodes, key)
+	action := "delete"
+	if opts.PrevValue != "" || opts.PrevIndex != 0 {
+		action = "compareAndDelete"
+	}
+	return &client.Response{
+		Action:   action,
+		Node:     &client.Node{Key: key, ModifiedIndex: k.index, CreatedIndex: prev.CreatedIndex},
+		PrevNode: prev,
+		Index:    k.index,
+	}, nil
+}
+
+// Create implements client.KeysAPI.
+func (k *KeysAPI) Create(ctx context.Context, key, value string) (*client.Response, error) {
+	return k.Set(ctx, key, value, &client.SetOptions{PrevExist: client.PrevNoExist})
+}
+
+// CreateInOrder implements client.KeysAPI, it is not supported.
+func (k *KeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *client.CreateInOrderOptions) (*client.Response, error) {
+	return nil, errors.New("etcdtest: in order keys are not supported")
+}
+
+// Update implements client.KeysAPI.
+func (k *KeysAPI) Update(ctx context.Context, key, value string) (*client.Response, error) {
+	return k.Set(ctx, key, value, &client.SetOptions{PrevExist: client.PrevExist})
+}
+
+// Watcher implements client.KeysAPI, the watcher never receives events.
+func (k *KeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return watcher{}
+}
+
+type watcher struct{}
+
+func (watcher) Next(ctx context.Context) (*client.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/client"
+)
+
+// HealthCheck is the result of the check of a dependency.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthStatus is the response of the liveness and readiness endpoints.
+type HealthStatus struct {
+	Ok     bool          `json:"ok"`
+	Time   string        `json:"time"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// NewHealthStatus returns a status healthy if all the checks passed.
+func NewHealthStatus(checks ...HealthCheck) HealthStatus {
+	status := HealthStatus{
+		Ok:     true,
+		Time:   time.Now().String(),
+		Checks: checks,
+	}
+	for _, check := range checks {
+		status.Ok = status.Ok && check.Ok
+	}
+	return status
+}
+
+// CheckEtcdQuorum reads `key` through the raft log,
+// which only succeeds if the cluster has a quorum.
+// A missing key is not an error.
+func CheckEtcdQuorum(etcd client.KeysAPI, key string, timeout time.Duration) HealthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := etcd.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if e, ok := err.(client.Error); !ok || e.Code != client.ErrorCodeKeyNotFound {
+			return HealthCheck{Name: "etcd", Detail: err.Error()}
+		}
+	}
+	return HealthCheck{Name: "etcd", Ok: true, Detail: "quorum reached"}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -21,11 +22,29 @@ func Max(x, y uint16) uint16 {
 	return y
 }
 
-// IsValidDomain : Taken from https://www.socketloop.com/tutorials/golang-use-regular-expression-to-validate-domain-name
+// Maximum length of a domain name, in its textual form
+const maxDomainLength = 253
+
+var domainLabelRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// IsValidLabels returns true if d is a sequence of dot separated DNS labels:
+// alphanumeric characters and hyphens, not starting or ending with a hyphen.
+func IsValidLabels(d string) bool {
+	if len(d) == 0 || len(d) > maxDomainLength {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if !domainLabelRe.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsValidDomain returns true if d is a domain name of at least two labels.
 // Does not validate the tld, so that it can be used with .localhost domains.
 func IsValidDomain(d string) bool {
-	re := regexp.MustCompile(`^(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30})$`)
-	return re.MatchString(d)
+	return strings.Contains(d, ".") && IsValidLabels(d)
 }
 
 // SplitParts Splits {"a,b", "c"} into {"a", "b", "c"}
@@ -45,11 +64,50 @@ func SplitParts(maybeParted []string) []string {
 	return r
 }
 
-// SplitDomainRequest split the fqdn at the first subdomain
-func SplitDomainRequest(fqdn string) (subDomain string, rootDomain string) {
-	domainSlice := strings.Split(fqdn, ".")
-
-	subDomain = domainSlice[0]
-	rootDomain = strings.Join(domainSlice[1:], ".")
+// SplitDomain splits the fqdn into the subdomain and the longest of the
+// root domains it belongs to, ok is false if there is none.
+// Subdomains may have several levels (e.g: db-1.prod.<root>).
+func SplitDomain(fqdn string, roots []string) (subDomain string, rootDomain string, ok bool) {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	for _, root := range roots {
+		root = strings.TrimSuffix(root, ".")
+		if len(root) == 0 || len(root) <= len(rootDomain) {
+			continue
+		}
+		suffix := "." + strings.ToLower(root)
+		if len(fqdn) > len(suffix) && strings.HasSuffix(strings.ToLower(fqdn), suffix) {
+			subDomain = fqdn[:len(fqdn)-len(suffix)]
+			rootDomain = fqdn[len(fqdn)-len(root):]
+			ok = true
+		}
+	}
 	return
 }
+
+// SplitDomainRequest splits the fqdn into the subdomain and the rssh root domain,
+// matching the `roots` domains (see SplitDomain). Names outside of them are only
+// split when there is no ambiguity: a single label subdomain of a two labels root
+// domain (sub.example.com). Otherwise, the root domain has to be configured.
+func SplitDomainRequest(fqdn string, roots []string) (subDomain string, rootDomain string, err error) {
+	if sub, root, ok := SplitDomain(fqdn, roots); ok {
+		return sub, root, nil
+	}
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	switch {
+	case len(labels) < 3:
+		return "", "", fmt.Errorf("%s is not a subdomain of a root domain", fqdn)
+	case len(labels) > 3:
+		return "", "", fmt.Errorf("ambiguous root domain of %s, it has to be configured", fqdn)
+	}
+	return labels[0], strings.Join(labels[1:], "."), nil
+}
+
+// SplitTargetRequest split a `fqdn:target` client request
+// into the fqdn and the (optional) target name
+func SplitTargetRequest(request string) (fqdn string, target string) {
+	idx := strings.LastIndex(request, ":")
+	if idx < 0 {
+		return request, ""
+	}
+	return request[:idx], request[idx+1:]
+}
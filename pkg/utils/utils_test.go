@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidLabels(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"sub", true},
+		{"my-host", true},
+		{"db-1.prod", true},
+		{"DB-1.Prod", true},
+		{"", false},
+		{"-sub", false},
+		{"sub-", false},
+		{"sub..prod", false},
+		{".sub", false},
+		{"sub.", false},
+		{"sub_1", false},
+		{"sub:pg", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+		{strings.Repeat("a.", 126) + "a", true},
+		{strings.Repeat("a.", 127) + "a", false},
+	}
+	for _, tt := range tests {
+		if got := IsValidLabels(tt.domain); got != tt.want {
+			t.Errorf("IsValidLabels(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestSplitDomain(t *testing.T) {
+	roots := []string{"example.com", "prod.example.com", "Other.Example"}
+	tests := []struct {
+		fqdn     string
+		wantSub  string
+		wantRoot string
+		wantOk   bool
+	}{
+		{"sub.example.com", "sub", "example.com", true},
+		{"db-1.dev.example.com", "db-1.dev", "example.com", true},
+		{"db-1.prod.example.com", "db-1", "prod.example.com", true},
+		{"sub.example.com.", "sub", "example.com", true},
+		{"Sub.EXAMPLE.com", "Sub", "EXAMPLE.com", true},
+		{"sub.other.example", "sub", "other.example", true},
+		{"example.com", "", "", false},
+		{"subexample.com", "", "", false},
+		{"sub.example.org", "", "", false},
+	}
+	for _, tt := range tests {
+		sub, root, ok := SplitDomain(tt.fqdn, roots)
+		if sub != tt.wantSub || root != tt.wantRoot || ok != tt.wantOk {
+			t.Errorf("SplitDomain(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.fqdn, sub, root, ok, tt.wantSub, tt.wantRoot, tt.wantOk)
+		}
+	}
+}
+
+func TestSplitDomainRequest(t *testing.T) {
+	roots := []string{"example.com"}
+	tests := []struct {
+		name     string
+		fqdn     string
+		roots    []string
+		wantSub  string
+		wantRoot string
+		wantErr  bool
+	}{
+		{"configured root", "db-1.prod.example.com", roots, "db-1.prod", "example.com", false},
+		{"single label", "sub.example.org", roots, "sub", "example.org", false},
+		{"without roots", "sub.example.org", nil, "sub", "example.org", false},
+		{"ambiguous", "db-1.prod.example.org", roots, "", "", true},
+		{"ambiguous without roots", "pg.sub.example.com", nil, "", "", true},
+		{"root domain", "example.org", nil, "", "", true},
+		{"single name", "localhost", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, root, err := SplitDomainRequest(tt.fqdn, tt.roots)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q, %q", sub, root)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sub != tt.wantSub || root != tt.wantRoot {
+				t.Errorf("SplitDomainRequest() = %q, %q, want %q, %q", sub, root, tt.wantSub, tt.wantRoot)
+			}
+		})
+	}
+}
+
+func TestSplitTargetRequest(t *testing.T) {
+	tests := []struct {
+		request    string
+		wantFqdn   string
+		wantTarget string
+	}{
+		{"sub.example.com", "sub.example.com", ""},
+		{"sub.example.com:pg", "sub.example.com", "pg"},
+		{"sub.example.com:", "sub.example.com", ""},
+		{"sub.example.com:a:pg", "sub.example.com:a", "pg"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		fqdn, target := SplitTargetRequest(tt.request)
+		if fqdn != tt.wantFqdn || target != tt.wantTarget {
+			t.Errorf("SplitTargetRequest(%q) = %q, %q, want %q, %q",
+				tt.request, fqdn, target, tt.wantFqdn, tt.wantTarget)
+		}
+	}
+}